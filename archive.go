@@ -0,0 +1,377 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/forensicanalysis/filetype"
+)
+
+// archiveFS is the file system of a zip or tar file. In contrast to the
+// file systems of archive/zip and go-tarfs, entries with names like "../x",
+// "/x" or duplicates are not dropped, but listed under normalised names.
+type archiveFS struct {
+	root *archiveNode
+}
+
+// archiveNode is a file or directory of an archive.
+type archiveNode struct {
+	// raw is the path element as stored in the archive, name the normalised
+	// name
+	raw, name string
+	// rawPath is the name of the entry in the archive
+	rawPath string
+	// renamed is set if the raw name or path differs from the normalised path
+	renamed bool
+	info    fs.FileInfo
+	open    func() (io.Reader, error)
+	isDir   bool
+
+	children []*archiveNode
+	dirs     map[string]*archiveNode
+	byName   map[string]*archiveNode
+}
+
+func newArchiveDir(raw string) *archiveNode {
+	return &archiveNode{raw: raw, name: raw, isDir: true, dirs: map[string]*archiveNode{}}
+}
+
+// add adds an entry with the raw name of the archive. Directories in the
+// name are merged with existing directories.
+func (a *archiveFS) add(rawPath string, isDir bool, info fs.FileInfo, open func() (io.Reader, error)) {
+	var elems []string
+	for _, elem := range strings.Split(rawPath, "/") {
+		if elem != "" && elem != "." {
+			elems = append(elems, elem)
+		}
+	}
+	if len(elems) == 0 {
+		if isDir {
+			return
+		}
+		elems = []string{rawPath}
+	}
+
+	dir := a.root
+	for _, elem := range elems[:len(elems)-1] {
+		dir = dir.subdir(elem)
+	}
+	last := elems[len(elems)-1]
+	if isDir {
+		n := dir.subdir(last)
+		n.info, n.rawPath = info, rawPath
+		return
+	}
+	dir.children = append(dir.children, &archiveNode{raw: last, rawPath: rawPath, info: info, open: open})
+}
+
+// subdir returns the child directory with the raw name, it is created if
+// it does not exist.
+func (n *archiveNode) subdir(raw string) *archiveNode {
+	if dir, ok := n.dirs[raw]; ok {
+		return dir
+	}
+	dir := newArchiveDir(raw)
+	n.dirs[raw] = dir
+	n.children = append(n.children, dir)
+	return dir
+}
+
+// normalise assigns valid and unique names to all nodes, dir is the
+// normalised path of n.
+func (n *archiveNode) normalise(dir string) {
+	raw := make([]string, len(n.children))
+	for i, child := range n.children {
+		raw[i] = child.raw
+	}
+	n.byName = map[string]*archiveNode{}
+	for i, name := range renameEntries(raw) {
+		child := n.children[i]
+		child.name = name
+		n.byName[name] = child
+		p := path.Join(dir, name)
+		child.renamed = name != child.raw || (child.rawPath != "" && strings.TrimSuffix(child.rawPath, "/") != p)
+		if child.isDir {
+			child.normalise(p)
+		}
+	}
+}
+
+// Open opens the file with the normalised name.
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n := a.root
+	if name != "." {
+		for _, elem := range strings.Split(name, "/") {
+			child, ok := n.byName[elem]
+			if !ok || !n.isDir {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			n = child
+		}
+	}
+	if n.isDir {
+		return &archiveDir{node: n}, nil
+	}
+	r, err := n.open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if rsa, ok := r.(*io.SectionReader); ok {
+		return &archiveSectionFile{archiveFile: archiveFile{node: n, r: r}, rsa: rsa}, nil
+	}
+	return &archiveFile{node: n, r: r}, nil
+}
+
+// Stat returns the fs.FileInfo of the file with the normalised name.
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// Name returns the normalised name.
+func (n *archiveNode) Name() string { return n.name }
+
+// IsDir returns if the node is a directory.
+func (n *archiveNode) IsDir() bool { return n.isDir }
+
+// Type returns the type bits of the node.
+func (n *archiveNode) Type() fs.FileMode { return n.Mode().Type() }
+
+// Info returns the fs.FileInfo of the node.
+func (n *archiveNode) Info() (fs.FileInfo, error) { return n, nil }
+
+// Size returns the size of a file.
+func (n *archiveNode) Size() int64 {
+	if n.info == nil || n.isDir {
+		return 0
+	}
+	return n.info.Size()
+}
+
+// Mode returns the mode of the node, directories without an entry in the
+// archive are readable by all.
+func (n *archiveNode) Mode() fs.FileMode {
+	switch {
+	case n.info == nil:
+		return fs.ModeDir | 0555
+	case n.isDir:
+		return n.info.Mode() | fs.ModeDir
+	}
+	return n.info.Mode()
+}
+
+// ModTime returns the modification time of the entry.
+func (n *archiveNode) ModTime() time.Time {
+	if n.info == nil {
+		return time.Time{}
+	}
+	return n.info.ModTime()
+}
+
+// Sys returns the header of the entry or a *RawName with the header if the
+// name or path of the entry was changed, e.g. for "../x" or "/x".
+func (n *archiveNode) Sys() interface{} {
+	var sys interface{}
+	if n.info != nil {
+		sys = n.info.Sys()
+	}
+	if n.renamed {
+		name := n.rawPath
+		if name == "" {
+			// directory without an entry in the archive
+			name = n.raw
+		}
+		return &RawName{Name: name, Sys: sys}
+	}
+	return sys
+}
+
+type archiveDir struct {
+	node   *archiveNode
+	offset int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.node, nil }
+
+func (d *archiveDir) Read([]byte) (int, error) { return 0, syscall.EISDIR }
+
+func (d *archiveDir) Close() error { return nil }
+
+// ReadDir returns up to n entries of the directory.
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	items := make([]fs.DirEntry, len(d.node.children))
+	for i, child := range d.node.children {
+		items[i] = child
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name() < items[j].Name() })
+	entries, offset, err := dirEntries(n, items, d.offset)
+	d.offset += offset
+	return entries, err
+}
+
+type archiveFile struct {
+	node *archiveNode
+	r    io.Reader
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+
+func (f *archiveFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *archiveFile) Close() error {
+	if closer, ok := f.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// archiveSectionFile is a file that is stored uncompressed and supports
+// random access.
+type archiveSectionFile struct {
+	archiveFile
+	rsa *io.SectionReader
+}
+
+func (f *archiveSectionFile) ReadAt(p []byte, off int64) (int, error) { return f.rsa.ReadAt(p, off) }
+
+func (f *archiveSectionFile) Seek(offset int64, whence int) (int64, error) {
+	return f.rsa.Seek(offset, whence)
+}
+
+// newZipFS creates the file system of a zip file. Stored files support
+// random access, encrypted files can not be opened.
+func newZipFS(zr *zip.Reader, r io.ReaderAt) *archiveFS {
+	a := &archiveFS{root: newArchiveDir(".")}
+	for _, f := range zr.File {
+		f := f
+		a.add(f.Name, strings.HasSuffix(f.Name, "/"), f.FileInfo(), func() (io.Reader, error) {
+			if f.Flags&0x1 != 0 {
+				return nil, &ContainerError{Kind: ErrEncrypted, Format: filetype.Zip, Err: fs.ErrPermission}
+			}
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				return io.NewSectionReader(r, offset, int64(f.UncompressedSize64)), nil
+			}
+			return f.Open()
+		})
+	}
+	a.root.normalise(".")
+	return a
+}
+
+// newTarFS creates the file system of a tar file. The content of files is
+// read from r, only sparse files are read by parsing the archive again. Like
+// tar readers, files are stream-only and do not support random access. Tar
+// files with more than maxEntries entries are rejected if maxEntries is set.
+func newTarFS(r io.ReaderAt, size int64, maxEntries int) (*archiveFS, error) {
+	a := &archiveFS{root: newArchiveDir(".")}
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	opens := map[string]func() (io.Reader, error){}
+	for index := 0; ; index++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if maxEntries > 0 && index >= maxEntries {
+			return nil, entriesError(filetype.Tar, maxEntries)
+		}
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		var open func() (io.Reader, error)
+		switch {
+		case h.Typeflag == tar.TypeLink:
+			open = opens[h.Linkname]
+		case isSparse(h):
+			open = tarEntry(r, size, index)
+		case h.Typeflag == tar.TypeReg || h.Typeflag == '\x00':
+			open = section(r, offset, h.Size)
+		}
+		if open == nil {
+			open = section(r, 0, 0)
+		}
+		opens[h.Name] = open
+		a.add(h.Name, h.Typeflag == tar.TypeDir, h.FileInfo(), open)
+	}
+	a.root.normalise(".")
+	return a, nil
+}
+
+// section reads a file of a tar file, only the io.Reader is exposed.
+func section(r io.ReaderAt, offset, size int64) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		return struct{ io.Reader }{io.NewSectionReader(r, offset, size)}, nil
+	}
+}
+
+// isSparse reports if the content of the entry is not stored contiguously.
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// tarEntry reads the entry with the given index from the start of the
+// archive.
+func tarEntry(r io.ReaderAt, size int64, index int) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		tr := tar.NewReader(io.NewSectionReader(r, 0, size))
+		for i := 0; i <= index; i++ {
+			if _, err := tr.Next(); err != nil {
+				return nil, err
+			}
+		}
+		return tr, nil
+	}
+}
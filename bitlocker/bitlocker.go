@@ -0,0 +1,224 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+// Package bitlocker provides read access to BitLocker encrypted volumes.
+//
+// The FVE metadata of Windows 7 and later volumes is parsed and the volume
+// master key is unlocked with a recovery password, a startup key file (.BEK)
+// or a clear key of a suspended volume. Alternatively the full volume
+// encryption key (FVEK) can be passed directly. AES-CBC with and without the
+// Elephant diffuser as well as AES-XTS encrypted volumes are supported.
+package bitlocker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Signature is the signature of BitLocker volume headers and FVE metadata
+// blocks.
+const Signature = "-FVE-FS-"
+
+var (
+	// ErrNoKey is returned if none of the provided keys unlocks the volume.
+	ErrNoKey = errors.New("bitlocker: no matching key")
+	// ErrUnsupported is returned for volumes that cannot be decrypted.
+	ErrUnsupported = errors.New("bitlocker: unsupported volume")
+)
+
+// Keys contains the key material that is used to unlock a volume.
+type Keys struct {
+	// RecoveryPasswords are 48 digit recovery passwords, the dashes between
+	// the blocks are optional.
+	RecoveryPasswords []string
+	// StartupKeys are the contents of startup key files (.BEK).
+	StartupKeys [][]byte
+	// FVEK is the decrypted full volume encryption key. For volumes using the
+	// Elephant diffuser the tweak key is expected at offset 32.
+	FVEK []byte
+}
+
+// Empty returns true if no key material is set.
+func (k *Keys) Empty() bool {
+	return k == nil || (len(k.RecoveryPasswords) == 0 && len(k.StartupKeys) == 0 && len(k.FVEK) == 0)
+}
+
+// Match checks if the buffer starts with a BitLocker volume header.
+func Match(buf []byte) bool {
+	return len(buf) >= 11 && string(buf[3:11]) == Signature
+}
+
+// Volume is a decrypted view of a BitLocker volume.
+type Volume struct {
+	r    io.ReaderAt
+	size int64
+
+	sectorSize    int64
+	encryptedSize int64
+	headerOffset  int64
+	headerSize    int64
+	metadata      [3]int64
+
+	cipher sectorCipher
+	offset int64
+}
+
+// New unlocks a BitLocker volume with the given keys.
+func New(r io.ReaderAt, size int64, keys *Keys) (*Volume, error) {
+	if keys.Empty() {
+		return nil, ErrNoKey
+	}
+
+	header := make([]byte, 512)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !Match(header) {
+		return nil, errors.New("bitlocker: invalid volume header")
+	}
+	v := &Volume{r: r, size: size, sectorSize: int64(le16(header[0x0b:]))}
+	if v.sectorSize == 0 || v.sectorSize%16 != 0 {
+		return nil, fmt.Errorf("bitlocker: invalid sector size %d", v.sectorSize)
+	}
+	for i := range v.metadata {
+		v.metadata[i] = int64(le64(header[0xb0+8*i:]))
+	}
+	if v.metadata[0] == 0 {
+		return nil, fmt.Errorf("%w: no FVE metadata offsets, Windows Vista volumes are not supported", ErrUnsupported)
+	}
+
+	md, err := readMetadata(r, v.metadata[:])
+	if err != nil {
+		return nil, err
+	}
+	v.encryptedSize = md.encryptedSize
+	v.headerOffset = md.headerOffset
+	v.headerSize = md.headerSectors * v.sectorSize
+
+	fvek := keys.FVEK
+	if len(fvek) == 0 {
+		fvek, err = md.unlock(keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	v.cipher, err = newSectorCipher(md.method, fvek)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Size returns the size of the volume.
+func (v *Volume) Size() int64 { return v.size }
+
+// Read reads decrypted bytes into the passed buffer.
+func (v *Volume) Read(p []byte) (n int, err error) {
+	n, err = v.ReadAt(p, v.offset)
+	v.offset += int64(n)
+	return n, err
+}
+
+// Seek moves the current offset to the given position.
+func (v *Volume) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += v.offset
+	case os.SEEK_END:
+		offset += v.size
+	default:
+		return 0, errors.New("bitlocker: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("bitlocker: negative position")
+	}
+	v.offset = offset
+	return offset, nil
+}
+
+// ReadAt reads decrypted bytes starting at off into the passed buffer.
+func (v *Volume) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	if remaining := v.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	sector := make([]byte, v.sectorSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		start := pos - pos%v.sectorSize
+		if rerr := v.readSector(sector, start); rerr != nil {
+			return n, rerr
+		}
+		n += copy(p[n:], sector[pos-start:])
+	}
+	return n, err
+}
+
+func (v *Volume) readSector(sector []byte, off int64) error {
+	switch {
+	case off < v.headerSize:
+		// the original boot sectors are relocated behind the metadata
+		return v.readEncrypted(sector, v.headerOffset+off)
+	case v.isMetadata(off):
+		for i := range sector {
+			sector[i] = 0
+		}
+		return nil
+	case v.encryptedSize > 0 && off >= v.encryptedSize:
+		// volume is not fully encrypted yet
+		return v.readRaw(sector, off)
+	default:
+		return v.readEncrypted(sector, off)
+	}
+}
+
+func (v *Volume) readEncrypted(sector []byte, off int64) error {
+	if err := v.readRaw(sector, off); err != nil {
+		return err
+	}
+	v.cipher.decrypt(sector, off, off/v.sectorSize)
+	return nil
+}
+
+func (v *Volume) readRaw(sector []byte, off int64) error {
+	n, err := v.r.ReadAt(sector, off)
+	if err == io.EOF && n == len(sector) {
+		err = nil
+	}
+	return err
+}
+
+func (v *Volume) isMetadata(off int64) bool {
+	for _, m := range v.metadata {
+		if m != 0 && off >= m && off < m+metadataBlockSize {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package bitlocker
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+const (
+	testSectorSize    = 512
+	testHeaderSectors = 16
+	testHeaderOffset  = 0x40000
+	testVolumeSize    = 0x50000
+	testPassword      = "111111-222222-333333-444444-555555-666666-123420-011011"
+)
+
+var testMetadataOffsets = []int64{0x10000, 0x20000, 0x30000}
+
+type protector struct {
+	protection uint16
+	key        []byte
+}
+
+func entryBytes(typ, valueType uint16, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint16(b, uint16(8+len(data)))
+	binary.LittleEndian.PutUint16(b[2:], typ)
+	binary.LittleEndian.PutUint16(b[4:], valueType)
+	binary.LittleEndian.PutUint16(b[6:], 1)
+	return append(b, data...)
+}
+
+func keyEntry(method uint16, key []byte) []byte {
+	data := make([]byte, 4, 4+len(key))
+	binary.LittleEndian.PutUint32(data, uint32(method))
+	return entryBytes(0, valueTypeKey, append(data, key...))
+}
+
+func ccmEncryptedEntry(typ uint16, key, plain []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	nonce := make([]byte, 12)
+	rand.Read(nonce) // nolint
+
+	data := append(ccmMAC(block, nonce, plain), plain...)
+	counter := make([]byte, aes.BlockSize)
+	counter[0] = 2
+	copy(counter[1:13], nonce)
+	cipher.NewCTR(block, counter).XORKeyStream(data, data)
+
+	return entryBytes(typ, valueTypeAESCCMKey, append(nonce, data...))
+}
+
+func testGUID(i int) []byte {
+	return bytes.Repeat([]byte{byte(i + 1)}, 16)
+}
+
+func vmkEntry(id []byte, p protector, vmk []byte) []byte {
+	data := make([]byte, 28)
+	copy(data, id)
+	binary.LittleEndian.PutUint16(data[26:], p.protection)
+
+	key := p.key
+	switch p.protection {
+	case protectionClearKey:
+		data = append(data, keyEntry(methodAES256CBC, p.key)...)
+	case protectionRecoveryPassword:
+		salt := bytes.Repeat([]byte{0x5a}, 16)
+		data = append(data, entryBytes(0, valueTypeStretchKey, append(make([]byte, 4), salt...))...)
+		key, _ = recoveryPasswordKey(testPassword, salt)
+	}
+	data = append(data, ccmEncryptedEntry(0, key, keyEntry(0x2000, vmk))...)
+	return entryBytes(entryTypeVMK, valueTypeVMK, data)
+}
+
+func startupKeyFile(id, key []byte) []byte {
+	data := append(append([]byte{}, id...), make([]byte, 8)...)
+	data = append(data, keyEntry(0x2000, key)...)
+	entries := entryBytes(entryTypeStartupKey, valueTypeExternalKey, data)
+
+	header := make([]byte, metadataHeaderSize)
+	binary.LittleEndian.PutUint32(header, uint32(metadataHeaderSize+len(entries)))
+	binary.LittleEndian.PutUint32(header[4:], 1)
+	binary.LittleEndian.PutUint32(header[8:], metadataHeaderSize)
+	return append(header, entries...)
+}
+
+func metadataBlock(method uint16, fvek []byte, protectors []protector) []byte {
+	vmk := make([]byte, 32)
+	rand.Read(vmk) // nolint
+
+	var entries []byte
+	for i, p := range protectors {
+		entries = append(entries, vmkEntry(testGUID(i), p, vmk)...)
+	}
+	entries = append(entries, ccmEncryptedEntry(entryTypeFVEK, vmk, keyEntry(method, fvek))...)
+
+	block := make([]byte, blockHeaderSize+metadataHeaderSize)
+	copy(block, Signature)
+	binary.LittleEndian.PutUint16(block[0x0a:], 2)
+	binary.LittleEndian.PutUint64(block[0x10:], testVolumeSize)
+	binary.LittleEndian.PutUint32(block[0x1c:], testHeaderSectors)
+	for i, offset := range testMetadataOffsets {
+		binary.LittleEndian.PutUint64(block[0x20+8*i:], uint64(offset))
+	}
+	binary.LittleEndian.PutUint64(block[0x38:], testHeaderOffset)
+
+	header := block[blockHeaderSize:]
+	binary.LittleEndian.PutUint32(header, uint32(metadataHeaderSize+len(entries)))
+	binary.LittleEndian.PutUint32(header[4:], 1)
+	binary.LittleEndian.PutUint32(header[8:], metadataHeaderSize)
+	binary.LittleEndian.PutUint32(header[0x24:], uint32(method))
+	return append(block, entries...)
+}
+
+func diffuserAEncrypt(d []uint32) {
+	n := len(d)
+	for cycle := 0; cycle < 5; cycle++ {
+		for i := n - 1; i >= 0; i-- {
+			d[i] -= d[(i-2+n)%n] ^ rotl(d[(i-5+n)%n], diffuserARotations[i%4])
+		}
+	}
+}
+
+func diffuserBEncrypt(d []uint32) {
+	n := len(d)
+	for cycle := 0; cycle < 3; cycle++ {
+		for i := n - 1; i >= 0; i-- {
+			d[i] -= d[(i+2)%n] ^ rotl(d[(i+5)%n], diffuserBRotations[i%4])
+		}
+	}
+}
+
+func encryptSector(c sectorCipher, sector []byte, offset int64) {
+	switch c := c.(type) {
+	case *cbcCipher:
+		iv := encodeOffset(offset)
+		c.block.Encrypt(iv, iv)
+		cipher.NewCBCEncrypter(c.block, iv).CryptBlocks(sector, sector)
+	case *diffuserCipher:
+		key := c.sectorKey(offset)
+		for i := range sector {
+			sector[i] ^= key[i%len(key)]
+		}
+		words := make([]uint32, len(sector)/4)
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint32(sector[i*4:])
+		}
+		diffuserAEncrypt(words)
+		diffuserBEncrypt(words)
+		for i, w := range words {
+			binary.LittleEndian.PutUint32(sector[i*4:], w)
+		}
+		encryptSector(&c.cbcCipher, sector, offset)
+	case *xtsCipher:
+		t := encodeOffset(offset / testSectorSize)
+		c.tweak.Encrypt(t, t)
+		for i := 0; i < len(sector); i += aes.BlockSize {
+			b := sector[i : i+aes.BlockSize]
+			xor(b, t)
+			c.block.Encrypt(b, b)
+			xor(b, t)
+			xtsMultiply(t)
+		}
+	}
+}
+
+// testVolume creates a synthetic BitLocker volume and returns the encrypted
+// volume and the expected decrypted data.
+func testVolume(t *testing.T, method uint16, fvek []byte, protectors []protector) (encrypted, plain []byte) {
+	c, err := newSectorCipher(method, fvek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain = make([]byte, testVolumeSize)
+	rand.Read(plain) // nolint
+	for _, offset := range testMetadataOffsets {
+		copy(plain[offset:offset+metadataBlockSize], make([]byte, metadataBlockSize))
+	}
+	headerSize := testHeaderSectors * testSectorSize
+	copy(plain[testHeaderOffset:], plain[:headerSize])
+
+	encrypted = make([]byte, testVolumeSize)
+	for offset := int64(headerSize); offset < testVolumeSize; offset += testSectorSize {
+		sector := encrypted[offset : offset+testSectorSize]
+		copy(sector, plain[offset:])
+		encryptSector(c, sector, offset)
+	}
+
+	copy(encrypted[3:], Signature)
+	binary.LittleEndian.PutUint16(encrypted[0x0b:], testSectorSize)
+	for i, offset := range testMetadataOffsets {
+		binary.LittleEndian.PutUint64(encrypted[0xb0+8*i:], uint64(offset))
+	}
+	encrypted[510], encrypted[511] = 0x55, 0xaa
+
+	block := metadataBlock(method, fvek, protectors)
+	for _, offset := range testMetadataOffsets {
+		copy(encrypted[offset:offset+metadataBlockSize], make([]byte, metadataBlockSize))
+		copy(encrypted[offset:], block)
+	}
+	return encrypted, plain
+}
+
+func TestNew(t *testing.T) {
+	startup := bytes.Repeat([]byte{0x42}, 32)
+	clear := bytes.Repeat([]byte{0x17}, 32)
+	fvek := make([]byte, 64)
+	rand.Read(fvek) // nolint
+
+	tests := []struct {
+		name       string
+		method     uint16
+		protectors []protector
+		keys       *Keys
+		wantErr    error
+	}{
+		{"recovery password", methodAES128Diffuser, []protector{{protection: protectionRecoveryPassword}}, &Keys{RecoveryPasswords: []string{testPassword}}, nil},
+		{"wrong recovery password", methodAES128Diffuser, []protector{{protection: protectionRecoveryPassword}}, &Keys{RecoveryPasswords: []string{"000000-000000-000000-000000-000000-000000-000000-000000"}}, ErrNoKey},
+		{"startup key", methodAES256Diffuser, []protector{{protection: protectionStartupKey, key: startup}}, &Keys{StartupKeys: [][]byte{startupKeyFile(testGUID(0), startup)}}, nil},
+		{"startup key second protector", methodAES128CBC, []protector{{protection: protectionClearKey, key: clear}, {protection: protectionStartupKey, key: startup}}, &Keys{StartupKeys: [][]byte{startupKeyFile(testGUID(1), startup)}}, nil},
+		{"wrong startup key", methodAES128CBC, []protector{{protection: protectionStartupKey, key: startup}}, &Keys{StartupKeys: [][]byte{startupKeyFile(testGUID(3), startup)}}, ErrNoKey},
+		{"clear key", methodAES256CBC, []protector{{protection: protectionClearKey, key: clear}}, &Keys{StartupKeys: [][]byte{{}}}, nil},
+		{"fvek xts 128", methodAES128XTS, nil, &Keys{FVEK: fvek}, nil},
+		{"fvek xts 256", methodAES256XTS, nil, &Keys{FVEK: fvek}, nil},
+		{"no keys", methodAES256XTS, nil, &Keys{}, ErrNoKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, plain := testVolume(t, tt.method, fvek, tt.protectors)
+
+			v, err := New(bytes.NewReader(encrypted), int64(len(encrypted)), tt.keys)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got := make([]byte, len(plain))
+			if _, err := v.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("decrypted volume differs")
+			}
+
+			// unaligned reads
+			got = make([]byte, 1000)
+			if _, err := v.ReadAt(got, 0x41234); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain[0x41234:0x41234+1000]) {
+				t.Errorf("unaligned read differs")
+			}
+		})
+	}
+}
+
+func TestRecoveryPasswordKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"valid", testPassword, false},
+		{"without dashes", "111111222222333333444444555555666666123420011011", false},
+		{"too short", "111111-222222", true},
+		{"not divisible by 11", "111112-222222-333333-444444-555555-666666-123420-011011", true},
+		{"too large", "999999-222222-333333-444444-555555-666666-123420-011011", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := recoveryPasswordKey(tt.password, make([]byte, 16))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("recoveryPasswordKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	header := make([]byte, 512)
+	if Match(header) {
+		t.Error("Match() = true for empty header")
+	}
+	copy(header[3:], Signature)
+	if !Match(header) {
+		t.Error("Match() = false for BitLocker header")
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package bitlocker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Encryption methods.
+const (
+	methodAES128Diffuser = 0x8000
+	methodAES256Diffuser = 0x8001
+	methodAES128CBC      = 0x8002
+	methodAES256CBC      = 0x8003
+	methodAES128XTS      = 0x8004
+	methodAES256XTS      = 0x8005
+)
+
+const stretchIterations = 0x100000
+
+// recoveryPasswordKey derives the key that protects the volume master key from
+// a recovery password.
+func recoveryPasswordKey(password string, salt []byte) ([]byte, error) {
+	password = strings.ReplaceAll(strings.TrimSpace(password), "-", "")
+	if len(password) != 48 {
+		return nil, errors.New("bitlocker: recovery password must have 48 digits")
+	}
+
+	key := make([]byte, 16)
+	for i := 0; i < 8; i++ {
+		block, err := strconv.Atoi(password[i*6 : i*6+6])
+		if err != nil || block%11 != 0 || block/11 > 0xffff {
+			return nil, fmt.Errorf("bitlocker: invalid recovery password block %d", i+1)
+		}
+		binary.LittleEndian.PutUint16(key[i*2:], uint16(block/11))
+	}
+
+	initial := sha256.Sum256(key)
+	return stretchKey(initial[:], salt), nil
+}
+
+func stretchKey(initial, salt []byte) []byte {
+	// last hash | initial hash | salt | counter
+	var state [88]byte
+	copy(state[32:64], initial)
+	copy(state[64:80], salt)
+	for i := uint64(0); i < stretchIterations; i++ {
+		binary.LittleEndian.PutUint64(state[80:], i)
+		last := sha256.Sum256(state[:])
+		copy(state[:32], last[:])
+	}
+	return state[:32]
+}
+
+// ccmDecrypt decrypts AES-CCM data that starts with the 16 byte message
+// authentication code and verifies it.
+func ccmDecrypt(key, nonce, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize {
+		return nil, errors.New("bitlocker: invalid AES-CCM data")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// counter blocks with a 12 byte nonce and 3 byte counter
+	counter := make([]byte, aes.BlockSize)
+	counter[0] = 2
+	copy(counter[1:13], nonce)
+
+	stream := cipher.NewCTR(block, counter)
+	plain := make([]byte, len(data))
+	stream.XORKeyStream(plain, data)
+	mac, plain := plain[:aes.BlockSize], plain[aes.BlockSize:]
+
+	if subtle.ConstantTimeCompare(mac, ccmMAC(block, nonce, plain)) != 1 {
+		return nil, errors.New("bitlocker: AES-CCM authentication failed")
+	}
+	return plain, nil
+}
+
+func ccmMAC(block cipher.Block, nonce, plain []byte) []byte {
+	mac := make([]byte, aes.BlockSize)
+	mac[0] = 0x3a // 16 byte MAC, 3 byte length
+	copy(mac[1:13], nonce)
+	mac[13] = byte(len(plain) >> 16)
+	mac[14] = byte(len(plain) >> 8)
+	mac[15] = byte(len(plain))
+	block.Encrypt(mac, mac)
+
+	for i := 0; i < len(plain); i += aes.BlockSize {
+		end := i + aes.BlockSize
+		if end > len(plain) {
+			end = len(plain)
+		}
+		xor(mac, plain[i:end])
+		block.Encrypt(mac, mac)
+	}
+	return mac
+}
+
+type sectorCipher interface {
+	// decrypt decrypts a sector in place. The offset is the byte offset of
+	// the sector and the number its index.
+	decrypt(sector []byte, offset, number int64)
+}
+
+func newSectorCipher(method uint16, key []byte) (sectorCipher, error) {
+	size := 16
+	if method == methodAES256Diffuser || method == methodAES256CBC || method == methodAES256XTS {
+		size = 32
+	}
+
+	switch method {
+	case methodAES128CBC, methodAES256CBC:
+		if len(key) < size {
+			return nil, fmt.Errorf("bitlocker: FVEK too short")
+		}
+		block, err := aes.NewCipher(key[:size])
+		return &cbcCipher{block: block}, err
+	case methodAES128Diffuser, methodAES256Diffuser:
+		if len(key) < 32+size {
+			return nil, fmt.Errorf("bitlocker: FVEK too short")
+		}
+		block, err := aes.NewCipher(key[:size])
+		if err != nil {
+			return nil, err
+		}
+		tweak, err := aes.NewCipher(key[32 : 32+size])
+		return &diffuserCipher{cbcCipher{block: block}, tweak}, err
+	case methodAES128XTS, methodAES256XTS:
+		if len(key) < 2*size {
+			return nil, fmt.Errorf("bitlocker: FVEK too short")
+		}
+		block, err := aes.NewCipher(key[:size])
+		if err != nil {
+			return nil, err
+		}
+		tweak, err := aes.NewCipher(key[size : 2*size])
+		return &xtsCipher{block: block, tweak: tweak}, err
+	default:
+		return nil, fmt.Errorf("%w: encryption method 0x%04x", ErrUnsupported, method)
+	}
+}
+
+// encodeOffset returns the 16 byte little endian encoding of a sector offset.
+func encodeOffset(offset int64) []byte {
+	b := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint64(b, uint64(offset))
+	return b
+}
+
+type cbcCipher struct {
+	block cipher.Block
+}
+
+func (c *cbcCipher) decrypt(sector []byte, offset, _ int64) {
+	iv := encodeOffset(offset)
+	c.block.Encrypt(iv, iv)
+	cipher.NewCBCDecrypter(c.block, iv).CryptBlocks(sector, sector)
+}
+
+// diffuserCipher implements AES-CBC with the Elephant diffuser.
+type diffuserCipher struct {
+	cbcCipher
+	tweak cipher.Block
+}
+
+func (c *diffuserCipher) decrypt(sector []byte, offset, number int64) {
+	c.cbcCipher.decrypt(sector, offset, number)
+
+	words := make([]uint32, len(sector)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(sector[i*4:])
+	}
+	diffuserBDecrypt(words)
+	diffuserADecrypt(words)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(sector[i*4:], w)
+	}
+
+	key := c.sectorKey(offset)
+	for i := range sector {
+		sector[i] ^= key[i%len(key)]
+	}
+}
+
+func (c *diffuserCipher) sectorKey(offset int64) []byte {
+	key := make([]byte, 2*aes.BlockSize)
+	e := encodeOffset(offset)
+	c.tweak.Encrypt(key[:aes.BlockSize], e)
+	e[15] = 0x80
+	c.tweak.Encrypt(key[aes.BlockSize:], e)
+	return key
+}
+
+var (
+	diffuserARotations = [4]uint{9, 0, 13, 0}
+	diffuserBRotations = [4]uint{0, 10, 0, 25}
+)
+
+func xor(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+func rotl(v uint32, n uint) uint32 { return v<<n | v>>(32-n) }
+
+func diffuserADecrypt(d []uint32) {
+	n := len(d)
+	for cycle := 0; cycle < 5; cycle++ {
+		for i := 0; i < n; i++ {
+			d[i] += d[(i-2+n)%n] ^ rotl(d[(i-5+n)%n], diffuserARotations[i%4])
+		}
+	}
+}
+
+func diffuserBDecrypt(d []uint32) {
+	n := len(d)
+	for cycle := 0; cycle < 3; cycle++ {
+		for i := 0; i < n; i++ {
+			d[i] += d[(i+2)%n] ^ rotl(d[(i+5)%n], diffuserBRotations[i%4])
+		}
+	}
+}
+
+type xtsCipher struct {
+	block, tweak cipher.Block
+}
+
+func (c *xtsCipher) decrypt(sector []byte, _, number int64) {
+	t := encodeOffset(number)
+	c.tweak.Encrypt(t, t)
+	for i := 0; i+aes.BlockSize <= len(sector); i += aes.BlockSize {
+		b := sector[i : i+aes.BlockSize]
+		xor(b, t)
+		c.block.Decrypt(b, b)
+		xor(b, t)
+		xtsMultiply(t)
+	}
+}
+
+// xtsMultiply multiplies the tweak by the primitive element of GF(2^128).
+func xtsMultiply(t []byte) {
+	var carry byte
+	for i := range t {
+		next := t[i] >> 7
+		t[i] = t[i]<<1 | carry
+		carry = next
+	}
+	if carry != 0 {
+		t[0] ^= 0x87
+	}
+}
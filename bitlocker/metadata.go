@@ -0,0 +1,275 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package bitlocker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	metadataBlockSize  = 0x10000
+	blockHeaderSize    = 64
+	metadataHeaderSize = 48
+)
+
+// FVE metadata entry types.
+const (
+	entryTypeVMK        = 0x0002
+	entryTypeFVEK       = 0x0003
+	entryTypeStartupKey = 0x0006
+)
+
+// FVE metadata value types.
+const (
+	valueTypeKey         = 0x0001
+	valueTypeStretchKey  = 0x0003
+	valueTypeAESCCMKey   = 0x0005
+	valueTypeVMK         = 0x0008
+	valueTypeExternalKey = 0x0009
+)
+
+// Key protection types of volume master keys.
+const (
+	protectionClearKey         = 0x0000
+	protectionStartupKey       = 0x0200
+	protectionRecoveryPassword = 0x0800
+)
+
+type entry struct {
+	typ       uint16
+	valueType uint16
+	data      []byte
+}
+
+type metadata struct {
+	encryptedSize int64
+	headerSectors int64
+	headerOffset  int64
+	method        uint16
+	entries       []entry
+}
+
+func le16(b []byte) uint16 { return binary.LittleEndian.Uint16(b) }
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+func le64(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+// readMetadata reads the first valid of the redundant FVE metadata blocks.
+func readMetadata(r io.ReaderAt, offsets []int64) (md *metadata, err error) {
+	for _, offset := range offsets {
+		md, err = readMetadataBlock(r, offset)
+		if err == nil {
+			return md, nil
+		}
+	}
+	return nil, err
+}
+
+func readMetadataBlock(r io.ReaderAt, offset int64) (*metadata, error) {
+	head := make([]byte, blockHeaderSize+metadataHeaderSize)
+	if _, err := r.ReadAt(head, offset); err != nil {
+		return nil, err
+	}
+	if string(head[:8]) != Signature {
+		return nil, fmt.Errorf("bitlocker: invalid FVE metadata block at %d", offset)
+	}
+	if version := le16(head[0x0a:]); version != 2 {
+		return nil, fmt.Errorf("%w: FVE metadata version %d", ErrUnsupported, version)
+	}
+	md := &metadata{
+		encryptedSize: int64(le64(head[0x10:])),
+		headerSectors: int64(le32(head[0x1c:])),
+		headerOffset:  int64(le64(head[0x38:])),
+	}
+
+	header := head[blockHeaderSize:]
+	size := int64(le32(header))
+	if size < metadataHeaderSize || size > metadataBlockSize-blockHeaderSize {
+		return nil, fmt.Errorf("bitlocker: invalid FVE metadata size %d", size)
+	}
+	md.method = uint16(le32(header[0x24:]))
+
+	data := make([]byte, size-metadataHeaderSize)
+	if _, err := r.ReadAt(data, offset+blockHeaderSize+metadataHeaderSize); err != nil {
+		return nil, err
+	}
+	entries, err := parseEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	md.entries = entries
+	return md, nil
+}
+
+func parseEntries(b []byte) (entries []entry, err error) {
+	for len(b) >= 8 {
+		size := int(le16(b))
+		if size == 0 {
+			break
+		}
+		if size < 8 || size > len(b) {
+			return nil, fmt.Errorf("bitlocker: invalid FVE metadata entry size %d", size)
+		}
+		entries = append(entries, entry{typ: le16(b[2:]), valueType: le16(b[4:]), data: b[8:size]})
+		b = b[size:]
+	}
+	return entries, nil
+}
+
+func findValue(entries []entry, valueType uint16) *entry {
+	for i := range entries {
+		if entries[i].valueType == valueType {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// unlock decrypts the volume master key with one of the keys and uses it to
+// decrypt the full volume encryption key.
+func (md *metadata) unlock(keys *Keys) ([]byte, error) {
+	var vmk []byte
+	for _, e := range md.entries {
+		if e.typ != entryTypeVMK || e.valueType != valueTypeVMK || len(e.data) < 28 {
+			continue
+		}
+		key, err := unlockVMK(e.data, keys)
+		if err == nil {
+			vmk = key
+			break
+		}
+	}
+	if vmk == nil {
+		return nil, ErrNoKey
+	}
+
+	for _, e := range md.entries {
+		if e.typ == entryTypeFVEK && e.valueType == valueTypeAESCCMKey {
+			return decryptKey(vmk, e.data)
+		}
+	}
+	return nil, errors.New("bitlocker: no FVEK in metadata")
+}
+
+func unlockVMK(data []byte, keys *Keys) ([]byte, error) {
+	id := data[:16]
+	protection := le16(data[26:])
+	properties, err := parseEntries(data[28:])
+	if err != nil {
+		return nil, err
+	}
+	encrypted := findValue(properties, valueTypeAESCCMKey)
+	if encrypted == nil {
+		return nil, ErrNoKey
+	}
+
+	var candidates [][]byte
+	switch protection {
+	case protectionClearKey:
+		if clear := findValue(properties, valueTypeKey); clear != nil && len(clear.data) > 4 {
+			candidates = append(candidates, clear.data[4:])
+		}
+	case protectionRecoveryPassword:
+		stretch := findValue(properties, valueTypeStretchKey)
+		if stretch == nil || len(stretch.data) < 20 {
+			return nil, ErrNoKey
+		}
+		for _, password := range keys.RecoveryPasswords {
+			key, err := recoveryPasswordKey(password, stretch.data[4:20])
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, key)
+		}
+	case protectionStartupKey:
+		for _, bek := range keys.StartupKeys {
+			key, err := startupKey(bek, id)
+			if err == nil {
+				candidates = append(candidates, key)
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if vmk, err := decryptKey(candidate, encrypted.data); err == nil {
+			return vmk, nil
+		}
+	}
+	return nil, ErrNoKey
+}
+
+// decryptKey decrypts an AES-CCM encrypted key value and returns the
+// contained key data.
+func decryptKey(key, data []byte) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("bitlocker: invalid encrypted key")
+	}
+	plain, err := ccmDecrypt(key, data[:12], data[12:])
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseEntries(plain)
+	if err != nil {
+		return nil, err
+	}
+	k := findValue(entries, valueTypeKey)
+	if k == nil || len(k.data) <= 4 {
+		return nil, errors.New("bitlocker: invalid decrypted key")
+	}
+	return k.data[4:], nil
+}
+
+// startupKey extracts the external key with the given identifier from the
+// content of a startup key file.
+func startupKey(bek []byte, id []byte) ([]byte, error) {
+	if len(bek) < metadataHeaderSize {
+		return nil, errors.New("bitlocker: invalid startup key file")
+	}
+	size := int(le32(bek))
+	if size < metadataHeaderSize || size > len(bek) {
+		return nil, errors.New("bitlocker: invalid startup key file")
+	}
+	entries, err := parseEntries(bek[metadataHeaderSize:size])
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.typ != entryTypeStartupKey || e.valueType != valueTypeExternalKey || len(e.data) < 24 {
+			continue
+		}
+		if !bytes.Equal(e.data[:16], id) {
+			continue
+		}
+		properties, err := parseEntries(e.data[24:])
+		if err != nil {
+			return nil, err
+		}
+		if k := findValue(properties, valueTypeKey); k != nil && len(k.data) > 4 {
+			return k.data[4:], nil
+		}
+	}
+	return nil, ErrNoKey
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+// Package btrfs provides a read-only io/fs implementation of the Btrfs file
+// system.
+//
+// The root of the file system is the default subvolume, named subvolumes and
+// snapshots appear as directories where they are linked. Inline, regular and
+// preallocated extents are supported, compressed extents can use zlib, LZO or
+// zstd. Only single device file systems are supported.
+package btrfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// SuperblockOffset is the position of the primary superblock.
+const SuperblockOffset = 0x10000
+
+const (
+	superblockMagic = "_BHRfS_M"
+	superblockSize  = 0x1000
+	sysChunkArray   = 0x32b
+
+	rootTreeDirObjectID = 6
+	fsTreeObjectID      = 5
+	maxNodeLevel        = 8
+)
+
+// Match checks if the buffer starts with a Btrfs superblock.
+func Match(buf []byte) bool {
+	return len(buf) >= 0x48 && string(buf[0x40:0x48]) == superblockMagic
+}
+
+func le16(b []byte) uint16 { return binary.LittleEndian.Uint16(b) }
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+func le64(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+// chunk maps a range of logical addresses to the first stripe on the device.
+type chunk struct {
+	logical  uint64
+	length   uint64
+	physical uint64
+}
+
+// FS implements a read-only file system for Btrfs.
+type FS struct {
+	r          io.ReaderAt
+	nodeSize   uint32
+	sectorSize uint32
+	chunks     []chunk
+	rootTree   uint64
+	defaultID  uint64
+}
+
+// New creates a new btrfs FS.
+func New(r io.ReaderAt) (*FS, error) {
+	b := make([]byte, superblockSize)
+	if _, err := r.ReadAt(b, SuperblockOffset); err != nil {
+		return nil, err
+	}
+	if !Match(b) {
+		return nil, errors.New("btrfs: invalid superblock")
+	}
+	if numDevices := le64(b[0x88:]); numDevices != 1 {
+		return nil, fmt.Errorf("btrfs: %d devices are not supported", numDevices)
+	}
+
+	fsys := &FS{
+		r:          r,
+		sectorSize: le32(b[0x90:]),
+		nodeSize:   le32(b[0x94:]),
+	}
+	if fsys.nodeSize < 1024 || fsys.nodeSize > 0x10000 || fsys.sectorSize == 0 {
+		return nil, errors.New("btrfs: invalid superblock geometry")
+	}
+
+	sysChunkSize := le32(b[0xa0:])
+	if sysChunkSize > superblockSize-sysChunkArray {
+		return nil, errors.New("btrfs: invalid system chunk array")
+	}
+	if err := fsys.addChunks(b[sysChunkArray : sysChunkArray+sysChunkSize]); err != nil {
+		return nil, err
+	}
+
+	// the chunk tree describes the mapping of all other chunks
+	err := fsys.search(le64(b[0x58:]), key{}, maxKey, func(k key, data []byte) error {
+		if k.typ != chunkItemKey {
+			return nil
+		}
+		_, err := fsys.addChunk(k, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fsys.rootTree = le64(b[0x50:])
+	if fsys.defaultID, err = fsys.defaultSubvolume(); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// addChunks parses the system chunk array of the superblock.
+func (fsys *FS) addChunks(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < keySize {
+			return errors.New("btrfs: invalid system chunk array")
+		}
+		n, err := fsys.addChunk(parseKey(b), b[keySize:])
+		if err != nil {
+			return err
+		}
+		b = b[keySize+n:]
+	}
+	return nil
+}
+
+// addChunk adds the mapping of a chunk item and returns the item size.
+func (fsys *FS) addChunk(k key, b []byte) (int, error) {
+	if len(b) < chunkItemSize {
+		return 0, errors.New("btrfs: invalid chunk item")
+	}
+	numStripes := int(le16(b[44:]))
+	size := chunkItemSize + numStripes*stripeSize
+	if numStripes == 0 || len(b) < size {
+		return 0, errors.New("btrfs: invalid chunk item")
+	}
+	if typ := le64(b[24:]); typ&blockGroupProfileMask&^blockGroupMirrored != 0 {
+		return 0, fmt.Errorf("btrfs: unsupported chunk profile %#x", typ&blockGroupProfileMask)
+	}
+
+	c := chunk{logical: k.offset, length: le64(b), physical: le64(b[chunkItemSize+8:])}
+	i := sort.Search(len(fsys.chunks), func(i int) bool { return fsys.chunks[i].logical >= c.logical })
+	if i < len(fsys.chunks) && fsys.chunks[i].logical == c.logical {
+		fsys.chunks[i] = c
+		return size, nil
+	}
+	fsys.chunks = append(fsys.chunks, chunk{})
+	copy(fsys.chunks[i+1:], fsys.chunks[i:])
+	fsys.chunks[i] = c
+	return size, nil
+}
+
+// physical translates a logical address into a device offset and returns the
+// number of bytes that are contiguous from there.
+func (fsys *FS) physical(logical uint64) (int64, uint64, error) {
+	i := sort.Search(len(fsys.chunks), func(i int) bool { return fsys.chunks[i].logical > logical })
+	if i == 0 {
+		return 0, 0, fmt.Errorf("btrfs: logical address %#x not mapped", logical)
+	}
+	c := fsys.chunks[i-1]
+	if logical-c.logical >= c.length {
+		return 0, 0, fmt.Errorf("btrfs: logical address %#x not mapped", logical)
+	}
+	return int64(c.physical + logical - c.logical), c.length - (logical - c.logical), nil
+}
+
+// readLogical reads len(b) bytes at a logical address.
+func (fsys *FS) readLogical(b []byte, logical uint64) error {
+	for len(b) > 0 {
+		off, available, err := fsys.physical(logical)
+		if err != nil {
+			return err
+		}
+		n := len(b)
+		if uint64(n) > available {
+			n = int(available)
+		}
+		if _, err := fsys.r.ReadAt(b[:n], off); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		b = b[n:]
+		logical += uint64(n)
+	}
+	return nil
+}
+
+// defaultSubvolume looks up the "default" entry of the root tree directory.
+func (fsys *FS) defaultSubvolume() (uint64, error) {
+	id := uint64(fsTreeObjectID)
+	min := key{objectID: rootTreeDirObjectID, typ: dirItemKey}
+	max := key{objectID: rootTreeDirObjectID, typ: dirItemKey, offset: ^uint64(0)}
+	err := fsys.search(fsys.rootTree, min, max, func(k key, data []byte) error {
+		items, err := parseDirItems(data)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.name == "default" {
+				id = item.location.objectID
+			}
+		}
+		return nil
+	})
+	return id, err
+}
+
+// subvolume returns the tree root and root directory of a subvolume.
+func (fsys *FS) subvolume(id uint64) (*subvolume, error) {
+	var sv *subvolume
+	min := key{objectID: id, typ: rootItemKey}
+	max := key{objectID: id, typ: rootItemKey, offset: ^uint64(0)}
+	err := fsys.search(fsys.rootTree, min, max, func(k key, data []byte) error {
+		if len(data) < rootItemSize {
+			return errors.New("btrfs: invalid root item")
+		}
+		sv = &subvolume{id: id, root: le64(data[176:]), dirID: le64(data[168:])}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sv == nil {
+		return nil, fmt.Errorf("btrfs: subvolume %d not found", id)
+	}
+	return sv, nil
+}
+
+// Open opens a file or directory for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	sv, err := fsys.subvolume(fsys.defaultID)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	in, err := fsys.inode(sv, sv.dirID)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	base := "."
+	if name != "." {
+		for _, part := range strings.Split(name, "/") {
+			if !in.isDir() {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			entries, err := fsys.readDir(in)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			var found *DirEntry
+			for _, entry := range entries {
+				if entry.name == part {
+					found = entry
+					break
+				}
+			}
+			if found == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			if in, err = found.inode(); err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+		base = name[strings.LastIndex(name, "/")+1:]
+	}
+	return &File{fsys: fsys, inode: in, name: base}, nil
+}
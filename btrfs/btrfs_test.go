@@ -0,0 +1,401 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package btrfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	testNodeSize  = 4096
+	testImageSize = 0x100000
+
+	// logical addresses of the second chunk are mapped to testMapped
+	testChunk  = 0x10000000
+	testMapped = 0xc0000
+)
+
+type testItem struct {
+	k    key
+	data []byte
+	ptr  uint64
+}
+
+type testImage struct {
+	b []byte
+}
+
+func (img *testImage) at(logical uint64) []byte {
+	if logical >= testChunk {
+		logical = logical - testChunk + testMapped
+	}
+	return img.b[logical:]
+}
+
+func keyBytes(k key) []byte {
+	b := make([]byte, keySize)
+	binary.LittleEndian.PutUint64(b, k.objectID)
+	b[8] = k.typ
+	binary.LittleEndian.PutUint64(b[9:], k.offset)
+	return b
+}
+
+func (img *testImage) node(logical uint64, level uint8, items ...testItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].k.less(items[j].k) })
+	b := img.at(logical)[:testNodeSize]
+	binary.LittleEndian.PutUint64(b[48:], logical)
+	binary.LittleEndian.PutUint32(b[96:], uint32(len(items)))
+	b[100] = level
+	end := testNodeSize
+	for i, item := range items {
+		if level > 0 {
+			p := b[headerSize+i*nodePtrSize:]
+			copy(p, keyBytes(item.k))
+			binary.LittleEndian.PutUint64(p[17:], item.ptr)
+			continue
+		}
+		end -= len(item.data)
+		copy(b[end:], item.data)
+		p := b[headerSize+i*leafItemSize:]
+		copy(p, keyBytes(item.k))
+		binary.LittleEndian.PutUint32(p[17:], uint32(end-headerSize))
+		binary.LittleEndian.PutUint32(p[21:], uint32(len(item.data)))
+	}
+}
+
+func chunkItem(length, physical uint64) []byte {
+	b := make([]byte, chunkItemSize+stripeSize)
+	binary.LittleEndian.PutUint64(b, length)
+	binary.LittleEndian.PutUint64(b[16:], 0x10000)
+	binary.LittleEndian.PutUint64(b[24:], 2)
+	binary.LittleEndian.PutUint16(b[44:], 1)
+	binary.LittleEndian.PutUint64(b[chunkItemSize:], 1)
+	binary.LittleEndian.PutUint64(b[chunkItemSize+8:], physical)
+	return b
+}
+
+func rootItem(root uint64) []byte {
+	b := make([]byte, rootItemSize)
+	binary.LittleEndian.PutUint64(b[168:], firstFreeObjID)
+	binary.LittleEndian.PutUint64(b[176:], root)
+	return b
+}
+
+func inodeItem(ino uint64, mode uint32, size int) testItem {
+	b := make([]byte, inodeItemSize)
+	binary.LittleEndian.PutUint64(b[16:], uint64(size))
+	binary.LittleEndian.PutUint32(b[40:], 1)
+	binary.LittleEndian.PutUint32(b[52:], mode)
+	binary.LittleEndian.PutUint64(b[136:], 1600000000)
+	return testItem{k: key{objectID: ino, typ: inodeItemKey}, data: b}
+}
+
+func dirItemBytes(location key, typ uint8, name string) []byte {
+	b := make([]byte, dirItemSize+len(name))
+	copy(b, keyBytes(location))
+	binary.LittleEndian.PutUint16(b[27:], uint16(len(name)))
+	b[29] = typ
+	copy(b[dirItemSize:], name)
+	return b
+}
+
+func dirIndex(dir, index, ino uint64, typ uint8, name string) testItem {
+	location := key{objectID: ino, typ: inodeItemKey}
+	return testItem{k: key{objectID: dir, typ: dirIndexKey, offset: index}, data: dirItemBytes(location, typ, name)}
+}
+
+func subvolumeIndex(dir, index, id uint64, name string) testItem {
+	location := key{objectID: id, typ: rootItemKey, offset: ^uint64(0)}
+	return testItem{k: key{objectID: dir, typ: dirIndexKey, offset: index}, data: dirItemBytes(location, ftypeDir, name)}
+}
+
+func inlineExtent(ino uint64, compression uint8, size int, data []byte) testItem {
+	b := make([]byte, fileExtentHeader+len(data))
+	binary.LittleEndian.PutUint64(b[8:], uint64(size))
+	b[16] = compression
+	b[20] = extentInline
+	copy(b[fileExtentHeader:], data)
+	return testItem{k: key{objectID: ino, typ: extentDataKey}, data: b}
+}
+
+func regularExtent(ino, offset uint64, typ, compression uint8, bytenr, diskBytes, diskOffset, length, ram uint64) testItem {
+	b := make([]byte, fileExtentSize)
+	binary.LittleEndian.PutUint64(b[8:], ram)
+	b[16] = compression
+	b[20] = typ
+	binary.LittleEndian.PutUint64(b[21:], bytenr)
+	binary.LittleEndian.PutUint64(b[29:], diskBytes)
+	binary.LittleEndian.PutUint64(b[37:], diskOffset)
+	binary.LittleEndian.PutUint64(b[45:], length)
+	return testItem{k: key{objectID: ino, typ: extentDataKey, offset: offset}, data: b}
+}
+
+// testLZO is a LZO1X stream with a literal run and all match types.
+var (
+	testLZO = []byte{
+		21, 'a', 'b', 'c', 'd', // literals
+		236, 0, // copy 8 bytes at distance 4
+		1, 'w', 'x', 'y', 'z', // literals
+		35, 62, 0, 'X', 'Y', // copy 5 bytes at distance 16 and two literals
+		8, 0, // copy 2 bytes at distance 3
+		17, 0, 0, // end of stream
+	}
+	testLZOData = []byte("abcdabcdabcdwxyzabcdaXYaX")
+)
+
+var (
+	testZlibData = bytes.Repeat([]byte("zlib "), 100)
+	testZstdData = bytes.Repeat([]byte("zstd compressed data "), 500)
+)
+
+func newTestImage(t *testing.T, defaultSubvolume uint64) *testImage {
+	img := &testImage{b: make([]byte, testImageSize)}
+
+	sb := img.b[SuperblockOffset:]
+	copy(sb[0x40:], superblockMagic)
+	binary.LittleEndian.PutUint64(sb[0x50:], 0x21000)
+	binary.LittleEndian.PutUint64(sb[0x58:], 0x20000)
+	binary.LittleEndian.PutUint64(sb[0x88:], 1)
+	binary.LittleEndian.PutUint32(sb[0x90:], 4096)
+	binary.LittleEndian.PutUint32(sb[0x94:], testNodeSize)
+	sys := append(keyBytes(key{objectID: firstFreeObjID, typ: chunkItemKey}), chunkItem(testChunk, 0)...)
+	binary.LittleEndian.PutUint32(sb[0xa0:], uint32(len(sys)))
+	copy(sb[sysChunkArray:], sys)
+
+	img.node(0x20000, 0, testItem{k: key{objectID: firstFreeObjID, typ: chunkItemKey, offset: testChunk}, data: chunkItem(0x40000, testMapped)})
+
+	// root tree with two leaves
+	img.node(0x21000, 1,
+		testItem{k: key{objectID: fsTreeObjectID, typ: rootItemKey}, ptr: 0x22000},
+		testItem{k: key{objectID: rootTreeDirObjectID, typ: dirItemKey}, ptr: 0x23000},
+	)
+	img.node(0x22000, 0,
+		testItem{k: key{objectID: fsTreeObjectID, typ: rootItemKey}, data: rootItem(testChunk)},
+	)
+	img.node(0x23000, 0,
+		testItem{k: key{objectID: rootTreeDirObjectID, typ: dirItemKey, offset: 0x1234}, data: append(
+			dirItemBytes(key{objectID: 300, typ: inodeItemKey}, ftypeRegular, "other"),
+			dirItemBytes(key{objectID: defaultSubvolume, typ: rootItemKey, offset: ^uint64(0)}, ftypeDir, "default")...,
+		)},
+		testItem{k: key{objectID: firstFreeObjID, typ: rootItemKey}, data: rootItem(0x24000)},
+	)
+
+	lzo := make([]byte, 8, 8+len(testLZO))
+	binary.LittleEndian.PutUint32(lzo, uint32(8+len(testLZO)))
+	binary.LittleEndian.PutUint32(lzo[4:], uint32(len(testLZO)))
+	lzo = append(lzo, testLZO...)
+	copy(img.at(0x30000), lzo)
+
+	var zlibData bytes.Buffer
+	zw := zlib.NewWriter(&zlibData)
+	if _, err := zw.Write(testZlibData); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdData := enc.EncodeAll(testZstdData, nil)
+	copy(img.at(0x31000), zstdData)
+
+	copy(img.at(testChunk+0x2000), bytes.Repeat([]byte("s"), 4096))
+
+	// default file system tree in the second chunk
+	img.node(testChunk, 0,
+		inodeItem(256, modeDir|0755, 0),
+		dirIndex(256, 2, 257, ftypeRegular, "hello.txt"),
+		dirIndex(256, 3, 258, ftypeDir, "sub"),
+		subvolumeIndex(256, 4, firstFreeObjID, "vol"),
+		dirIndex(256, 5, 261, 0, "link"),
+		inodeItem(257, modeRegular|0644, 11),
+		inlineExtent(257, compressionNone, 11, []byte("hello world")),
+		inodeItem(258, modeDir|0755, 0),
+		dirIndex(258, 2, 259, ftypeRegular, "zlib.txt"),
+		dirIndex(258, 3, 260, ftypeRegular, "lzo.txt"),
+		dirIndex(258, 4, 262, ftypeRegular, "zstd.txt"),
+		dirIndex(258, 5, 263, ftypeRegular, "sparse.bin"),
+		inodeItem(259, modeRegular|0644, len(testZlibData)),
+		inlineExtent(259, compressionZlib, len(testZlibData), zlibData.Bytes()),
+		inodeItem(260, modeRegular|0644, len(testLZOData)),
+		regularExtent(260, 0, extentRegular, compressionLZO, 0x30000, 4096, 0, 4096, 4096),
+		inodeItem(261, modeSymlink|0777, 9),
+		inlineExtent(261, compressionNone, 9, []byte("hello.txt")),
+		inodeItem(262, modeRegular|0644, len(testZstdData)),
+		regularExtent(262, 0, extentRegular, compressionZstd, 0x31000, 4096, 0, 12288, 12288),
+		inodeItem(263, modeRegular|0644, 3*4096),
+		regularExtent(263, 4096, extentRegular, compressionNone, testChunk+0x1000, 8192, 4096, 4096, 8192),
+		regularExtent(263, 8192, extentPrealloc, compressionNone, testChunk+0x3000, 4096, 0, 4096, 4096),
+	)
+
+	// named subvolume
+	img.node(0x24000, 0,
+		inodeItem(256, modeDir|0755, 0),
+		dirIndex(256, 2, 257, ftypeRegular, "inner.txt"),
+		inodeItem(257, modeRegular|0644, 16),
+		inlineExtent(257, compressionNone, 16, []byte("inside subvolume")),
+	)
+	return img
+}
+
+func TestFS(t *testing.T) {
+	fsys, err := New(bytes.NewReader(newTestImage(t, fsTreeObjectID).b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(fsys, "hello.txt", "link", "sub/zlib.txt", "sub/lzo.txt", "sub/zstd.txt", "sub/sparse.bin", "vol/inner.txt"); err != nil {
+		t.Error(err)
+	}
+
+	want := map[string][]byte{
+		"hello.txt":      []byte("hello world"),
+		"link":           []byte("hello.txt"),
+		"sub/zlib.txt":   testZlibData,
+		"sub/lzo.txt":    testLZOData,
+		"sub/zstd.txt":   testZstdData,
+		"sub/sparse.bin": append(append(make([]byte, 4096), bytes.Repeat([]byte("s"), 4096)...), make([]byte, 4096)...),
+		"vol/inner.txt":  []byte("inside subvolume"),
+	}
+	for name, data := range want {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("ReadFile(%s) = %q, want %q", name, got, data)
+		}
+	}
+
+	info, err := fs.Stat(fsys, "vol/inner.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*Stat); stat.Subvolume != firstFreeObjID || stat.Inode != 257 {
+		t.Errorf("Sys() = %+v", stat)
+	}
+	info, err = fs.Stat(fsys, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("link mode = %s", info.Mode())
+	}
+
+	entries, err := fs.ReadDir(fsys, "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		f, err := entry.(*DirEntry).Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		if err != nil || !bytes.Equal(got, want["vol/"+entry.Name()]) {
+			t.Errorf("Open() of entry %s = %q, %v", entry.Name(), got, err)
+		}
+	}
+}
+
+func TestDefaultSubvolume(t *testing.T) {
+	fsys, err := New(bytes.NewReader(newTestImage(t, firstFreeObjID).b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "inner.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(bytes.NewReader(make([]byte, testImageSize))); err == nil {
+		t.Error("New() error = nil for empty image")
+	}
+
+	img := newTestImage(t, fsTreeObjectID)
+	binary.LittleEndian.PutUint64(img.b[SuperblockOffset+0x88:], 2)
+	if _, err := New(bytes.NewReader(img.b)); err == nil {
+		t.Error("New() error = nil for multi device file system")
+	}
+}
+
+func TestCompressedExtentSize(t *testing.T) {
+	fsys, err := New(bytes.NewReader(newTestImage(t, fsTreeObjectID).b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		extent extent
+	}{
+		{"disk bytes", extent{length: 4096, typ: extentRegular, compression: compressionZlib, diskBytenr: 0x30000, diskNumBytes: 1 << 40, ramBytes: 4096}},
+		{"ram bytes", extent{length: 4096, typ: extentRegular, compression: compressionZlib, diskBytenr: 0x30000, diskNumBytes: 4096, ramBytes: 1 << 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reader{fsys: fsys, extents: []extent{tt.extent}, size: 4096, cached: -1}
+			if _, err := r.ReadAt(make([]byte, 4096), 0); err == nil {
+				t.Error("ReadAt() error = nil")
+			}
+		})
+	}
+
+	if _, err := decompress(compressionZlib, nil, 1<<40, 4096); err == nil {
+		t.Error("decompress() error = nil")
+	}
+}
+
+func TestDecompressLZO(t *testing.T) {
+	// the second segment header would cross the sector boundary
+	segment := append([]byte{17 + 4, 'a', 'b', 'c', 'd'}, 17, 0, 0)
+	src := make([]byte, 8, 16)
+	binary.LittleEndian.PutUint32(src[4:], uint32(len(segment)))
+	src = append(src, segment...)
+	src = append(src, 0, 0, byte(len(segment)), 0, 0, 0)
+	src = append(src, segment...)
+	binary.LittleEndian.PutUint32(src, uint32(len(src)))
+
+	got, err := decompressLZO(src, 8, 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdabcd" {
+		t.Errorf("decompressLZO() = %q", got)
+	}
+
+	if _, err := decompressLZO([]byte{12, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0}, 8, 4096); err == nil {
+		t.Error("decompressLZO() error = nil for invalid data")
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package btrfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = 0
+	compressionZlib = 1
+	compressionLZO  = 2
+	compressionZstd = 3
+
+	// maxCompressedExtent is the maximal size of compressed extents, before
+	// and after decompression
+	maxCompressedExtent = 128 << 10
+)
+
+// decompress decompresses the data of an extent into at most size bytes.
+func decompress(compression uint8, src []byte, size, sectorSize int) ([]byte, error) {
+	if size < 0 || size > maxCompressedExtent {
+		return nil, fmt.Errorf("btrfs: invalid decompressed extent size %d", size)
+	}
+	switch compression {
+	case compressionZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		dst := make([]byte, size)
+		n, err := io.ReadFull(zr, dst)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return dst[:n], nil
+	case compressionLZO:
+		return decompressLZO(src, size, sectorSize)
+	case compressionZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(src), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		dst := make([]byte, size)
+		n, err := io.ReadFull(zr, dst)
+		// extents are padded to the sector size after the frame
+		if err != nil && err != io.ErrUnexpectedEOF && !(errors.Is(err, zstd.ErrMagicMismatch) && n > 0) {
+			return nil, err
+		}
+		return dst[:n], nil
+	}
+	return nil, fmt.Errorf("btrfs: unsupported compression %d", compression)
+}
+
+var errLZO = errors.New("btrfs: invalid lzo data")
+
+// decompressLZO decompresses the Btrfs LZO format. The data starts with the
+// total length, followed by segments with a length header and LZO1X data for
+// one sector each. Segment headers never cross a sector boundary.
+func decompressLZO(src []byte, size, sectorSize int) ([]byte, error) {
+	if len(src) < 4 {
+		return nil, errLZO
+	}
+	total := int(le32(src))
+	if total > len(src) || total < 4 {
+		return nil, errLZO
+	}
+	src = src[:total]
+
+	dst := make([]byte, 0, size)
+	pos := 4
+	for pos < total && len(dst) < size {
+		if remaining := sectorSize - pos%sectorSize; remaining < 4 {
+			pos += remaining
+			if pos >= total {
+				break
+			}
+		}
+		if pos+4 > total {
+			return nil, errLZO
+		}
+		segment := int(le32(src[pos:]))
+		pos += 4
+		if segment > total-pos {
+			return nil, errLZO
+		}
+		var err error
+		if dst, err = lzo1xDecompress(dst, src[pos:pos+segment]); err != nil {
+			return nil, err
+		}
+		pos += segment
+	}
+	if len(dst) > size {
+		dst = dst[:size]
+	}
+	return dst, nil
+}
+
+// lzo1xDecompress appends the decompressed LZO1X stream src to dst.
+func lzo1xDecompress(dst, src []byte) ([]byte, error) {
+	start := len(dst)
+	in := 0
+	next := func() (int, error) {
+		if in >= len(src) {
+			return 0, errLZO
+		}
+		in++
+		return int(src[in-1]), nil
+	}
+	// length reads the zero bytes extension of a length field
+	length := func(t int) (int, error) {
+		for in < len(src) && src[in] == 0 {
+			t += 255
+			in++
+		}
+		b, err := next()
+		return t + b, err
+	}
+	literals := func(t int) error {
+		if in+t > len(src) {
+			return errLZO
+		}
+		dst = append(dst, src[in:in+t]...)
+		in += t
+		return nil
+	}
+	match := func(distance, t int) error {
+		pos := len(dst) - distance
+		if pos < start || distance <= 0 {
+			return errLZO
+		}
+		for i := 0; i < t; i++ {
+			dst = append(dst, dst[pos+i])
+		}
+		return nil
+	}
+
+	state := 0
+	if len(src) > 0 && src[0] > 17 {
+		t := int(src[0]) - 17
+		in++
+		if err := literals(t); err != nil {
+			return nil, err
+		}
+		if t < 4 {
+			state = t
+		} else {
+			state = 4
+		}
+	}
+
+	for {
+		t, err := next()
+		if err != nil {
+			return nil, err
+		}
+		var distance, count, trailing int
+		switch {
+		case t < 16 && state == 0:
+			// literal run
+			if t == 0 {
+				if t, err = length(15); err != nil {
+					return nil, err
+				}
+			}
+			if err := literals(t + 3); err != nil {
+				return nil, err
+			}
+			state = 4
+			continue
+		case t < 16:
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			trailing = t & 3
+			if state == 4 {
+				// three byte match after a literal run
+				distance, count = 1+0x800+t>>2+b<<2, 3
+			} else {
+				distance, count = 1+t>>2+b<<2, 2
+			}
+		case t >= 64:
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			trailing = t & 3
+			distance, count = 1+(t>>2)&7+b<<3, t>>5+1
+		case t >= 32:
+			count = t & 31
+			if count == 0 {
+				if count, err = length(31); err != nil {
+					return nil, err
+				}
+			}
+			count += 2
+			if in+2 > len(src) {
+				return nil, errLZO
+			}
+			d := int(le16(src[in:]))
+			in += 2
+			trailing = d & 3
+			distance = 1 + d>>2
+		default:
+			count = t & 7
+			if count == 0 {
+				if count, err = length(7); err != nil {
+					return nil, err
+				}
+			}
+			count += 2
+			if in+2 > len(src) {
+				return nil, errLZO
+			}
+			d := int(le16(src[in:]))
+			in += 2
+			trailing = d & 3
+			distance = (t&8)<<11 + d>>2
+			if distance == 0 {
+				// end of stream
+				if count != 3 {
+					return nil, errLZO
+				}
+				return dst, nil
+			}
+			distance += 0x4000
+		}
+
+		if err := match(distance, count); err != nil {
+			return nil, err
+		}
+		if err := literals(trailing); err != nil {
+			return nil, err
+		}
+		state = trailing
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+)
+
+const (
+	ftypeRegular = 1
+	ftypeDir     = 2
+	ftypeSymlink = 7
+
+	extentInline   = 0
+	extentRegular  = 1
+	extentPrealloc = 2
+
+	fileExtentHeader = 21
+	fileExtentSize   = 53
+)
+
+// File is a file or directory of the file system.
+type File struct {
+	fsys      *FS
+	inode     *inode
+	name      string
+	data      *reader
+	offset    int64
+	dirOffset int
+}
+
+func (f *File) reader() (*reader, error) {
+	if f.data != nil {
+		return f.data, nil
+	}
+	extents, err := f.fsys.extents(f.inode)
+	if err != nil {
+		return nil, err
+	}
+	f.data = &reader{fsys: f.fsys, extents: extents, size: f.inode.size, cached: -1}
+	return f.data, nil
+}
+
+// Read reads bytes into the passed buffer.
+func (f *File) Read(p []byte) (n int, err error) {
+	if f.inode.isDir() {
+		return 0, syscall.EISDIR
+	}
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads bytes starting at off into the passed buffer.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.inode.isDir() {
+		return 0, syscall.EISDIR
+	}
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.ReadAt(p, off)
+}
+
+// Seek moves the current offset to the given position.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.inode.size
+	default:
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir returns up to n child items of a directory.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.inode.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	dirEntries, err := f.fsys.readDir(f.inode)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(dirEntries, func(i, j int) bool { return dirEntries[i].name < dirEntries[j].name })
+	entries := make([]fs.DirEntry, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		entries = append(entries, entry)
+	}
+
+	return direntries.Read(n, entries, &f.dirOffset)
+}
+
+// Stat returns the fs.FileInfo of the file.
+func (f *File) Stat() (fs.FileInfo, error) {
+	return &FileInfo{name: f.name, inode: f.inode}, nil
+}
+
+// Close does not do anything for Btrfs files.
+func (f *File) Close() error { return nil }
+
+// Stat contains Btrfs specific attributes of a file.
+type Stat struct {
+	Subvolume    uint64
+	Inode        uint64
+	UID, GID     uint32
+	Nlink        uint32
+	AccessTime   time.Time
+	ChangeTime   time.Time
+	CreationTime time.Time
+}
+
+// FileInfo describes a file or directory.
+type FileInfo struct {
+	name  string
+	inode *inode
+}
+
+func (fi *FileInfo) Name() string { return fi.name }
+
+func (fi *FileInfo) Size() int64 {
+	if fi.inode.isDir() {
+		return 0
+	}
+	return fi.inode.size
+}
+
+func (fi *FileInfo) Mode() fs.FileMode { return fi.inode.fileMode() }
+
+func (fi *FileInfo) ModTime() time.Time { return fi.inode.mtime }
+
+func (fi *FileInfo) IsDir() bool { return fi.inode.isDir() }
+
+// Sys returns the *Stat of the file.
+func (fi *FileInfo) Sys() interface{} {
+	return &Stat{
+		Subvolume:    fi.inode.subvolume.id,
+		Inode:        fi.inode.ino,
+		UID:          fi.inode.uid,
+		GID:          fi.inode.gid,
+		Nlink:        fi.inode.nlink,
+		AccessTime:   fi.inode.atime,
+		ChangeTime:   fi.inode.ctime,
+		CreationTime: fi.inode.otime,
+	}
+}
+
+// DirEntry is an entry of a directory. Entries that point to the root of
+// another subvolume are directories.
+type DirEntry struct {
+	fsys      *FS
+	subvolume *subvolume
+	name      string
+	location  key
+	ftype     uint8
+}
+
+func (e *DirEntry) Name() string { return e.name }
+
+func (e *DirEntry) IsDir() bool { return e.Type().IsDir() }
+
+func (e *DirEntry) Type() fs.FileMode {
+	switch e.ftype {
+	case ftypeRegular:
+		return 0
+	case ftypeDir:
+		return fs.ModeDir
+	case ftypeSymlink:
+		return fs.ModeSymlink
+	}
+	info, err := e.Info()
+	if err != nil {
+		return fs.ModeIrregular
+	}
+	return info.Mode().Type()
+}
+
+func (e *DirEntry) Info() (fs.FileInfo, error) {
+	in, err := e.inode()
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{name: e.name, inode: in}, nil
+}
+
+// Open opens the file of the entry by its inode, so names that are not
+// unique or contain a slash can be opened.
+func (e *DirEntry) Open() (fs.File, error) {
+	in, err := e.inode()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: e.name, Err: err}
+	}
+	return &File{fsys: e.fsys, inode: in, name: e.name}, nil
+}
+
+func (e *DirEntry) inode() (*inode, error) {
+	switch e.location.typ {
+	case inodeItemKey:
+		return e.fsys.inode(e.subvolume, e.location.objectID)
+	case rootItemKey:
+		sv, err := e.fsys.subvolume(e.location.objectID)
+		if err != nil {
+			return nil, err
+		}
+		return e.fsys.inode(sv, sv.dirID)
+	}
+	return nil, fmt.Errorf("btrfs: invalid directory entry location type %d", e.location.typ)
+}
+
+type extent struct {
+	offset       int64 // position in the file
+	length       int64
+	typ          uint8
+	compression  uint8
+	inline       []byte
+	diskBytenr   uint64
+	diskNumBytes uint64
+	diskOffset   uint64 // position in the decompressed extent
+	ramBytes     uint64
+}
+
+func (fsys *FS) extents(in *inode) ([]extent, error) {
+	var extents []extent
+	min := key{objectID: in.ino, typ: extentDataKey}
+	max := key{objectID: in.ino, typ: extentDataKey, offset: ^uint64(0)}
+	err := fsys.search(in.subvolume.root, min, max, func(k key, b []byte) error {
+		if len(b) < fileExtentHeader {
+			return errors.New("btrfs: invalid file extent item")
+		}
+		e := extent{
+			offset:      int64(k.offset),
+			typ:         b[20],
+			compression: b[16],
+			ramBytes:    le64(b[8:]),
+		}
+		if b[17] != 0 || le16(b[18:]) != 0 {
+			return errors.New("btrfs: encrypted extents are not supported")
+		}
+		switch e.typ {
+		case extentInline:
+			e.inline = append([]byte{}, b[fileExtentHeader:]...)
+			e.length = int64(e.ramBytes)
+		case extentRegular, extentPrealloc:
+			if len(b) < fileExtentSize {
+				return errors.New("btrfs: invalid file extent item")
+			}
+			e.diskBytenr = le64(b[21:])
+			e.diskNumBytes = le64(b[29:])
+			e.diskOffset = le64(b[37:])
+			e.length = int64(le64(b[45:]))
+		default:
+			return fmt.Errorf("btrfs: invalid file extent type %d", e.typ)
+		}
+		extents = append(extents, e)
+		return nil
+	})
+	return extents, err
+}
+
+// reader reads the data of a file through its extents, holes and
+// preallocated extents are read as zeros.
+type reader struct {
+	fsys    *FS
+	extents []extent
+	size    int64
+
+	cached       int // index of the decompressed extent
+	decompressed []byte
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := p[n:]
+		i := sort.Search(len(r.extents), func(i int) bool {
+			return r.extents[i].offset+r.extents[i].length > pos
+		})
+		if i == len(r.extents) || r.extents[i].offset > pos {
+			// hole
+			if i < len(r.extents) && r.extents[i].offset-pos < int64(len(chunk)) {
+				chunk = chunk[:r.extents[i].offset-pos]
+			}
+			n += zero(chunk)
+			continue
+		}
+
+		e := &r.extents[i]
+		within := pos - e.offset
+		if available := e.length - within; int64(len(chunk)) > available {
+			chunk = chunk[:available]
+		}
+		switch {
+		case e.typ == extentPrealloc || (e.typ == extentRegular && e.diskBytenr == 0):
+			n += zero(chunk)
+		case e.compression != compressionNone:
+			data, derr := r.decompress(i)
+			if derr != nil {
+				return n, derr
+			}
+			n += copyOrZero(chunk, data, int64(e.diskOffset)+within)
+		case e.typ == extentInline:
+			n += copyOrZero(chunk, e.inline, within)
+		default:
+			if rerr := r.fsys.readLogical(chunk, e.diskBytenr+e.diskOffset+uint64(within)); rerr != nil {
+				return n, rerr
+			}
+			n += len(chunk)
+		}
+	}
+	return n, err
+}
+
+// decompress returns the decompressed data of an extent, the last extent is
+// kept so sequential reads do not decompress the same data again.
+func (r *reader) decompress(i int) ([]byte, error) {
+	if r.cached == i {
+		return r.decompressed, nil
+	}
+	e := &r.extents[i]
+	if e.diskNumBytes > maxCompressedExtent || e.ramBytes > maxCompressedExtent {
+		return nil, fmt.Errorf("btrfs: compressed extent of %d bytes (%d on disk) is too large", e.ramBytes, e.diskNumBytes)
+	}
+	src := e.inline
+	if e.typ == extentRegular {
+		src = make([]byte, e.diskNumBytes)
+		if err := r.fsys.readLogical(src, e.diskBytenr); err != nil {
+			return nil, err
+		}
+	}
+	data, err := decompress(e.compression, src, int(e.ramBytes), int(r.fsys.sectorSize))
+	if err != nil {
+		return nil, err
+	}
+	r.cached, r.decompressed = i, data
+	return data, nil
+}
+
+// copyOrZero copies data from src starting at off and fills the remainder of
+// dst with zeros.
+func copyOrZero(dst, src []byte, off int64) int {
+	var n int
+	if off < int64(len(src)) {
+		n = copy(dst, src[off:])
+	}
+	zero(dst[n:])
+	return len(dst)
+}
+
+func zero(b []byte) int {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b)
+}
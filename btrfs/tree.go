@@ -0,0 +1,264 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+const (
+	inodeItemKey  = 1
+	dirItemKey    = 84
+	dirIndexKey   = 96
+	extentDataKey = 108
+	rootItemKey   = 132
+	chunkItemKey  = 228
+
+	keySize        = 17
+	headerSize     = 101
+	leafItemSize   = 25
+	nodePtrSize    = 33
+	chunkItemSize  = 48
+	stripeSize     = 32
+	inodeItemSize  = 160
+	rootItemSize   = 239
+	dirItemSize    = 30
+	firstFreeObjID = 256
+
+	blockGroupProfileMask = 0x7f8
+	blockGroupMirrored    = 1<<4 | 1<<5 | 1<<9 | 1<<10
+
+	modeTypeMask = 0170000
+	modeDir      = 0040000
+	modeRegular  = 0100000
+	modeSymlink  = 0120000
+)
+
+type key struct {
+	objectID uint64
+	typ      uint8
+	offset   uint64
+}
+
+var maxKey = key{objectID: ^uint64(0), typ: 0xff, offset: ^uint64(0)}
+
+func parseKey(b []byte) key {
+	return key{objectID: le64(b), typ: b[8], offset: le64(b[9:])}
+}
+
+func (k key) less(o key) bool {
+	if k.objectID != o.objectID {
+		return k.objectID < o.objectID
+	}
+	if k.typ != o.typ {
+		return k.typ < o.typ
+	}
+	return k.offset < o.offset
+}
+
+// search calls fn for all leaf items of the tree starting at the logical
+// address root with keys between min and max.
+func (fsys *FS) search(root uint64, min, max key, fn func(key, []byte) error) error {
+	return fsys.searchNode(root, maxNodeLevel, min, max, fn)
+}
+
+func (fsys *FS) searchNode(logical uint64, maxLevel int, min, max key, fn func(key, []byte) error) error {
+	node := make([]byte, fsys.nodeSize)
+	if err := fsys.readLogical(node, logical); err != nil {
+		return err
+	}
+	if le64(node[48:]) != logical {
+		return fmt.Errorf("btrfs: invalid tree node at %#x", logical)
+	}
+	nritems := int(le32(node[96:]))
+	level := int(node[100])
+	if level > maxLevel {
+		return fmt.Errorf("btrfs: invalid tree node level at %#x", logical)
+	}
+
+	if level == 0 {
+		if headerSize+nritems*leafItemSize > len(node) {
+			return fmt.Errorf("btrfs: invalid leaf at %#x", logical)
+		}
+		for i := 0; i < nritems; i++ {
+			b := node[headerSize+i*leafItemSize:]
+			k := parseKey(b)
+			if k.less(min) {
+				continue
+			}
+			if max.less(k) {
+				return nil
+			}
+			start, size := headerSize+int(le32(b[17:])), int(le32(b[21:]))
+			if start+size > len(node) {
+				return fmt.Errorf("btrfs: invalid leaf item at %#x", logical)
+			}
+			if err := fn(k, node[start:start+size]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if headerSize+nritems*nodePtrSize > len(node) {
+		return fmt.Errorf("btrfs: invalid node at %#x", logical)
+	}
+	for i := 0; i < nritems; i++ {
+		b := node[headerSize+i*nodePtrSize:]
+		if max.less(parseKey(b)) {
+			return nil
+		}
+		// the child covers all keys up to the key of the next pointer
+		if i+1 < nritems && !min.less(parseKey(node[headerSize+(i+1)*nodePtrSize:])) {
+			continue
+		}
+		if err := fsys.searchNode(le64(b[17:]), level-1, min, max, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subvolume is a file system tree.
+type subvolume struct {
+	id    uint64
+	root  uint64
+	dirID uint64
+}
+
+type inode struct {
+	subvolume *subvolume
+	ino       uint64
+	size      int64
+	nlink     uint32
+	uid, gid  uint32
+	mode      uint32
+	atime     time.Time
+	ctime     time.Time
+	mtime     time.Time
+	otime     time.Time
+}
+
+func (in *inode) isDir() bool { return in.mode&modeTypeMask == modeDir }
+
+func (in *inode) fileMode() fs.FileMode {
+	m := fs.FileMode(in.mode & 0777)
+	switch in.mode & modeTypeMask {
+	case modeDir:
+		m |= fs.ModeDir
+	case modeSymlink:
+		m |= fs.ModeSymlink
+	case modeRegular:
+	default:
+		m |= fs.ModeIrregular
+	}
+	return m
+}
+
+func timestamp(b []byte) time.Time {
+	return time.Unix(int64(le64(b)), int64(le32(b[8:]))).UTC()
+}
+
+func (fsys *FS) inode(sv *subvolume, ino uint64) (*inode, error) {
+	var in *inode
+	k := key{objectID: ino, typ: inodeItemKey}
+	err := fsys.search(sv.root, k, k, func(_ key, b []byte) error {
+		if len(b) < inodeItemSize {
+			return errors.New("btrfs: invalid inode item")
+		}
+		in = &inode{
+			subvolume: sv,
+			ino:       ino,
+			size:      int64(le64(b[16:])),
+			nlink:     le32(b[40:]),
+			uid:       le32(b[44:]),
+			gid:       le32(b[48:]),
+			mode:      le32(b[52:]),
+			atime:     timestamp(b[112:]),
+			ctime:     timestamp(b[124:]),
+			mtime:     timestamp(b[136:]),
+			otime:     timestamp(b[148:]),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if in == nil {
+		return nil, fmt.Errorf("btrfs: inode %d not found in subvolume %d", ino, sv.id)
+	}
+	return in, nil
+}
+
+type dirItem struct {
+	location key
+	typ      uint8
+	name     string
+}
+
+// parseDirItems parses the directory items packed into a single leaf item.
+func parseDirItems(b []byte) ([]dirItem, error) {
+	var items []dirItem
+	for len(b) > 0 {
+		if len(b) < dirItemSize {
+			return nil, errors.New("btrfs: invalid directory item")
+		}
+		dataLen, nameLen := int(le16(b[25:])), int(le16(b[27:]))
+		if len(b) < dirItemSize+nameLen+dataLen {
+			return nil, errors.New("btrfs: invalid directory item")
+		}
+		items = append(items, dirItem{
+			location: parseKey(b),
+			typ:      b[29],
+			name:     string(b[dirItemSize : dirItemSize+nameLen]),
+		})
+		b = b[dirItemSize+nameLen+dataLen:]
+	}
+	return items, nil
+}
+
+// readDir returns the entries of a directory in index order.
+func (fsys *FS) readDir(in *inode) ([]*DirEntry, error) {
+	var entries []*DirEntry
+	min := key{objectID: in.ino, typ: dirIndexKey}
+	max := key{objectID: in.ino, typ: dirIndexKey, offset: ^uint64(0)}
+	err := fsys.search(in.subvolume.root, min, max, func(_ key, b []byte) error {
+		items, err := parseDirItems(b)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			entries = append(entries, &DirEntry{
+				fsys:      fsys,
+				subvolume: in.subvolume,
+				name:      item.name,
+				location:  item.location,
+				ftype:     item.typ,
+			})
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"container/list"
+	"io"
+	"io/fs"
+	"runtime"
+	"sync"
+
+	"github.com/forensicanalysis/filetype"
+)
+
+// defaultCacheSize is the number of child file systems that are cached if
+// WithCacheSize is not used.
+const defaultCacheSize = 64
+
+// node is a parsed container. Nodes are reference counted, the cache and
+// every Item that uses the file system of a node hold a reference. The file
+// of the container and the parent node are released with the last
+// reference.
+type node struct {
+	mu   sync.Mutex
+	refs int
+
+	file   fs.File
+	fsys   fs.FS
+	format *filetype.Filetype
+	parent *node
+
+	fingerprint fingerprint
+}
+
+func newNode(file fs.File, fsys fs.FS, format *filetype.Filetype, parent *node) *node {
+	return &node{refs: 1, file: file, fsys: fsys, format: format, parent: parent.acquire()}
+}
+
+// level returns the nesting depth of the node, nil nodes are at level 0.
+func (n *node) level() int {
+	depth := 0
+	for ; n != nil; n = n.parent {
+		depth++
+	}
+	return depth
+}
+
+// acquire adds a reference to the node.
+func (n *node) acquire() *node {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.refs++
+	return n
+}
+
+// tryAcquire adds a reference unless the node was already closed.
+func (n *node) tryAcquire() bool {
+	if n == nil {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.refs == 0 {
+		return false
+	}
+	n.refs++
+	return true
+}
+
+// release removes a reference and closes the node if it was the last one.
+func (n *node) release() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.refs--
+	refs := n.refs
+	n.mu.Unlock()
+	if refs != 0 {
+		return
+	}
+
+	if closer, ok := n.fsys.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	_ = n.file.Close()
+	n.parent.release()
+}
+
+// lease is a reference to a node that outlives the item it was created by.
+// It is released explicitly or when the lease is garbage collected.
+type lease struct {
+	mu   sync.Mutex
+	node *node
+}
+
+func newLease(n *node) *lease {
+	l := &lease{node: n.acquire()}
+	runtime.SetFinalizer(l, (*lease).release)
+	return l
+}
+
+func (l *lease) release() {
+	l.mu.Lock()
+	n := l.node
+	l.node = nil
+	l.mu.Unlock()
+	n.release()
+}
+
+// cacheEntry is the detection result of a file, node is nil for files that
+// are not containers.
+type cacheEntry struct {
+	name string
+	node *node
+}
+
+// cache is a LRU cache of child file systems keyed by their path. The cache
+// holds a reference to every cached node.
+type cache struct {
+	size    int
+	mu      sync.Mutex
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: list.New(), index: map[string]*list.Element{}}
+}
+
+// get returns the node of a cached file, a reference for the caller is
+// acquired.
+func (c *cache) get(name string) (*node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.index[name]
+	if !ok {
+		return nil, false
+	}
+	c.entries.MoveToFront(e)
+	return e.Value.(*cacheEntry).node.acquire(), true
+}
+
+// add caches the node of a file.
+func (c *cache) add(name string, n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+	if e, ok := c.index[name]; ok {
+		c.entries.MoveToFront(e)
+		entry := e.Value.(*cacheEntry)
+		entry.node.release()
+		entry.node = n.acquire()
+		return
+	}
+	c.index[name] = c.entries.PushFront(&cacheEntry{name: name, node: n.acquire()})
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		entry := oldest.Value.(*cacheEntry)
+		delete(c.index, entry.name)
+		entry.node.release()
+	}
+}
+
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// purge removes all entries and releases their nodes.
+func (c *cache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.entries.Front(); e != nil; e = e.Next() {
+		e.Value.(*cacheEntry).node.release()
+	}
+	c.entries.Init()
+	c.index = map[string]*list.Element{}
+}
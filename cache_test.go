@@ -0,0 +1,348 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// closeFile records if it was closed.
+type closeFile struct {
+	fs.File
+	closed bool
+}
+
+func (f *closeFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	files := map[string]*closeFile{}
+	add := func(c *cache, name string) {
+		files[name] = &closeFile{}
+		n := newNode(files[name], nil, nil, nil)
+		c.add(name, n)
+		n.release()
+	}
+
+	c := newCache(2)
+	add(c, "a")
+	add(c, "b")
+	n, ok := c.get("a")
+	if !ok {
+		t.Fatal("a is not cached")
+	}
+	n.release()
+	add(c, "c")
+	if _, ok := c.get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	if !files["b"].closed {
+		t.Error("b was not closed")
+	}
+	for _, name := range []string{"a", "c"} {
+		n, ok := c.get(name)
+		if !ok {
+			t.Errorf("%s is not cached", name)
+		}
+		n.release()
+	}
+
+	// nodes in use are closed when they are released
+	n, _ = c.get("a")
+	c.purge()
+	if c.len() != 0 {
+		t.Errorf("len() = %d after purge", c.len())
+	}
+	if files["a"].closed || !files["c"].closed {
+		t.Error("purge() closed a node in use")
+	}
+	n.release()
+	if !files["a"].closed {
+		t.Error("a was not closed")
+	}
+
+	disabled := newCache(0)
+	add(disabled, "a")
+	if _, ok := disabled.get("a"); ok {
+		t.Error("disabled cache contains a")
+	}
+	if !files["a"].closed {
+		t.Error("a was not closed")
+	}
+}
+
+// countFS counts the calls to Open per file.
+type countFS struct {
+	fs.FS
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func (c *countFS) Open(name string) (fs.File, error) {
+	c.mu.Lock()
+	c.count[name]++
+	c.mu.Unlock()
+	return c.FS.Open(name)
+}
+
+func TestFS_Cache(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []Option
+		wantOpens int
+	}{
+		{"cached", nil, 3},
+		{"disabled", []Option{WithCacheSize(0)}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := &countFS{
+				FS:    fstest.MapFS{"evidence.zip": &fstest.MapFile{Data: testZip(t)}},
+				count: map[string]int{},
+			}
+			fsys := NewFS(root, tt.options...)
+			for _, name := range []string{"evidence.zip/doc.txt", "evidence.zip/dir/doc.txt"} {
+				if _, err := fs.ReadFile(fsys, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// every ReadFile stats the zip file, it is only opened for
+			// parsing if it is not cached
+			if got := root.count["evidence.zip"]; got != tt.wantOpens {
+				t.Errorf("evidence.zip opened %d times, want %d", got, tt.wantOpens)
+			}
+
+			fsys.Purge()
+			if fsys.cache.len() != 0 {
+				t.Error("Purge() did not empty the cache")
+			}
+		})
+	}
+}
+
+// handleFS counts the open files.
+type handleFS struct {
+	fs.FS
+	mu   sync.Mutex
+	open int
+}
+
+func (h *handleFS) Open(name string) (fs.File, error) {
+	f, err := h.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.open++
+	h.mu.Unlock()
+	return &handleFile{File: f, fsys: h}, nil
+}
+
+func (h *handleFS) handles() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.open
+}
+
+type handleFile struct {
+	fs.File
+	fsys   *handleFS
+	closed bool
+}
+
+func (f *handleFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.File.(io.ReaderAt).ReadAt(p, off)
+}
+
+func (f *handleFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func (f *handleFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return f.File.(fs.ReadDirFile).ReadDir(n)
+}
+
+func (f *handleFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		f.fsys.mu.Lock()
+		f.fsys.open--
+		f.fsys.mu.Unlock()
+	}
+	return f.File.Close()
+}
+
+func TestFS_Close(t *testing.T) {
+	zipFile := testZip(t)
+	disk := testDisk(t)
+
+	for _, size := range []int{0, 1, defaultCacheSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			root := &handleFS{FS: fstest.MapFS{
+				"disk.dd":      &fstest.MapFile{Data: disk},
+				"evidence.zip": &fstest.MapFile{Data: zipFile},
+				"plain.txt":    &fstest.MapFile{Data: []byte("plain")},
+			}}
+			fsys := NewFS(root, WithCacheSize(size), WithProvenance())
+
+			err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if _, err := d.Info(); err != nil {
+					return err
+				}
+				if !d.IsDir() {
+					_, err = fs.ReadFile(fsys, name)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"disk.dd/p0/dir/doc.txt", "evidence.zip", "plain.txt"} {
+				if _, err := fs.Stat(fsys, name); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := fsys.Resolve(name); err != nil {
+					t.Fatal(err)
+				}
+				raw, err := fsys.OpenRaw(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := raw.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := fsys.Open("disk.dd/p0/missing"); err == nil {
+				t.Fatal("Open() of a missing file succeeded")
+			}
+
+			f, err := fsys.Open("disk.dd/p0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := f.(*Item).Raw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if root.handles() == 0 {
+				t.Error("Close() closed files in use")
+			}
+			entries, err := f.(fs.ReadDirFile).ReadDir(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// entries keep their directory open until they are inspected
+			for _, entry := range entries {
+				entry.IsDir()
+			}
+			for _, f := range []fs.File{f, raw} {
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Close(); err == nil {
+				t.Error("second Close() succeeded")
+			}
+
+			if root.handles() != 0 {
+				t.Errorf("%d files are still open", root.handles())
+			}
+		})
+	}
+}
+
+// TestFS_LazyDetection inspects entries after their directory was closed.
+// Files of os.DirFS cannot be read after they were closed.
+func TestFS_LazyDetection(t *testing.T) {
+	dir := t.TempDir()
+	outer := testZipFiles(t, map[string][]byte{"nested.zip": testZip(t), "plain.txt": []byte("plain")})
+	if err := os.WriteFile(filepath.Join(dir, "outer.zip"), outer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := os.DirFS(dir)
+
+	t.Run("walk", func(t *testing.T) {
+		fsys := NewFS(root, WithCacheSize(0))
+		defer fsys.Close()
+
+		var names []string
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{".", "outer.zip", "outer.zip/nested.zip", "outer.zip/nested.zip/dir", "outer.zip/nested.zip/dir/doc.txt", "outer.zip/nested.zip/doc.txt", "outer.zip/plain.txt"}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("WalkDir() = %v, want %v", names, want)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		options []Option
+	}{
+		{"purge", nil},
+		{"evict", []Option{WithCacheSize(1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(root, tt.options...)
+			defer fsys.Close()
+
+			entries, err := fsys.ReadDir("outer.zip")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "purge" {
+				fsys.Purge()
+			} else if _, err := fsys.Stat("outer.zip/nested.zip/doc.txt"); err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if got, want := entry.IsDir(), entry.Name() == "nested.zip"; got != want {
+					t.Errorf("%s IsDir() = %v, want %v", entry.Name(), got, want)
+				}
+			}
+		})
+	}
+}
@@ -40,36 +40,182 @@
 // Hash all files in a zip file:
 //
 //	fs hashsum case/evidence.zip/*
+//
+// List the files on a BitLocker encrypted partition:
+//
+//	fs ls --recovery-password 123456-... case/disk.dd/p1/
+//
+// Print the Zone.Identifier alternate data stream of a downloaded file:
+//
+//	fs cat case/ntfs.dd/Users/user/Downloads/setup.exe:Zone.Identifier
+//
+// List deleted files of a NTFS or FAT image:
+//
+//	fs ls --deleted case/ntfs.dd/$Deleted/
+//
+// Extract the unpartitioned space between two partitions:
+//
+//	fs cat --unallocated case/disk.dd/unallocated-0000002048-0000004095 > gap.bin
+//
+// List a NTFS file system that starts 1 MiB into an unknown disk image:
+//
+//	fs ls --type ntfs --offset 1048576 case/disk.bin
+//
+// List a directory with damaged containers and print their errors:
+//
+//	fs ls --tolerant case/
+//
+// List an untrusted archive with limits against decompression bombs:
+//
+//	fs ls --max-depth 8 --max-ratio 100 upload.zip
+//
+// Print a file given as Windows path or as file URI:
+//
+//	fs cat C:\case\evidence.zip\ntfs.dd\Windows\win.ini
+//	fs cat 'file:///case/evidence%20files.zip/report.pdf'
+//
+// Hash the zip file itself and a file inside of it:
+//
+//	fs hashsum --explicit case/evidence.zip 'case/evidence.zip!/doc.pdf'
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
 	"io/fs"
 	"log"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/forensicanalysis/fscmd"
-	"github.com/forensicanalysis/fslib"
 	"github.com/forensicanalysis/recursivefs"
 )
 
 func main() {
-	fsys := recursivefs.New()
+	var recoveryPasswords, startupKeys []string
+	var fvek string
+	var streams, deleted, unallocated, explicit, tolerant, caseSensitive bool
+	var forceType string
+	var offset int64
+	var maxDepth, maxEntries int
+	var maxBytes int64
+	var maxRatio float64
+	var maxDuration time.Duration
 	fsCmd := fscmd.FSCommand(func(_ *cobra.Command, args []string) (fs.FS, []string, error) {
-		var names []string
+		options, err := bitlockerOptions(recoveryPasswords, startupKeys, fvek)
+		if err != nil {
+			return nil, nil, err
+		}
+		if streams {
+			options = append(options, recursivefs.WithAlternateDataStreams())
+		}
+		if deleted {
+			options = append(options, recursivefs.WithDeleted())
+		}
+		if unallocated {
+			options = append(options, recursivefs.WithUnallocated())
+		}
+		if explicit {
+			options = append(options, recursivefs.WithExplicitContainers())
+		}
+		if caseSensitive {
+			options = append(options, recursivefs.WithCaseSensitive())
+		}
+		if tolerant {
+			options = append(options, recursivefs.WithTolerance(func(name string, err error) {
+				log.Printf("%s: %s", name, err)
+			}))
+		}
+		options = append(options,
+			recursivefs.WithMaxDepth(maxDepth),
+			recursivefs.WithMaxBytes(maxBytes),
+			recursivefs.WithMaxRatio(maxRatio),
+			recursivefs.WithMaxEntries(maxEntries),
+			recursivefs.WithMaxDuration(maxDuration),
+		)
+		fsys := recursivefs.New(options...)
+
+		suffix, err := interpretation(forceType, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the output shows the paths as they were given
+		display := &displayFS{fsys: fsys}
 		for _, arg := range args {
-			name, err := fslib.ToFSPath(arg)
+			name, err := parsePath(arg)
 			if err != nil {
 				return nil, nil, err
 			}
-			names = append(names, name)
+			display.add(arg, name+suffix)
 		}
-		return fsys, names, nil
+		return display, args, nil
 	})
 	fsCmd.Use = "fs"
 	fsCmd.Short = "recursive file, filesystem and archive commands"
+	fsCmd.PersistentFlags().StringArrayVar(&recoveryPasswords, "recovery-password", nil, "BitLocker recovery password")
+	fsCmd.PersistentFlags().StringArrayVar(&startupKeys, "startup-key", nil, "BitLocker startup key file (.BEK)")
+	fsCmd.PersistentFlags().StringVar(&fvek, "fvek", "", "hex encoded BitLocker full volume encryption key")
+	fsCmd.PersistentFlags().BoolVar(&streams, "streams", false, "list NTFS alternate data streams")
+	fsCmd.PersistentFlags().BoolVar(&deleted, "deleted", false, "add $Deleted and $Orphan directories to NTFS and FAT file systems")
+	fsCmd.PersistentFlags().BoolVar(&unallocated, "unallocated", false, "add partition gaps, $Unallocated and file slack ($Slack) as virtual files")
+	fsCmd.PersistentFlags().BoolVar(&explicit, "explicit", false, "only open containers where a path element ends with ! (e.g. evidence.zip!/doc.pdf)")
+	fsCmd.PersistentFlags().BoolVar(&caseSensitive, "case-sensitive", false, "match the exact case of names in NTFS and FAT file systems")
+	fsCmd.PersistentFlags().BoolVar(&tolerant, "tolerant", false, "show damaged containers as plain files and print their errors")
+	fsCmd.PersistentFlags().StringVar(&forceType, "type", "", "parse the given files as this container type (e.g. ntfs, zip, mbr)")
+	fsCmd.PersistentFlags().Int64Var(&offset, "offset", 0, "start offset in bytes of the container in the given files")
+	fsCmd.PersistentFlags().IntVar(&maxDepth, "max-depth", 0, "maximal nesting depth of containers (0 for no limit)")
+	fsCmd.PersistentFlags().Int64Var(&maxBytes, "max-bytes", 0, "maximal bytes read from a single container (0 for no limit)")
+	fsCmd.PersistentFlags().Float64Var(&maxRatio, "max-ratio", 0, "maximal ratio of bytes read from a container to its size (0 for no limit)")
+	fsCmd.PersistentFlags().IntVar(&maxEntries, "max-entries", 0, "maximal entries of a directory in a container (0 for no limit)")
+	fsCmd.PersistentFlags().DurationVar(&maxDuration, "max-duration", 0, "maximal time to open a container (0 for no limit)")
 	err := fsCmd.Execute()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// interpretation returns the path suffix that forces the file type and the
+// start offset of a container.
+func interpretation(forceType string, offset int64) (string, error) {
+	if forceType != "" {
+		if _, ok := recursivefs.FiletypeByID(forceType); !ok {
+			return "", fmt.Errorf("unknown container type %s", forceType)
+		}
+	}
+	switch {
+	case offset < 0:
+		return "", fmt.Errorf("invalid offset %d", offset)
+	case offset > 0 && forceType != "":
+		return fmt.Sprintf("@offset=%d:%s", offset, forceType), nil
+	case offset > 0:
+		return fmt.Sprintf("@offset=%d", offset), nil
+	case forceType != "":
+		return "@" + forceType, nil
+	}
+	return "", nil
+}
+
+func bitlockerOptions(recoveryPasswords, startupKeys []string, fvek string) ([]recursivefs.Option, error) {
+	var options []recursivefs.Option
+	for _, password := range recoveryPasswords {
+		options = append(options, recursivefs.WithBitLockerRecoveryPassword(password))
+	}
+	for _, startupKey := range startupKeys {
+		bek, err := os.ReadFile(startupKey)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, recursivefs.WithBitLockerStartupKey(bek))
+	}
+	if fvek != "" {
+		key, err := hex.DecodeString(fvek)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, recursivefs.WithBitLockerFVEK(key))
+	}
+	return options, nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/forensicanalysis/fslib"
+)
+
+// parsePath converts a command line argument into a path of the recursive
+// file system. Arguments can be native paths, paths whose nested elements are
+// separated by backslashes, e.g. C:\case\evidence.zip\ntfs.dd\Windows, or
+// file URIs with percent-encoded names like
+// file:///case/evidence%20files.zip/doc.pdf.
+func parsePath(arg string) (string, error) {
+	systemPath := arg
+	if isURI(arg) {
+		var err error
+		if systemPath, err = uriPath(arg); err != nil {
+			return "", err
+		}
+	} else if _, err := os.Lstat(arg); err != nil {
+		// names on the host can contain backslashes, names in containers
+		// can not
+		systemPath = filepath.FromSlash(strings.ReplaceAll(arg, `\`, "/"))
+	}
+	return fslib.ToFSPath(systemPath)
+}
+
+// isURI reports if a command line argument is a file URI.
+func isURI(arg string) bool {
+	return strings.HasPrefix(strings.ToLower(arg), "file:")
+}
+
+// uriPath returns the native path of a local file URI.
+func uriPath(arg string) (string, error) {
+	u, err := url.Parse(arg)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case u.Opaque != "":
+		return "", fmt.Errorf("%s: file URIs must contain an absolute path", arg)
+	case u.Host != "" && u.Host != "localhost":
+		return "", fmt.Errorf("%s: remote file URIs are not supported", arg)
+	case u.RawQuery != "" || u.ForceQuery || u.Fragment != "":
+		return "", fmt.Errorf("%s: ? and # in names must be percent-encoded", arg)
+	case u.Path == "":
+		return "", errors.New("file URI without path")
+	}
+	p := u.Path
+	// file:///C:/case/evidence.zip
+	if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// argPath is a path as given on the command line and its path in the
+// recursive file system.
+type argPath struct {
+	display string
+	name    string
+	// uri is set for file URIs, the names below them are percent-encoded
+	uri bool
+}
+
+// displayFS opens the paths as they were given on the command line, so the
+// commands print them in the same form. Paths below a given path, e.g. the
+// entries of a listed directory, are resolved as well. The entries of
+// directories below file URIs are listed with percent-encoded names, so
+// their paths are URIs as well.
+type displayFS struct {
+	fsys  fs.FS
+	paths []argPath
+}
+
+// add registers the display form of a path, longer paths take precedence.
+func (d *displayFS) add(display, name string) {
+	d.paths = append(d.paths, argPath{display: display, name: name, uri: isURI(display)})
+	sort.SliceStable(d.paths, func(i, j int) bool {
+		return len(d.paths[i].display) > len(d.paths[j].display)
+	})
+}
+
+// lookup returns the given path that display is or is below of and the
+// remaining elements of display.
+func (d *displayFS) lookup(display string) (argPath, string, bool) {
+	for _, p := range d.paths {
+		// the commands join children with path.Join, which cleans the
+		// prefix, e.g. file:///x.zip to file:/x.zip
+		for _, prefix := range []string{p.display, path.Clean(p.display)} {
+			if display == prefix {
+				return p, "", true
+			}
+			if strings.HasPrefix(display, prefix+"/") {
+				return p, display[len(prefix)+1:], true
+			}
+		}
+	}
+	return argPath{}, "", false
+}
+
+// name returns the path in the recursive file system for a display path.
+// Paths that were not given on the command line are returned unchanged.
+func (d *displayFS) name(display string) string {
+	p, rest, ok := d.lookup(display)
+	switch {
+	case !ok:
+		return display
+	case rest == "":
+		return p.name
+	case !p.uri:
+		return path.Join(p.name, rest)
+	}
+	elems := strings.Split(rest, "/")
+	for i, elem := range elems {
+		name, err := url.PathUnescape(elem)
+		if err != nil {
+			return display
+		}
+		elems[i] = name
+	}
+	return path.Join(append([]string{p.name}, elems...)...)
+}
+
+func (d *displayFS) Open(name string) (fs.File, error) {
+	return d.fsys.Open(d.name(name))
+}
+
+func (d *displayFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(d.fsys, d.name(name))
+}
+
+func (d *displayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(d.fsys, d.name(name))
+	if p, _, ok := d.lookup(name); ok && p.uri {
+		for i, entry := range entries {
+			entries[i] = &uriEntry{DirEntry: entry}
+		}
+	}
+	return entries, err
+}
+
+// uriEntry is an entry of a directory below a file URI, its name is
+// percent-encoded.
+type uriEntry struct {
+	fs.DirEntry
+}
+
+func (e *uriEntry) Name() string {
+	return url.PathEscape(e.DirEntry.Name())
+}
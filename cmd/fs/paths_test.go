@@ -0,0 +1,141 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"testing/fstest"
+
+	"github.com/forensicanalysis/fslib"
+)
+
+func TestParsePath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("expects unix paths")
+	}
+	dir := t.TempDir()
+	backslash := filepath.Join(dir, `a\b.txt`)
+	if err := os.WriteFile(backslash, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wantBackslash, err := fslib.ToFSPath(backslash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		arg     string
+		want    string
+		wantErr bool
+	}{
+		{"native", "/case/evidence.zip/doc.pdf", "case/evidence.zip/doc.pdf", false},
+		{"backslashes", `/case/evidence.zip\ntfs.dd\Windows\win.ini`, "case/evidence.zip/ntfs.dd/Windows/win.ini", false},
+		{"existing backslash", backslash, wantBackslash, false},
+		{"uri", "file:///case/evidence%20files.zip/a%23b%3F.txt", "case/evidence files.zip/a#b?.txt", false},
+		{"uri escape", "file:///case/evidence.zip/%252E%252E/evil.txt", "case/evidence.zip/%2E%2E/evil.txt", false},
+		{"localhost", "FILE://localhost/case/evidence.zip", "case/evidence.zip", false},
+		{"remote", "file://server/share/evidence.zip", "", true},
+		{"relative", "file:evidence.zip", "", true},
+		{"query", "file:///case/what?.txt", "", true},
+		{"fragment", "file:///case/#1.txt", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePath(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parsePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayFS(t *testing.T) {
+	fsys := &displayFS{fsys: fstest.MapFS{
+		"case/evidence files.zip/doc.txt":     &fstest.MapFile{Data: []byte("doc")},
+		"case/evidence files.zip/dir/sub.txt": &fstest.MapFile{Data: []byte("sub")},
+		"case/ntfs.dd/Windows/win.ini":        &fstest.MapFile{Data: []byte("ini")},
+		"case/names.zip/a%2Fb":                &fstest.MapFile{Data: []byte("escaped")},
+		"case/names.zip/#1 what?.txt":         &fstest.MapFile{Data: []byte("reserved")},
+		"case/names.zip/50%.txt":              &fstest.MapFile{Data: []byte("percent")},
+	}}
+	fsys.add("file:///case/evidence%20files.zip", "case/evidence files.zip")
+	fsys.add(`C:\case\ntfs.dd\Windows`, "case/ntfs.dd/Windows")
+	fsys.add("file:///case/names.zip", "case/names.zip")
+
+	for name, want := range map[string]string{
+		"file:///case/evidence%20files.zip/doc.txt": "doc",
+		// children are joined with path.Join
+		"file:/case/evidence%20files.zip/dir/sub.txt": "sub",
+		"file:///case/names.zip/a%252Fb":              "escaped",
+		"file:///case/names.zip/%231%20what%3F.txt":   "reserved",
+		`C:\case\ntfs.dd\Windows/win.ini`:             "ini",
+		"case/ntfs.dd/Windows/win.ini":                "ini",
+	} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Errorf("ReadFile(%q) = %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("ReadFile(%q) = %q, want %q", name, data, want)
+		}
+	}
+
+	entries, err := fs.ReadDir(fsys, "file:///case/evidence%20files.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("ReadDir() = %v, want 2 entries", entries)
+	}
+	if _, err := fs.Stat(fsys, `C:\case\ntfs.dd\Windows`); err != nil {
+		t.Fatal(err)
+	}
+
+	// the commands join the listed names to the given path
+	entries, err = fs.ReadDir(fsys, "file:///case/names.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+		if _, err := fs.ReadFile(fsys, path.Join("file:///case/names.zip", entry.Name())); err != nil {
+			t.Errorf("ReadFile() of listed entry = %v", err)
+		}
+	}
+	want := []string{"%231%20what%3F.txt", "50%25.txt", "a%252Fb"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir() = %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func concurrencyRoot(t *testing.T) fstest.MapFS {
+	root := ntfsRoot(t).(fstest.MapFS)
+	root["evidence.zip"] = &fstest.MapFile{Data: testZip(t)}
+	root["archive.tar"] = &fstest.MapFile{Data: testTar(t)}
+	root["fat.dd"] = &fstest.MapFile{Data: gunzip(t, "fat/testdata/test.fat12.dd.gz")}
+	root["disk.dd"] = &fstest.MapFile{Data: testDisk(t)}
+	root["gpt.dd"] = &fstest.MapFile{Data: testGPT()}
+	return root
+}
+
+// TestConcurrency reads nested paths from many goroutines, it is meant to be
+// run with the race detector.
+func TestConcurrency(t *testing.T) {
+	root := concurrencyRoot(t)
+	files := []string{
+		"evidence.zip/doc.txt",
+		"evidence.zip/dir/doc.txt",
+		"archive.tar/tar.txt",
+		"archive.tar/nested.zip/doc.txt",
+		"archive.tar/nested.zip/dir/doc.txt",
+		"fat.dd/Long File Name.txt",
+		"fat.dd/SUB/nested.txt",
+		"disk.dd/p0/doc.txt",
+		"gpt.dd/p0",
+		"ntfs.dd/Folder A/Folder B/Hello world text document.txt",
+	}
+	dirs := []string{".", "evidence.zip", "archive.tar/nested.zip", "fat.dd/SUB", "disk.dd/p0", "gpt.dd", "ntfs.dd/Folder A"}
+
+	// read the expected content sequentially
+	want := map[string][]byte{}
+	sequential := NewFS(root)
+	for _, name := range files {
+		data, err := fs.ReadFile(sequential, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[name] = data
+	}
+	_ = sequential.Close()
+
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"default", nil},
+		{"small cache", []Option{WithCacheSize(2)}},
+		{"spill", []Option{WithMemoryLimit(0), WithTempDir(t.TempDir())}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(root, tt.options...)
+			defer fsys.Close()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 100)
+			for g := 0; g < 16; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 5; i++ {
+						name := files[(g+i)%len(files)]
+						data, err := fs.ReadFile(fsys, name)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if !bytes.Equal(data, want[name]) {
+							errs <- fmt.Errorf("%s: got %q", name, data)
+							return
+						}
+						if _, err := fsys.ReadDir(dirs[(g+i)%len(dirs)]); err != nil {
+							errs <- err
+							return
+						}
+						if g == 0 {
+							fsys.Purge()
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestItem_ReadAtConcurrent reads a shared file from many goroutines.
+func TestItem_ReadAtConcurrent(t *testing.T) {
+	fsys := NewFS(concurrencyRoot(t))
+	defer fsys.Close()
+
+	for _, name := range []string{"archive.tar/nested.zip/dir/doc.txt", "fat.dd/SUB/nested.txt"} {
+		want, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ra := f.(io.ReaderAt)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(off int64) {
+				defer wg.Done()
+				off %= int64(len(want))
+				b := make([]byte, int64(len(want))-off)
+				if n, err := ra.ReadAt(b, off); err != nil && err != io.EOF || !bytes.Equal(b[:n], want[off:]) {
+					errs <- fmt.Errorf("%s: ReadAt(%d) = %q, %v", name, off, b[:n], err)
+				}
+			}(int64(g))
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		_ = f.Close()
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+)
+
+// OpenContext is like Open but aborts when ctx is done. The context is
+// checked between the layers of the path, while containers are detected and
+// parsed and on every read of the returned file.
+func (fsys *FS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	return fsys.open(ctx, name, nil, false)
+}
+
+// ReadDirContext is like ReadDir but aborts when ctx is done.
+func (fsys *FS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	f, err := fsys.OpenContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.(*Item).ReadDir(-1)
+}
+
+// WalkDirContext walks the file tree rooted at root like fs.WalkDir, including
+// the contents of containers. The walk stops with the error of ctx when ctx is
+// done.
+func (fsys *FS) WalkDirContext(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.stat(ctx, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fsys.walkDir(ctx, root, info.(*Info), fn)
+	}
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (fsys *FS) walkDir(ctx context.Context, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDirContext(ctx, name)
+	if err != nil {
+		if err = fn(name, d, err); err != nil {
+			if err == fs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fsys.walkDir(ctx, path.Join(name, entry.Name()), entry, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// contextFile aborts reads of a container file while the container is
+// detected and parsed. The context is removed afterwards, as the file is
+// used by the cached file system in later calls.
+type contextFile struct {
+	fs.File
+
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+func (f *contextFile) setContext(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ctx = ctx
+}
+
+func (f *contextFile) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ctx == nil {
+		return nil
+	}
+	return f.ctx.Err()
+}
+
+func (f *contextFile) Read(p []byte) (int, error) {
+	if err := f.err(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *contextFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.err(); err != nil {
+		return 0, err
+	}
+	return f.File.(io.ReaderAt).ReadAt(p, off)
+}
+
+func (f *contextFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.err(); err != nil {
+		return 0, err
+	}
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
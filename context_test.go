@@ -0,0 +1,174 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// cancelFS cancels a context on the first read of any file.
+type cancelFS struct {
+	fs.FS
+	cancel context.CancelFunc
+}
+
+type cancelFile struct {
+	fs.File
+	cancel context.CancelFunc
+}
+
+func (c *cancelFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &cancelFile{File: f, cancel: c.cancel}, nil
+}
+
+func (f *cancelFile) Read(p []byte) (int, error) {
+	f.cancel()
+	return f.File.Read(p)
+}
+
+func (f *cancelFile) ReadAt(p []byte, off int64) (int, error) {
+	f.cancel()
+	return f.File.(io.ReaderAt).ReadAt(p, off)
+}
+
+func (f *cancelFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func TestOpenContext(t *testing.T) {
+	root := fstest.MapFS{"evidence.zip": &fstest.MapFile{Data: testZip(t)}}
+
+	t.Run("canceled", func(t *testing.T) {
+		fsys := NewFS(root)
+		defer fsys.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := fsys.OpenContext(ctx, "evidence.zip/doc.txt"); !errors.Is(err, context.Canceled) {
+			t.Errorf("OpenContext() error = %v, want %v", err, context.Canceled)
+		}
+		if _, err := fsys.ReadDirContext(ctx, "evidence.zip"); !errors.Is(err, context.Canceled) {
+			t.Errorf("ReadDirContext() error = %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("during detection", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		fsys := NewFS(&cancelFS{FS: root, cancel: cancel})
+		defer fsys.Close()
+		if _, err := fsys.OpenContext(ctx, "evidence.zip/doc.txt"); !errors.Is(err, context.Canceled) {
+			t.Errorf("OpenContext() error = %v, want %v", err, context.Canceled)
+		}
+
+		// aborted detections are not cached
+		data, err := fs.ReadFile(fsys, "evidence.zip/doc.txt")
+		if err != nil || string(data) != "content" {
+			t.Errorf("ReadFile() = %q, %v", data, err)
+		}
+	})
+
+	t.Run("listing done before detection", func(t *testing.T) {
+		fsys := NewFS(root)
+		defer fsys.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		entries, err := fsys.ReadDirContext(ctx, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if len(entries) != 1 || !entries[0].IsDir() {
+			t.Errorf("ReadDirContext() = %v, want the zip file as directory", entries)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		fsys := NewFS(root)
+		defer fsys.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		f, err := fsys.OpenContext(ctx, "evidence.zip/doc.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cancel()
+		if _, err := f.Read(make([]byte, 4)); !errors.Is(err, context.Canceled) {
+			t.Errorf("Read() error = %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestWalkDirContext(t *testing.T) {
+	root := fstest.MapFS{
+		"archive.tar":    &fstest.MapFile{Data: testTar(t)},
+		"plain/file.txt": &fstest.MapFile{Data: []byte("plain")},
+	}
+	fsys := NewFS(root)
+	defer fsys.Close()
+
+	var paths []string
+	err := fsys.WalkDirContext(context.Background(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "plain" {
+			return fs.SkipDir
+		}
+		paths = append(paths, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		".", "archive.tar", "archive.tar/nested.zip", "archive.tar/nested.zip/dir",
+		"archive.tar/nested.zip/dir/doc.txt", "archive.tar/nested.zip/doc.txt", "archive.tar/tar.txt",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("WalkDirContext() = %v, want %v", paths, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var visited []string
+	err = fsys.WalkDirContext(ctx, ".", func(name string, d fs.DirEntry, err error) error {
+		visited = append(visited, name)
+		if name == "archive.tar" {
+			cancel()
+		}
+		return err
+	})
+	// archive.tar is visited again with the error of ReadDir
+	if !errors.Is(err, context.Canceled) || !reflect.DeepEqual(visited, []string{".", "archive.tar", "archive.tar"}) {
+		t.Errorf("WalkDirContext() = %v after %v, want %v", err, visited, context.Canceled)
+	}
+}
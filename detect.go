@@ -0,0 +1,117 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"io"
+	"path"
+
+	"github.com/h2non/filetype/types"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/fslib/fsio"
+	"github.com/forensicanalysis/recursivefs/bitlocker"
+	"github.com/forensicanalysis/recursivefs/btrfs"
+	"github.com/forensicanalysis/recursivefs/fat"
+	"github.com/forensicanalysis/recursivefs/lvm"
+	"github.com/forensicanalysis/recursivefs/xfs"
+)
+
+// BitLocker is the file type for BitLocker encrypted volumes.
+var BitLocker = &filetype.Filetype{
+	ID:         "bitlocker",
+	Mimetype:   types.NewMIME("filesystem/bitlocker"),
+	Extensions: []string{"dd"},
+	Matcher:    bitlocker.Match,
+}
+
+// LVM is the file type for LVM2 physical volumes.
+var LVM = &filetype.Filetype{
+	ID:         "lvm",
+	Mimetype:   types.NewMIME("filesystem/lvm"),
+	Extensions: []string{"dd"},
+	Matcher:    lvm.Match,
+}
+
+// XFS is the file type for XFS file systems.
+var XFS = &filetype.Filetype{
+	ID:         "xfs",
+	Mimetype:   types.NewMIME("filesystem/xfs"),
+	Extensions: []string{"dd"},
+	Matcher:    xfs.Match,
+}
+
+// FAT is the file type for FAT12 and FAT32 file systems, FAT16 is detected as
+// filetype.FAT16.
+var FAT = &filetype.Filetype{
+	ID:         "fat",
+	Mimetype:   types.NewMIME("filesystem/fat"),
+	Extensions: []string{"dd"},
+	Matcher:    fat.Match,
+}
+
+// Btrfs is the file type for Btrfs file systems. The matcher expects the
+// start of the volume including the superblock at 64 KiB.
+var Btrfs = &filetype.Filetype{
+	ID:         "btrfs",
+	Mimetype:   types.NewMIME("filesystem/btrfs"),
+	Extensions: []string{"dd"},
+	Matcher: func(buf []byte) bool {
+		return len(buf) > btrfs.SuperblockOffset && btrfs.Match(buf[btrfs.SuperblockOffset:])
+	},
+}
+
+// filesystemTypes are file types that are not part of the filetype library.
+// They are checked first as their signatures are more specific.
+var filesystemTypes = []*filetype.Filetype{BitLocker, LVM, XFS, FAT}
+
+// detect identifies the file type by the first bytes of the reader, the
+// extension of the name is used as a guess.
+func detect(r io.Reader, name string) (*filetype.Filetype, error) {
+	head := make([]byte, 8192)
+	// stream and decompressing readers can return less than requested
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	for _, t := range filesystemTypes {
+		if t.Matcher(head) {
+			return t, nil
+		}
+	}
+
+	// the Btrfs superblock is located after the head
+	if ra, ok := r.(fsio.ReadSeekerAt); ok {
+		sb := make([]byte, 0x48)
+		// some readers do not support reads behind the end of the file
+		size, err := fsio.GetSize(ra)
+		if err == nil && size >= btrfs.SuperblockOffset+int64(len(sb)) {
+			if _, err := ra.ReadAt(sb, btrfs.SuperblockOffset); err == nil && btrfs.Match(sb) {
+				return Btrfs, nil
+			}
+		}
+	}
+	return filetype.DetectByExtension(head, path.Ext(name)), nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/recursivefs/bitlocker"
+	"github.com/forensicanalysis/recursivefs/internal/seekfs"
+)
+
+var (
+	// ErrUnsupportedFormat is returned if a file can not be opened as
+	// container, e.g. because its format is unknown or a feature of the format
+	// is not implemented.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrCorruptContainer is returned if the format of a container was
+	// detected, but its structures could not be parsed or its parser
+	// panicked.
+	ErrCorruptContainer = errors.New("corrupt container")
+	// ErrEncrypted is returned if a container is encrypted and no matching
+	// key is configured.
+	ErrEncrypted = errors.New("encrypted container")
+	// ErrLimitExceeded is returned if opening a container exceeds a
+	// configured limit, e.g. the quota of WithTempQuota.
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
+// ErrQuotaExceeded is returned if a spilled file exceeds the quota set by
+// WithTempQuota. It is wrapped in an error of kind ErrLimitExceeded.
+var ErrQuotaExceeded = seekfs.ErrQuotaExceeded
+
+// errNoKeys is returned for BitLocker volumes if no keys are configured. The
+// volumes are plain files, unless a path continues inside of them.
+var errNoKeys = errors.New("no BitLocker keys configured")
+
+// ContainerError describes why a container could not be opened. It is
+// returned as the Err of a *fs.PathError, errors.Is matches the Kind and the
+// wrapped error.
+type ContainerError struct {
+	// Kind is ErrUnsupportedFormat, ErrCorruptContainer, ErrEncrypted or
+	// ErrLimitExceeded.
+	Kind error
+	// Format is the format of the container if it is known.
+	Format *filetype.Filetype
+	// Layers is the nesting chain up to the container.
+	Layers []Layer
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ContainerError) Error() string {
+	msg := e.Kind.Error()
+	if e.Format != nil {
+		msg = string(e.Format.ID) + ": " + msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *ContainerError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *ContainerError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// containerError classifies an error that occurred while a container of type
+// t was opened. Errors that can not be classified get the kind fallback or
+// are returned unchanged if fallback is nil.
+func containerError(t *filetype.Filetype, err, fallback error) error {
+	var ce *ContainerError
+	if errors.As(err, &ce) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	kind := fallback
+	switch {
+	case errors.Is(err, seekfs.ErrQuotaExceeded):
+		kind = ErrLimitExceeded
+	case errors.Is(err, bitlocker.ErrNoKey), errors.Is(err, errNoKeys):
+		kind = ErrEncrypted
+	case errors.Is(err, bitlocker.ErrUnsupported):
+		kind = ErrUnsupportedFormat
+	}
+	if kind == nil {
+		return err
+	}
+	return &ContainerError{Kind: kind, Format: t, Err: err}
+}
+
+// openError returns a *fs.PathError for the path name. The layers of
+// container errors are set to the chain in elems.
+func openError(name string, elems []element, err error) error {
+	var ce *ContainerError
+	if errors.As(err, &ce) && ce.Layers == nil {
+		ce.Layers, _ = layers(elems)
+	}
+	if pe, ok := err.(*fs.PathError); ok {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: "open", Path: name, Err: err}
+}
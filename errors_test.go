@@ -0,0 +1,229 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/recursivefs/bitlocker"
+)
+
+func TestErrors(t *testing.T) {
+	badZip := append([]byte("PK\x03\x04"), make([]byte, 100)...)
+	bitlockerHeader := make([]byte, 8192)
+	copy(bitlockerHeader[3:], bitlocker.Signature)
+	bitlockerHeader[510], bitlockerHeader[511] = 0x55, 0xaa
+	badGPT := testGPT()
+	binary.LittleEndian.PutUint64(badGPT[2*sectorSize+40:], 1<<40)
+
+	root := fstest.MapFS{
+		"evidence.zip": &fstest.MapFile{Data: testZip(t)},
+		"bad.zip":      &fstest.MapFile{Data: badZip},
+		"archive.tar":  &fstest.MapFile{Data: testTarFiles(t, map[string][]byte{"bad.zip": badZip})},
+		"bitlocker.dd": &fstest.MapFile{Data: bitlockerHeader},
+		"bad.dd":       &fstest.MapFile{Data: badGPT},
+		"gpt.dd":       &fstest.MapFile{Data: testGPT()},
+		"plain.txt":    &fstest.MapFile{Data: []byte("plain")},
+	}
+
+	tests := []struct {
+		name       string
+		open       func(fsys *FS) error
+		wantPath   string
+		wantErr    error
+		wantLayers []*filetype.Filetype
+	}{
+		{"invalid", func(fsys *FS) error { _, err := fsys.Open("../x"); return err }, "../x", fs.ErrInvalid, nil},
+		{"not found", func(fsys *FS) error { _, err := fsys.Open("evidence.zip/missing"); return err }, "evidence.zip/missing", fs.ErrNotExist, nil},
+		{"corrupt", func(fsys *FS) error { _, err := fsys.Open("bad.zip/doc.txt"); return err }, "bad.zip/doc.txt", ErrCorruptContainer, []*filetype.Filetype{nil}},
+		{"nested corrupt", func(fsys *FS) error { _, err := fsys.Open("archive.tar/bad.zip/doc.txt"); return err }, "archive.tar/bad.zip/doc.txt", ErrCorruptContainer, []*filetype.Filetype{filetype.Tar, nil}},
+		{"forced corrupt", func(fsys *FS) error { _, err := fsys.OpenAs("bad.zip", filetype.Zip, 0); return err }, "bad.zip", ErrCorruptContainer, []*filetype.Filetype{nil}},
+		{"corrupt gpt", func(fsys *FS) error { _, err := fsys.Open("bad.dd/p0"); return err }, "bad.dd/p0", ErrCorruptContainer, []*filetype.Filetype{nil}},
+		{"parser panic", func(fsys *FS) error { _, err := fsys.Open("gpt.dd/p999"); return err }, "gpt.dd/p999", ErrCorruptContainer, []*filetype.Filetype{filetype.GPT}},
+		{"unsupported", func(fsys *FS) error { _, err := fsys.OpenAs("plain.txt", nil, 0); return err }, "plain.txt", ErrUnsupportedFormat, []*filetype.Filetype{nil}},
+		{"encrypted", func(fsys *FS) error { _, err := fsys.OpenAs("bitlocker.dd", BitLocker, 0); return err }, "bitlocker.dd", ErrEncrypted, []*filetype.Filetype{nil}},
+		{"encrypted path", func(fsys *FS) error { _, err := fsys.Open("bitlocker.dd/x"); return err }, "bitlocker.dd/x", ErrEncrypted, []*filetype.Filetype{nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(root)
+			defer fsys.Close()
+
+			err := tt.open(fsys)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			var pe *fs.PathError
+			if !errors.As(err, &pe) || pe.Path != tt.wantPath {
+				t.Errorf("error = %#v, want path %s", err, tt.wantPath)
+			}
+
+			var ce *ContainerError
+			if errors.As(err, &ce) != (tt.wantLayers != nil) {
+				t.Fatalf("error = %v, want ContainerError %v", err, tt.wantLayers != nil)
+			}
+			if ce == nil {
+				return
+			}
+			if len(ce.Layers) != len(tt.wantLayers) {
+				t.Fatalf("Layers = %v, want %d layers", ce.Layers, len(tt.wantLayers))
+			}
+			for i, layer := range ce.Layers {
+				if layer.Format != tt.wantLayers[i] {
+					t.Errorf("Layers[%d].Format = %v, want %v", i, layer.Format, tt.wantLayers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestErrors_LimitExceeded(t *testing.T) {
+	fsys := NewFS(fstest.MapFS{"archive.tar": &fstest.MapFile{Data: testTar(t)}},
+		WithMemoryLimit(0), WithTempDir(t.TempDir()), WithTempQuota(16))
+	defer fsys.Close()
+
+	_, err := fsys.Open("archive.tar/nested.zip/doc.txt")
+	if !errors.Is(err, ErrLimitExceeded) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Open() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	var ce *ContainerError
+	if !errors.As(err, &ce) || len(ce.Layers) != 2 || ce.Layers[0].Format != filetype.Tar {
+		t.Errorf("error = %#v, want layers of archive.tar/nested.zip", err)
+	}
+}
+
+// brokenFS fails to read the information of files named broken.txt.
+type brokenFS struct {
+	fs.FS
+}
+
+type brokenDir struct {
+	fs.ReadDirFile
+}
+
+type brokenEntry struct {
+	fs.DirEntry
+}
+
+func (b *brokenFS) Open(name string) (fs.File, error) {
+	f, err := b.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir, ok := f.(fs.ReadDirFile); ok {
+		return &brokenDir{ReadDirFile: dir}, nil
+	}
+	return f, nil
+}
+
+func (d *brokenDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.ReadDirFile.ReadDir(n)
+	for i, entry := range entries {
+		if entry.Name() == "broken.txt" {
+			entries[i] = &brokenEntry{DirEntry: entry}
+		}
+	}
+	return entries, err
+}
+
+func (e *brokenEntry) Info() (fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "stat", Path: e.Name(), Err: io.ErrUnexpectedEOF}
+}
+
+func TestTolerance(t *testing.T) {
+	root := &brokenFS{FS: fstest.MapFS{
+		"evidence.zip": &fstest.MapFile{Data: testZip(t)},
+		"bad.zip":      &fstest.MapFile{Data: append([]byte("PK\x03\x04"), make([]byte, 100)...)},
+		"broken.txt":   &fstest.MapFile{Data: []byte("broken")},
+	}}
+
+	// without tolerance the listing and the damaged container fail
+	strict := NewFS(root)
+	defer strict.Close()
+	if _, err := strict.ReadDir("."); err == nil {
+		t.Error("ReadDir() error = nil")
+	}
+	if _, err := strict.Stat("bad.zip"); !errors.Is(err, ErrCorruptContainer) {
+		t.Errorf("Stat() error = %v, want %v", err, ErrCorruptContainer)
+	}
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	fsys := NewFS(root, WithTolerance(func(name string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed[name] = err
+	}))
+	defer fsys.Close()
+
+	var dirs []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{".", "evidence.zip", "evidence.zip/dir"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("directories = %v, want %v", dirs, want)
+	}
+
+	data, err := fs.ReadFile(fsys, "bad.zip")
+	if err != nil || len(data) != 104 {
+		t.Errorf("ReadFile() = %d bytes, %v", len(data), err)
+	}
+	info, err := fsys.Stat("bad.zip")
+	if err != nil || info.IsDir() {
+		t.Errorf("Stat() = %v, %v", info, err)
+	}
+	// the path inside of the damaged container still fails
+	if _, err := fsys.Open("bad.zip/doc.txt"); !errors.Is(err, ErrCorruptContainer) {
+		t.Errorf("Open() error = %v, want %v", err, ErrCorruptContainer)
+	}
+
+	var names []string
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"bad.zip", "broken.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("errors = %v, want %v", failed, want)
+	}
+	if !errors.Is(failed["bad.zip"], ErrCorruptContainer) || !errors.Is(failed["broken.txt"], io.ErrUnexpectedEOF) {
+		t.Errorf("errors = %v", failed)
+	}
+}
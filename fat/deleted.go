@@ -0,0 +1,125 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package fat
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+)
+
+const deletedDir = "$Deleted"
+
+func virtualDir() *dirEntry {
+	return &dirEntry{attr: attrDirectory, allocated: true, virtual: true}
+}
+
+// deletedEntries walks all directories and returns the deleted files whose
+// clusters are unallocated.
+func (fsys *FS) deletedEntries() ([]*dirEntry, error) {
+	if fsys.deletedList != nil {
+		return fsys.deletedList, nil
+	}
+
+	deleted := []*dirEntry{}
+	visited := map[uint32]bool{}
+	var walk func(dir *dirEntry) error
+	walk = func(dir *dirEntry) error {
+		entries, err := fsys.readDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			switch {
+			case entry.allocated && entry.isDir():
+				if visited[entry.cluster] || entry.cluster < 2 {
+					continue
+				}
+				visited[entry.cluster] = true
+				if err := walk(entry); err != nil {
+					return err
+				}
+			case !entry.allocated && !entry.isDir():
+				if entry.size == 0 || fsys.contiguous(entry.cluster, int64(entry.size)) != nil {
+					deleted = append(deleted, entry)
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(fsys.root()); err != nil {
+		return nil, err
+	}
+	fsys.deletedList = deleted
+	return deleted, nil
+}
+
+// deletedName prefixes the name with the position of the directory entry to
+// keep the names unique.
+func deletedName(entry *dirEntry) string {
+	return fmt.Sprintf("%d-%s", entry.offset, entry.name)
+}
+
+func (fsys *FS) openDeleted(name string, parts []string) (fs.File, error) {
+	entries, err := fsys.deletedEntries()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	switch len(parts) {
+	case 0:
+		return &deletedFile{File: File{fsys: fsys, entry: virtualDir(), name: deletedDir}, entries: entries}, nil
+	case 1:
+		i := strings.Index(parts[0], "-")
+		if i < 0 {
+			break
+		}
+		offset, err := strconv.ParseInt(parts[0][:i], 10, 64)
+		if err != nil {
+			break
+		}
+		for _, entry := range entries {
+			if entry.offset == offset && deletedName(entry) == parts[0] {
+				return fsys.open(entry, parts[0])
+			}
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// deletedFile is the virtual directory of deleted files.
+type deletedFile struct {
+	File
+	entries []*dirEntry
+}
+
+// ReadDir returns up to n deleted files.
+func (f *deletedFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := make([]fs.DirEntry, 0, len(f.entries))
+	for _, entry := range f.entries {
+		entries = append(entries, newDirEntry(f.fsys, entry, deletedName(entry)))
+	}
+	return direntries.Read(n, entries, &f.dirOffset)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package fat
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	lowerBase      = 0x08
+	lowerExtension = 0x10
+	lfnLast        = 0x40
+)
+
+type dirEntry struct {
+	name       string
+	shortName  string
+	attr       uint8
+	cluster    uint32
+	size       uint32
+	modTime    time.Time
+	createTime time.Time
+	accessTime time.Time
+	allocated  bool
+	offset     int64 // position of the short entry in the volume
+	root       bool
+	virtual    bool // $Deleted or $Unallocated
+}
+
+func (e *dirEntry) isDir() bool { return e.attr&attrDirectory != 0 }
+
+// dirData reads the content of a directory and returns the volume offset of
+// each directory entry.
+func (fsys *FS) dirData(dir *dirEntry) ([]byte, func(int) int64, error) {
+	if dir.root && fsys.fatType != 32 {
+		b := make([]byte, fsys.rootEntries*dirEntrySize)
+		if _, err := fsys.r.ReadAt(b, fsys.rootOffset); err != nil {
+			return nil, nil, err
+		}
+		return b, func(p int) int64 { return fsys.rootOffset + int64(p) }, nil
+	}
+
+	clusters := fsys.chain(dir.cluster)
+	b := make([]byte, int64(len(clusters))*fsys.clusterSize)
+	for i, c := range clusters {
+		if _, err := fsys.r.ReadAt(b[int64(i)*fsys.clusterSize:int64(i+1)*fsys.clusterSize], fsys.clusterOffset(c)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return b, func(p int) int64 {
+		return fsys.clusterOffset(clusters[int64(p)/fsys.clusterSize]) + int64(p)%fsys.clusterSize
+	}, nil
+}
+
+// readDir returns all entries of a directory including deleted entries,
+// volume labels and the dot entries are skipped.
+func (fsys *FS) readDir(dir *dirEntry) ([]*dirEntry, error) {
+	b, offset, err := fsys.dirData(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*dirEntry
+	var lfn []uint16
+	var lfnChecksum byte
+	var lfnDeleted bool
+	for p := 0; p+dirEntrySize <= len(b); p += dirEntrySize {
+		e := b[p : p+dirEntrySize]
+		if e[0] == 0 {
+			break
+		}
+		deleted := e[0] == deletedMarker
+
+		if e[11]&0x3f == attrLFN {
+			// a new name starts with the last part, deleted names have no
+			// sequence numbers
+			if (!deleted && e[0]&lfnLast != 0) || deleted != lfnDeleted || e[13] != lfnChecksum {
+				lfn = nil
+			}
+			lfn = append(lfnPart(e), lfn...)
+			lfnChecksum, lfnDeleted = e[13], deleted
+			continue
+		}
+		if e[11]&attrVolumeID != 0 {
+			lfn = nil
+			continue
+		}
+
+		entry := &dirEntry{
+			shortName:  shortName(e),
+			attr:       e[11],
+			cluster:    uint32(le16(e[26:])),
+			size:       le32(e[28:]),
+			modTime:    timestamp(le16(e[24:]), le16(e[22:]), 0),
+			createTime: timestamp(le16(e[16:]), le16(e[14:]), e[13]),
+			accessTime: timestamp(le16(e[18:]), 0, 0),
+			allocated:  !deleted,
+			offset:     offset(p),
+		}
+		if fsys.fatType == 32 {
+			entry.cluster |= uint32(le16(e[20:])) << 16
+		}
+		entry.name = entry.shortName
+		// the checksum of deleted entries can not be verified as the first
+		// character is overwritten
+		if lfn != nil && deleted == lfnDeleted && (deleted || lfnChecksum == checksum(e[:11])) {
+			entry.name = decodeLFN(lfn)
+		}
+		lfn = nil
+
+		if entry.name == "." || entry.name == ".." || entry.name == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// lfnPart returns the characters of a long file name entry.
+func lfnPart(e []byte) []uint16 {
+	var part []uint16
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			part = append(part, le16(e[i:]))
+		}
+	}
+	return part
+}
+
+func decodeLFN(lfn []uint16) string {
+	for i, c := range lfn {
+		if c == 0 {
+			lfn = lfn[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(lfn))
+}
+
+// shortName returns the 8.3 name, the first character of deleted entries is
+// replaced by an underscore.
+func shortName(e []byte) string {
+	name := make([]byte, 8)
+	copy(name, e[:8])
+	switch name[0] {
+	case deletedMarker:
+		name[0] = '_'
+	case 0x05:
+		name[0] = deletedMarker
+	}
+	base := string(bytes.TrimRight(name, " "))
+	ext := string(bytes.TrimRight(e[8:11], " "))
+	if e[12]&lowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if e[12]&lowerExtension != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func checksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// timestamp converts FAT date and time values, the time zone is unknown and
+// UTC is used.
+func timestamp(date, t uint16, tenths byte) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		1980+int(date>>9), time.Month(date>>5&0x0f), int(date&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2+int(tenths)/100,
+		int(tenths)%100*10*int(time.Millisecond), time.UTC,
+	)
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+// Package fat provides a read-only io/fs implementation of the FAT12, FAT16
+// and FAT32 file systems.
+//
+// Long file names are supported. With the WithDeleted option the virtual
+// directory $Deleted lists deleted files whose clusters have not been
+// reallocated. With the WithUnallocated option the unallocated clusters are
+// available as $Unallocated and the slack space of files as "name:$Slack".
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/forensicanalysis/recursivefs/internal/segment"
+)
+
+const (
+	bootSectorSize = 512
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrLFN       = 0x0f
+
+	dirEntrySize  = 32
+	deletedMarker = 0xe5
+
+	// maxClusters is the number of clusters of the largest FAT32 volume
+	maxClusters = 0x0ffffff5
+)
+
+// Match checks if the buffer starts with a FAT12 or FAT32 boot sector, FAT16
+// is detected by the filetype library.
+func Match(buf []byte) bool {
+	if len(buf) < bootSectorSize || buf[510] != 0x55 || buf[511] != 0xaa {
+		return false
+	}
+	return string(buf[0x36:0x3b]) == "FAT12" || string(buf[0x52:0x57]) == "FAT32"
+}
+
+func le16(b []byte) uint16 { return binary.LittleEndian.Uint16(b) }
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+
+// FS implements a read-only file system for FAT.
+type FS struct {
+	r io.ReaderAt
+
+	fatType      int
+	clusterSize  int64
+	clusterCount uint32
+	rootOffset   int64 // FAT12 and FAT16 only
+	rootEntries  int64
+	rootCluster  uint32 // FAT32 only
+	dataOffset   int64
+	fat          []uint32
+
+	deleted     bool
+	deletedList []*dirEntry
+	unallocated bool
+}
+
+// Option configures a FS.
+type Option func(*FS)
+
+// WithDeleted adds the virtual directory $Deleted to the root that contains
+// the recoverable deleted files of all directories.
+func WithDeleted() Option {
+	return func(fsys *FS) {
+		fsys.deleted = true
+	}
+}
+
+// WithUnallocated adds the virtual file $Unallocated to the root that
+// contains all unallocated clusters and lists the slack space of files as
+// "name:$Slack".
+func WithUnallocated() Option {
+	return func(fsys *FS) {
+		fsys.unallocated = true
+	}
+}
+
+// New creates a new fat FS.
+func New(r io.ReaderAt, options ...Option) (*FS, error) {
+	b := make([]byte, bootSectorSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+
+	bytesPerSector := int64(le16(b[0x0b:]))
+	sectorsPerCluster := int64(b[0x0d])
+	reservedSectors := int64(le16(b[0x0e:]))
+	fatCount := int64(b[0x10])
+	rootEntries := int64(le16(b[0x11:]))
+	totalSectors := int64(le16(b[0x13:]))
+	if totalSectors == 0 {
+		totalSectors = int64(le32(b[0x20:]))
+	}
+	fatSize := int64(le16(b[0x16:]))
+	if fatSize == 0 {
+		fatSize = int64(le32(b[0x24:]))
+	}
+	if bytesPerSector < 512 || bytesPerSector&(bytesPerSector-1) != 0 || sectorsPerCluster == 0 ||
+		fatCount == 0 || fatSize == 0 || b[510] != 0x55 || b[511] != 0xaa {
+		return nil, errors.New("fat: invalid boot sector")
+	}
+
+	rootSectors := (rootEntries*dirEntrySize + bytesPerSector - 1) / bytesPerSector
+	dataSector := reservedSectors + fatCount*fatSize + rootSectors
+	if totalSectors <= dataSector {
+		return nil, errors.New("fat: invalid boot sector geometry")
+	}
+	clusterCount := (totalSectors - dataSector) / sectorsPerCluster
+	// the boot sector is not trusted, the allocation table and the root
+	// directory must be part of the image before memory is allocated for
+	// them. Truncated volumes are accepted, clusters that are not covered
+	// by the allocation table are ignored.
+	if clusterCount > maxClusters || !inImage(r, (reservedSectors+fatSize)*bytesPerSector) || !inImage(r, dataSector*bytesPerSector) {
+		return nil, errors.New("fat: boot sector geometry exceeds the image")
+	}
+
+	fsys := &FS{
+		r:            r,
+		clusterSize:  bytesPerSector * sectorsPerCluster,
+		clusterCount: uint32(clusterCount),
+		rootOffset:   (reservedSectors + fatCount*fatSize) * bytesPerSector,
+		rootEntries:  rootEntries,
+		dataOffset:   dataSector * bytesPerSector,
+	}
+	switch {
+	case clusterCount < 4085:
+		fsys.fatType = 12
+	case clusterCount < 65525:
+		fsys.fatType = 16
+	default:
+		fsys.fatType = 32
+		fsys.rootCluster = le32(b[0x2c:])
+	}
+
+	fat := make([]byte, fatSize*bytesPerSector)
+	if _, err := r.ReadAt(fat, reservedSectors*bytesPerSector); err != nil {
+		return nil, fmt.Errorf("fat: could not read allocation table: %w", err)
+	}
+	fsys.fat = fsys.decodeFAT(fat)
+
+	for _, option := range options {
+		option(fsys)
+	}
+	return fsys, nil
+}
+
+// decodeFAT returns the allocation table entries of all clusters.
+func (fsys *FS) decodeFAT(b []byte) []uint32 {
+	count := int64(fsys.clusterCount) + 2
+	if max := int64(len(b)) * 8 / int64(fsys.fatType); count > max {
+		count = max
+	}
+	fat := make([]uint32, count)
+	for n := range fat {
+		switch fsys.fatType {
+		case 12:
+			o := n * 3 / 2
+			if o+1 >= len(b) {
+				return fat[:n]
+			}
+			if n%2 == 0 {
+				fat[n] = uint32(b[o]) | uint32(b[o+1]&0x0f)<<8
+			} else {
+				fat[n] = uint32(b[o])>>4 | uint32(b[o+1])<<4
+			}
+		case 16:
+			if 2*n+2 > len(b) {
+				return fat[:n]
+			}
+			fat[n] = uint32(le16(b[2*n:]))
+		default:
+			if 4*n+4 > len(b) {
+				return fat[:n]
+			}
+			fat[n] = le32(b[4*n:]) & 0x0fffffff
+		}
+	}
+	return fat
+}
+
+// inImage checks if the image is at least size bytes large.
+func inImage(r io.ReaderAt, size int64) bool {
+	if size <= 0 {
+		return true
+	}
+	b := make([]byte, 1)
+	n, _ := r.ReadAt(b, size-1)
+	return n == 1
+}
+
+// chain returns the clusters that are allocated to a file starting at
+// cluster.
+func (fsys *FS) chain(cluster uint32) []uint32 {
+	var clusters []uint32
+	for cluster >= 2 && int(cluster) < len(fsys.fat) && len(clusters) < len(fsys.fat) {
+		clusters = append(clusters, cluster)
+		cluster = fsys.fat[cluster]
+	}
+	return clusters
+}
+
+// contiguous returns the clusters of a deleted file, they are expected to be
+// contiguous as the chain is cleared on deletion. Nil is returned if any of
+// the clusters has been reallocated.
+func (fsys *FS) contiguous(cluster uint32, size int64) []uint32 {
+	count := (size + fsys.clusterSize - 1) / fsys.clusterSize
+	if cluster < 2 || int64(cluster)+count > int64(len(fsys.fat)) {
+		return nil
+	}
+	clusters := make([]uint32, count)
+	for i := range clusters {
+		c := cluster + uint32(i)
+		if fsys.fat[c] != 0 {
+			return nil
+		}
+		clusters[i] = c
+	}
+	return clusters
+}
+
+func (fsys *FS) clusterOffset(cluster uint32) int64 {
+	return fsys.dataOffset + int64(cluster-2)*fsys.clusterSize
+}
+
+// root returns the directory entry of the root directory.
+func (fsys *FS) root() *dirEntry {
+	return &dirEntry{name: ".", attr: attrDirectory, cluster: fsys.rootCluster, allocated: true, root: true}
+}
+
+// Open opens a file or directory for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entry := fsys.root()
+	if name != "." {
+		parts := strings.Split(name, "/")
+		if fsys.deleted && parts[0] == deletedDir {
+			return fsys.openDeleted(name, parts[1:])
+		}
+		if fsys.unallocated && name == unallocatedFile {
+			return fsys.openUnallocated(), nil
+		}
+		if last := parts[len(parts)-1]; fsys.unallocated && strings.HasSuffix(last, ":"+slackStream) {
+			parts[len(parts)-1] = strings.TrimSuffix(last, ":"+slackStream)
+			return fsys.openSlack(name, parts)
+		}
+		var err error
+		if entry, err = fsys.lookup(parts); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return fsys.open(entry, base(name))
+}
+
+// lookup returns the allocated directory entry of a path.
+func (fsys *FS) lookup(parts []string) (*dirEntry, error) {
+	entry := fsys.root()
+	for _, part := range parts {
+		if !entry.isDir() {
+			return nil, fs.ErrNotExist
+		}
+		entries, err := fsys.readDir(entry)
+		if err != nil {
+			return nil, err
+		}
+		var found *dirEntry
+		for _, e := range entries {
+			if e.allocated && e.name == part {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return nil, fs.ErrNotExist
+		}
+		entry = found
+	}
+	return entry, nil
+}
+
+func (fsys *FS) open(entry *dirEntry, name string) (fs.File, error) {
+	f := &File{fsys: fsys, entry: entry, name: name}
+	if !entry.isDir() {
+		clusters := fsys.chain(entry.cluster)
+		if !entry.allocated {
+			clusters = fsys.contiguous(entry.cluster, int64(entry.size))
+		}
+		f.size = int64(entry.size)
+		f.data = segment.NewReader(fsys.r, fsys.span(clusters, 0, f.size))
+	}
+	return f, nil
+}
+
+// span returns the volume ranges of the bytes from to to of the clusters.
+func (fsys *FS) span(clusters []uint32, from, to int64) []segment.Segment {
+	var segments []segment.Segment
+	for i, c := range clusters {
+		start, end := int64(i)*fsys.clusterSize, int64(i+1)*fsys.clusterSize
+		offset := fsys.clusterOffset(c) - start
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if start < end {
+			segments = append(segments, segment.Segment{Offset: offset + start, Length: end - start})
+		}
+	}
+	return segments
+}
+
+// base returns the last element of a path.
+func base(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
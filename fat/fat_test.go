@@ -0,0 +1,438 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+)
+
+const testSectorSize = 512
+
+type testImage struct {
+	b           []byte
+	fatType     int
+	reserved    int64
+	fatSize     int64
+	rootEntries int64
+	next        uint32
+}
+
+func newTestImage(fatType int) *testImage {
+	img := &testImage{fatType: fatType, reserved: 1, rootEntries: 64, next: 3}
+	var sectors int64
+	switch fatType {
+	case 12:
+		sectors = 2000
+		img.fatSize = 6
+	case 16:
+		sectors = 5000
+		img.fatSize = 20
+	default:
+		sectors = 70000
+		img.fatSize = 550
+		img.reserved = 32
+		img.rootEntries = 0
+	}
+	img.b = make([]byte, sectors*testSectorSize)
+
+	b := img.b
+	copy(b, []byte{0xeb, 0x3c, 0x90})
+	binary.LittleEndian.PutUint16(b[0x0b:], testSectorSize)
+	b[0x0d] = 1
+	binary.LittleEndian.PutUint16(b[0x0e:], uint16(img.reserved))
+	b[0x10] = 2
+	binary.LittleEndian.PutUint16(b[0x11:], uint16(img.rootEntries))
+	binary.LittleEndian.PutUint32(b[0x20:], uint32(sectors))
+	if fatType == 32 {
+		binary.LittleEndian.PutUint32(b[0x24:], uint32(img.fatSize))
+		binary.LittleEndian.PutUint32(b[0x2c:], 2)
+		copy(b[0x52:], "FAT32   ")
+	} else {
+		binary.LittleEndian.PutUint16(b[0x16:], uint16(img.fatSize))
+		copy(b[0x36:], fmt.Sprintf("FAT%d   ", fatType))
+	}
+	b[510], b[511] = 0x55, 0xaa
+
+	img.setFAT(0, 0x0ffffff8)
+	img.setFAT(1, 0x0fffffff)
+	if fatType == 32 {
+		img.setFAT(2, 0x0fffffff)
+	}
+	return img
+}
+
+func (img *testImage) setFAT(n, v uint32) {
+	fat := img.b[img.reserved*testSectorSize : (img.reserved+img.fatSize)*testSectorSize]
+	switch img.fatType {
+	case 12:
+		v &= 0xfff
+		o := n * 3 / 2
+		if n%2 == 0 {
+			fat[o] = byte(v)
+			fat[o+1] = fat[o+1]&0xf0 | byte(v>>8)
+		} else {
+			fat[o] = fat[o]&0x0f | byte(v<<4)
+			fat[o+1] = byte(v >> 4)
+		}
+	case 16:
+		binary.LittleEndian.PutUint16(fat[2*n:], uint16(v))
+	default:
+		binary.LittleEndian.PutUint32(fat[4*n:], v)
+	}
+}
+
+func (img *testImage) cluster(n uint32) []byte {
+	rootSectors := img.rootEntries * dirEntrySize / testSectorSize
+	off := (img.reserved + 2*img.fatSize + rootSectors + int64(n) - 2) * testSectorSize
+	return img.b[off : off+testSectorSize]
+}
+
+// write stores data in the given clusters and links them in the allocation
+// table if allocated is set.
+func (img *testImage) write(data []byte, allocated bool, clusters ...uint32) {
+	for i, c := range clusters {
+		end := (i + 1) * testSectorSize
+		if end > len(data) {
+			end = len(data)
+		}
+		copy(img.cluster(c), data[i*testSectorSize:end])
+		if allocated {
+			next := uint32(0x0fffffff)
+			if i+1 < len(clusters) {
+				next = clusters[i+1]
+			}
+			img.setFAT(c, next)
+		}
+	}
+}
+
+func shortEntry(name string, attr, lower byte, cluster uint32, size int) []byte {
+	e := make([]byte, dirEntrySize)
+	copy(e, "           ")
+	copy(e, name)
+	e[11] = attr
+	e[12] = lower
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], uint32(size))
+	binary.LittleEndian.PutUint16(e[22:], 12<<11|30<<5)  // 12:30:00
+	binary.LittleEndian.PutUint16(e[24:], 41<<9|6<<5|15) // 2021-06-15
+	binary.LittleEndian.PutUint16(e[16:], 41<<9|6<<5|14) // 2021-06-14
+	return e
+}
+
+// longEntries returns the long file name entries followed by the short
+// entry.
+func longEntries(name string, short []byte, deleted bool) []byte {
+	chars := utf16.Encode([]rune(name))
+	chars = append(chars, 0)
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xffff)
+	}
+	sum := checksum(short[:11])
+	var b []byte
+	for seq := len(chars) / 13; seq > 0; seq-- {
+		e := make([]byte, dirEntrySize)
+		e[0] = byte(seq)
+		if seq == len(chars)/13 {
+			e[0] |= lfnLast
+		}
+		if deleted {
+			e[0] = deletedMarker
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		part := chars[(seq-1)*13 : seq*13]
+		p := 0
+		for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+			for i := r[0]; i < r[1]; i += 2 {
+				binary.LittleEndian.PutUint16(e[i:], part[p])
+				p++
+			}
+		}
+		b = append(b, e...)
+	}
+	if deleted {
+		short[0] = deletedMarker
+	}
+	return append(b, short...)
+}
+
+func testImageFS(t *testing.T, fatType int, options ...Option) *FS {
+	fsys, err := New(bytes.NewReader(testImageData(fatType)), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsys.fatType != fatType {
+		t.Fatalf("fat type = %d, want %d", fsys.fatType, fatType)
+	}
+	return fsys
+}
+
+// testImageData returns an image with a long file name, a sub directory with
+// a fragmented file and deleted files.
+func testImageData(fatType int) []byte {
+	img := newTestImage(fatType)
+
+	hello := []byte("hello fat")
+	nested := bytes.Repeat([]byte("n"), 600)
+	deleted := []byte("deleted content")
+	img.write(hello, true, 3)
+	copy(img.cluster(3)[len(hello):], "slack data")
+	img.write(nested, true, 10, 12) // fragmented
+	img.write(deleted, false, 20)
+
+	var root []byte
+	root = append(root, shortEntry("TESTVOL", attrVolumeID, 0, 0, 0)...)
+	root = append(root, longEntries("Long File Name.txt", shortEntry("LONGFI~1TXT", 0, 0, 3, len(hello)), false)...)
+	root = append(root, shortEntry("SUB", attrDirectory, 0, 5, 0)...)
+	root = append(root, longEntries("deleted.txt", shortEntry("DELETED TXT", 0, 0, 20, len(deleted)), true)...)
+	// deleted file whose cluster has been reallocated
+	gone := shortEntry("GONE    TXT", 0, 0, 3, 5)
+	gone[0] = deletedMarker
+	root = append(root, gone...)
+	if fatType == 32 {
+		copy(img.cluster(2), root)
+	} else {
+		rootOffset := (img.reserved + 2*img.fatSize) * testSectorSize
+		copy(img.b[rootOffset:], root)
+	}
+
+	var sub []byte
+	sub = append(sub, shortEntry(".", attrDirectory, 0, 5, 0)...)
+	sub = append(sub, shortEntry("..", attrDirectory, 0, 0, 0)...)
+	sub = append(sub, shortEntry("NESTED  TXT", attrReadOnly, lowerBase|lowerExtension, 10, len(nested))...)
+	img.write(sub, true, 5)
+	return img.b
+}
+
+func TestFS(t *testing.T) {
+	for _, fatType := range []int{12, 16, 32} {
+		fsys := testImageFS(t, fatType)
+		if err := fstest.TestFS(fsys, "Long File Name.txt", "SUB/nested.txt"); err != nil {
+			t.Errorf("FAT%d: %v", fatType, err)
+		}
+
+		want := map[string][]byte{
+			"Long File Name.txt": []byte("hello fat"),
+			"SUB/nested.txt":     bytes.Repeat([]byte("n"), 600),
+		}
+		for name, data := range want {
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("FAT%d: ReadFile(%s) = %q, want %q", fatType, name, got, data)
+			}
+		}
+
+		info, err := fs.Stat(fsys, "SUB/nested.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*Stat)
+		if stat.ShortName != "nested.txt" || !stat.Allocated || info.Mode() != 0444 || info.ModTime().Year() != 2021 {
+			t.Errorf("FAT%d: Stat() = %s %#v", fatType, info.Mode(), stat)
+		}
+		if _, err := fsys.Open(deletedDir); err == nil {
+			t.Errorf("FAT%d: Open(%s) succeeded without WithDeleted", fatType, deletedDir)
+		}
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	for _, fatType := range []int{12, 16, 32} {
+		fsys := testImageFS(t, fatType, WithDeleted())
+
+		entries, err := fs.ReadDir(fsys, deletedDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("FAT%d: ReadDir(%s) = %v, want 1 entry", fatType, deletedDir, entries)
+		}
+		name := deletedDir + "/" + entries[0].Name()
+		if err := fstest.TestFS(fsys, "Long File Name.txt", name); err != nil {
+			t.Errorf("FAT%d: %v", fatType, err)
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "deleted content" {
+			t.Errorf("FAT%d: ReadFile(%s) = %q", fatType, name, data)
+		}
+		info, err := entries[0].Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat := info.Sys().(*Stat); stat.Allocated || stat.ShortName != "_ELETED.TXT" {
+			t.Errorf("FAT%d: Stat() = %#v", fatType, stat)
+		}
+	}
+}
+
+func TestUnallocated(t *testing.T) {
+	for _, fatType := range []int{12, 16, 32} {
+		fsys := testImageFS(t, fatType, WithUnallocated())
+
+		if fatType == 12 {
+			if err := fstest.TestFS(fsys, "Long File Name.txt:$Slack", "SUB/nested.txt:$Slack", "$Unallocated"); err != nil {
+				t.Errorf("FAT%d: %v", fatType, err)
+			}
+		}
+
+		slack, err := fs.ReadFile(fsys, "Long File Name.txt:$Slack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(slack) != testSectorSize-len("hello fat") || !bytes.HasPrefix(slack, []byte("slack data")) {
+			t.Errorf("FAT%d: slack = %q", fatType, slack[:16])
+		}
+		info, err := fs.Stat(fsys, "SUB/nested.txt:$Slack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 2*testSectorSize-600 || !info.Sys().(*Stat).Slack {
+			t.Errorf("FAT%d: Stat() = %d %#v", fatType, info.Size(), info.Sys())
+		}
+		if _, err := fsys.Open("SUB:$Slack"); err == nil {
+			t.Errorf("FAT%d: Open() of directory slack succeeded", fatType)
+		}
+
+		unallocated, err := fs.ReadFile(fsys, unallocatedFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(unallocated)) != int64(len(fsys.unallocatedClusters()))*testSectorSize ||
+			!bytes.Contains(unallocated, []byte("deleted content")) || bytes.Contains(unallocated, []byte("hello fat")) {
+			t.Errorf("FAT%d: %s has %d bytes", fatType, unallocatedFile, len(unallocated))
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(bytes.NewReader(make([]byte, 1024))); err == nil {
+		t.Error("New() error = nil for empty image")
+	}
+	// crafted boot sectors must not allocate more memory than the image size
+	for _, craft := range []func(b []byte){
+		func(b []byte) { binary.LittleEndian.PutUint32(b[0x24:], 0xffffffff) },
+		func(b []byte) { binary.LittleEndian.PutUint32(b[0x20:], 0xffffffff) },
+	} {
+		img := newTestImage(32)
+		boot := img.b[:bootSectorSize]
+		binary.LittleEndian.PutUint16(boot[0x16:], 0)
+		binary.LittleEndian.PutUint16(boot[0x13:], 0)
+		binary.LittleEndian.PutUint32(boot[0x24:], uint32(img.fatSize))
+		binary.LittleEndian.PutUint32(boot[0x20:], uint32(len(img.b)/testSectorSize))
+		craft(boot)
+		if fsys, err := New(bytes.NewReader(img.b)); err == nil && int64(len(fsys.fat)) > img.fatSize*testSectorSize/4 {
+			t.Errorf("New() allocated %d allocation table entries", len(fsys.fat))
+		}
+	}
+
+	if Match(make([]byte, bootSectorSize)) {
+		t.Error("Match() = true for empty boot sector")
+	}
+	if !Match(newTestImage(32).b) || !Match(newTestImage(12).b) {
+		t.Error("Match() = false for FAT12 or FAT32")
+	}
+}
+
+func TestDirEntry_Open(t *testing.T) {
+	fsys := testImageFS(t, 12, WithDeleted(), WithUnallocated())
+	for _, dir := range []string{".", "SUB", deletedDir} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			f, err := entry.(*DirEntry).Open()
+			if err != nil {
+				t.Fatalf("Open() of %s: %v", name, err)
+			}
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := fs.Stat(fsys, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Name() != want.Name() || info.Size() != want.Size() || info.IsDir() != want.IsDir() {
+				t.Errorf("Stat() of %s = %s %d, want %s %d", name, info.Name(), info.Size(), want.Name(), want.Size())
+			}
+			if !info.IsDir() {
+				data, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wantData, _ := fs.ReadFile(fsys, name); !bytes.Equal(data, wantData) {
+					t.Errorf("ReadAll() of %s = %q, want %q", name, data, wantData)
+				}
+			}
+			f.Close()
+		}
+	}
+
+	// duplicate names are opened by their own directory entry
+	img := newTestImage(12)
+	img.write([]byte("first"), true, 3)
+	img.write([]byte("second"), true, 4)
+	root := append(shortEntry("DUP     TXT", 0, 0, 3, 5), shortEntry("DUP     TXT", 0, 0, 4, 6)...)
+	copy(img.b[(img.reserved+2*img.fatSize)*testSectorSize:], root)
+	fsys, err := New(bytes.NewReader(img.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		f, err := entry.(*DirEntry).Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(data))
+	}
+	if len(got) != 2 || got[0] == got[1] {
+		t.Errorf("content of duplicates = %q", got)
+	}
+}
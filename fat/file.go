@@ -0,0 +1,218 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package fat
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+	"github.com/forensicanalysis/recursivefs/internal/segment"
+)
+
+// File is a file or directory of the file system.
+type File struct {
+	fsys      *FS
+	entry     *dirEntry
+	name      string
+	data      *segment.Reader
+	size      int64
+	slack     bool
+	offset    int64
+	dirOffset int
+}
+
+// Read reads bytes into the passed buffer.
+func (f *File) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads bytes starting at off into the passed buffer.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.entry.isDir() {
+		return 0, syscall.EISDIR
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if remaining := f.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+	n, rerr := f.data.ReadAt(p, off)
+	if rerr == io.EOF && n < len(p) {
+		// the cluster chain is shorter than the file
+		return n, io.ErrUnexpectedEOF
+	}
+	if rerr != nil && rerr != io.EOF {
+		return n, rerr
+	}
+	return n, err
+}
+
+// Seek moves the current offset to the given position.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.size
+	default:
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir returns up to n child items of a directory.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.entry.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	dirEntries, err := f.fsys.readDir(f.entry)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fs.DirEntry
+	for _, entry := range dirEntries {
+		if !entry.allocated {
+			continue
+		}
+		entries = append(entries, newDirEntry(f.fsys, entry, entry.name))
+		if f.fsys.unallocated && !entry.isDir() {
+			if slack := f.fsys.slack(entry); slack.Size() > 0 {
+				entries = append(entries, &DirEntry{fsys: f.fsys, entry: entry, name: entry.name + ":" + slackStream, size: slack.Size(), slack: true})
+			}
+		}
+	}
+	if f.entry.root && f.fsys.deleted {
+		entries = append(entries, newDirEntry(f.fsys, virtualDir(), deletedDir))
+	}
+	if f.entry.root && f.fsys.unallocated {
+		size := int64(len(f.fsys.unallocatedClusters())) * f.fsys.clusterSize
+		entries = append(entries, &DirEntry{fsys: f.fsys, entry: unallocatedEntry(), name: unallocatedFile, size: size})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return direntries.Read(n, entries, &f.dirOffset)
+}
+
+// Stat returns the fs.FileInfo of the file.
+func (f *File) Stat() (fs.FileInfo, error) {
+	return &DirEntry{fsys: f.fsys, entry: f.entry, name: f.name, size: f.size, slack: f.slack}, nil
+}
+
+// Close does not do anything for FAT files.
+func (f *File) Close() error { return nil }
+
+// Stat contains FAT specific attributes of a file.
+type Stat struct {
+	ShortName    string
+	Attributes   uint8
+	Cluster      uint32
+	CreationTime time.Time
+	AccessTime   time.Time
+
+	// Allocated is false for deleted files.
+	Allocated bool
+	// Offset is the position of the directory entry in the volume.
+	Offset int64
+	// Slack is set for the slack space behind the end of a file.
+	Slack bool
+}
+
+// DirEntry describes a file or directory and implements fs.DirEntry and
+// fs.FileInfo.
+type DirEntry struct {
+	fsys  *FS
+	entry *dirEntry
+	name  string
+	size  int64
+	slack bool
+}
+
+func newDirEntry(fsys *FS, entry *dirEntry, name string) *DirEntry {
+	d := &DirEntry{fsys: fsys, entry: entry, name: name}
+	if !entry.isDir() {
+		d.size = int64(entry.size)
+	}
+	return d
+}
+
+func (e *DirEntry) Name() string { return e.name }
+
+// Open opens the file of the entry. In contrast to FS.Open, the file is
+// found by its directory entry, so names that are not unique can be opened.
+func (e *DirEntry) Open() (fs.File, error) {
+	switch {
+	case e.entry.virtual:
+		return e.fsys.Open(e.name)
+	case e.slack:
+		data := e.fsys.slack(e.entry)
+		return &File{fsys: e.fsys, entry: e.entry, name: e.name, data: data, size: data.Size(), slack: true}, nil
+	}
+	return e.fsys.open(e.entry, e.name)
+}
+
+func (e *DirEntry) IsDir() bool { return e.entry.isDir() }
+
+func (e *DirEntry) Type() fs.FileMode { return e.Mode().Type() }
+
+func (e *DirEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e *DirEntry) Size() int64 { return e.size }
+
+func (e *DirEntry) Mode() fs.FileMode {
+	mode := fs.FileMode(0644)
+	if e.entry.attr&attrReadOnly != 0 {
+		mode = 0444
+	}
+	if e.IsDir() {
+		mode |= fs.ModeDir | 0111
+	}
+	return mode
+}
+
+func (e *DirEntry) ModTime() time.Time { return e.entry.modTime }
+
+// Sys returns the *Stat of the entry.
+func (e *DirEntry) Sys() interface{} {
+	return &Stat{
+		ShortName:    e.entry.shortName,
+		Attributes:   e.entry.attr,
+		Cluster:      e.entry.cluster,
+		CreationTime: e.entry.createTime,
+		AccessTime:   e.entry.accessTime,
+		Allocated:    e.entry.allocated,
+		Offset:       e.entry.offset,
+		Slack:        e.slack,
+	}
+}
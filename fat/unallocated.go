@@ -0,0 +1,73 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package fat
+
+import (
+	"io/fs"
+
+	"github.com/forensicanalysis/recursivefs/internal/segment"
+)
+
+const (
+	unallocatedFile = "$Unallocated"
+	slackStream     = "$Slack"
+)
+
+func unallocatedEntry() *dirEntry {
+	return &dirEntry{name: unallocatedFile, virtual: true}
+}
+
+// unallocatedClusters returns all clusters that are marked as free.
+func (fsys *FS) unallocatedClusters() []uint32 {
+	var clusters []uint32
+	for c := uint32(2); int(c) < len(fsys.fat); c++ {
+		if fsys.fat[c] == 0 {
+			clusters = append(clusters, c)
+		}
+	}
+	return clusters
+}
+
+func (fsys *FS) openUnallocated() *File {
+	clusters := fsys.unallocatedClusters()
+	data := segment.NewReader(fsys.r, fsys.span(clusters, 0, int64(len(clusters))*fsys.clusterSize))
+	return &File{fsys: fsys, entry: unallocatedEntry(), name: unallocatedFile, data: data, size: data.Size()}
+}
+
+// slack returns the bytes between the end of a file and the end of its last
+// cluster, and all further clusters of the chain.
+func (fsys *FS) slack(entry *dirEntry) *segment.Reader {
+	clusters := fsys.chain(entry.cluster)
+	return segment.NewReader(fsys.r, fsys.span(clusters, int64(entry.size), int64(len(clusters))*fsys.clusterSize))
+}
+
+func (fsys *FS) openSlack(name string, parts []string) (fs.File, error) {
+	entry, err := fsys.lookup(parts)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entry.isDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	data := fsys.slack(entry)
+	return &File{fsys: fsys, entry: entry, name: base(name), data: data, size: data.Size(), slack: true}, nil
+}
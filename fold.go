@@ -0,0 +1,173 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"container/list"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/forensicanalysis/filetype"
+)
+
+// caseInsensitive are the file systems whose names are compared without
+// regard to case by the operating systems that write them.
+var caseInsensitive = map[*filetype.Filetype]bool{
+	filetype.NTFS:  true,
+	filetype.FAT16: true,
+	FAT:            true,
+}
+
+// foldDirs is the number of directory listings a foldFS keeps.
+const foldDirs = 64
+
+// foldFS resolves names case-insensitively, e.g. "windows/SYSTEM32" opens
+// "Windows/System32". Files are opened by the name as stored in the file
+// system, so their information contains that name. Exact matches are
+// preferred, names that are not listed, like alternate data streams, are
+// matched by the name of their file.
+type foldFS struct {
+	fsys fs.FS
+
+	mu sync.Mutex
+	// dirs indexes the recently listed directories in lru, the least
+	// recently used is evicted first
+	dirs map[string]*list.Element
+	lru  *list.List
+}
+
+// foldDir maps the folded names of a directory to its names.
+type foldDir struct {
+	dir   string
+	names map[string][]string
+}
+
+func newFoldFS(fsys fs.FS) *foldFS {
+	return &foldFS{fsys: fsys, dirs: map[string]*list.Element{}, lru: list.New()}
+}
+
+// Open opens the file whose name matches name regardless of case.
+func (f *foldFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.fsys.Open(f.canonical(name))
+}
+
+// Stat returns the information of the file whose name matches name
+// regardless of case.
+func (f *foldFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return fs.Stat(f.fsys, f.canonical(name))
+}
+
+// canonical returns the path with the names as stored in the file system.
+func (f *foldFS) canonical(name string) string {
+	if name == "." {
+		return name
+	}
+	canonical := "."
+	for _, elem := range strings.Split(name, "/") {
+		canonical = path.Join(canonical, f.lookup(canonical, elem))
+	}
+	return canonical
+}
+
+// lookup returns the name of the entry of dir that matches elem. elem is
+// returned unchanged if no entry matches. dir is only listed if the file
+// system does not find elem itself.
+func (f *foldFS) lookup(dir, elem string) string {
+	info, err := fs.Stat(f.fsys, path.Join(dir, elem))
+	if err == nil && strings.EqualFold(info.Name(), elem) {
+		// parsers like NTFS match names regardless of case
+		return info.Name()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return elem
+	}
+	names, ok := f.names(dir)
+	if !ok {
+		return elem
+	}
+
+	if match, ok := matchName(names, elem); ok {
+		return match
+	}
+	// alternate data streams and slack, e.g. "file.txt:Zone.Identifier"
+	if i := strings.Index(elem, ":"); i > 0 {
+		if match, ok := matchName(names, elem[:i]); ok {
+			return match + elem[i:]
+		}
+	}
+	return elem
+}
+
+// names returns the names of the entries of dir by their folded name.
+func (f *foldFS) names(dir string) (map[string][]string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e, ok := f.dirs[dir]; ok {
+		f.lru.MoveToFront(e)
+		return e.Value.(*foldDir).names, true
+	}
+	entries, err := fs.ReadDir(f.fsys, dir)
+	if err != nil {
+		return nil, false
+	}
+	names := map[string][]string{}
+	for _, entry := range entries {
+		key := foldName(entry.Name())
+		names[key] = append(names[key], entry.Name())
+	}
+	f.dirs[dir] = f.lru.PushFront(&foldDir{dir: dir, names: names})
+	if f.lru.Len() > foldDirs {
+		oldest := f.lru.Remove(f.lru.Back()).(*foldDir)
+		delete(f.dirs, oldest.dir)
+	}
+	return names, true
+}
+
+func matchName(names map[string][]string, elem string) (string, bool) {
+	candidates := names[foldName(elem)]
+	for _, candidate := range candidates {
+		if candidate == elem {
+			return candidate, true
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0], true
+	}
+	return "", false
+}
+
+// foldName returns the key under which names that differ only in case are
+// equal. Like NTFS, names are compared in upper case.
+func foldName(name string) string {
+	return strings.ToUpper(name)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	root := ntfsRoot(t).(fstest.MapFS)
+	root["fat.dd"] = &fstest.MapFile{Data: gunzip(t, "fat/testdata/test.fat12.dd.gz")}
+	root["evidence.zip"] = &fstest.MapFile{Data: testZip(t)}
+
+	tests := []struct {
+		name     string
+		options  []Option
+		wantName string
+		wantPath string
+		wantErr  bool
+	}{
+		{"fat.dd/long file name.TXT", nil, "Long File Name.txt", "Long File Name.txt", false},
+		{"fat.dd/sub/NESTED.TXT", nil, "nested.txt", "SUB/nested.txt", false},
+		{"ntfs.dd/folder a/FOLDER B/hello world text document.txt", nil, "Hello world text document.txt", "Folder A/Folder B/Hello world text document.txt", false},
+		{"fat.dd/SUB/nested.txt", []Option{WithCaseSensitive()}, "nested.txt", "SUB/nested.txt", false},
+		{"fat.dd/sub/nested.txt", []Option{WithCaseSensitive()}, "", "", true},
+		// zip files and the root file system keep their case
+		{"evidence.zip/DOC.txt", nil, "", "", true},
+		{"FAT.dd/SUB/nested.txt", nil, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(root, tt.options...)
+			info, err := fs.Stat(fsys, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Stat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Stat() error = %v, want %v", err, fs.ErrNotExist)
+				}
+				return
+			}
+			if info.Name() != tt.wantName {
+				t.Errorf("Name() = %q, want %q", info.Name(), tt.wantName)
+			}
+
+			layers, err := fsys.Resolve(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := layers[len(layers)-1].Path; got != tt.wantPath {
+				t.Errorf("Resolve() path = %q, want %q", got, tt.wantPath)
+			}
+
+			if _, err := fs.ReadFile(fsys, tt.name); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFoldFS(t *testing.T) {
+	fsys := newFoldFS(fstest.MapFS{
+		"Dir/File.txt": &fstest.MapFile{Data: []byte("file")},
+		"Dir/A.txt":    &fstest.MapFile{Data: []byte("upper")},
+		"Dir/a.txt":    &fstest.MapFile{Data: []byte("lower")},
+	})
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"dir/file.TXT", "file", false},
+		{"DIR/A.txt", "upper", false},
+		{"dir/a.txt", "lower", false},
+		{"dir/missing.txt", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := fs.ReadFile(fsys, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(data) != tt.want {
+				t.Errorf("ReadFile() = %q, want %q", data, tt.want)
+			}
+		})
+	}
+
+	if err := fstest.TestFS(fsys, "Dir/File.txt", "Dir/A.txt", "Dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFoldFS_Lookup(t *testing.T) {
+	root := fstest.MapFS{}
+	for i := 0; i < 2*foldDirs; i++ {
+		root[fmt.Sprintf("Dir%d/File.txt", i)] = &fstest.MapFile{Data: []byte("file")}
+	}
+
+	// exact names are opened without listing their directories
+	unlisted := newFoldFS(&unlistedFS{root})
+	if _, err := fs.Stat(unlisted, "Dir0/File.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := newFoldFS(root)
+	for i := 0; i < 2*foldDirs; i++ {
+		if _, err := fs.Stat(fsys, fmt.Sprintf("dir%d/file.txt", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fsys.dirs) > foldDirs || fsys.lru.Len() > foldDirs {
+		t.Errorf("%d listings kept, want at most %d", len(fsys.dirs), foldDirs)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package recursivefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/fslib/fsio"
+	"github.com/forensicanalysis/fslib/gpt"
+	"github.com/forensicanalysis/fslib/mbr"
+)
+
+const (
+	sectorSize = 512
+
+	// maxGPTEntries limits the partition entries that are read
+	maxGPTEntries = 1 << 16
+)
+
+// Gap is a range of sectors of a partitioned disk that is not part of any
+// partition. It is returned by Info.Sys() of unallocated-* files.
+type Gap struct {
+	FirstSector int64
+	LastSector  int64
+}
+
+func (g Gap) name() string {
+	return fmt.Sprintf("unallocated-%010d-%010d", g.FirstSector, g.LastSector)
+}
+
+// checkGPT validates the GPT header and partition entries, which are not
+// checked when they are parsed.
+func checkGPT(r fsio.ReadSeekerAt) error {
+	size, err := fsio.GetSize(r)
+	if err != nil {
+		return err
+	}
+	sectors := size / sectorSize
+
+	header := make([]byte, 92)
+	if _, err := r.ReadAt(header, sectorSize); err != nil {
+		return err
+	}
+	if string(header[:8]) != "EFI PART" {
+		return errors.New("invalid GPT signature")
+	}
+	start := binary.LittleEndian.Uint64(header[72:])
+	count := int64(binary.LittleEndian.Uint32(header[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:]))
+	if entrySize < 128 || count > maxGPTEntries || start >= uint64(sectors) ||
+		int64(start)*sectorSize+count*entrySize > size {
+		return errors.New("invalid GPT partition entries")
+	}
+
+	entries := make([]byte, count*entrySize)
+	if _, err := r.ReadAt(entries, int64(start)*sectorSize); err != nil && err != io.EOF {
+		return err
+	}
+	for i := int64(0); i < count; i++ {
+		entry := entries[i*entrySize:]
+		first, last := binary.LittleEndian.Uint64(entry[32:]), binary.LittleEndian.Uint64(entry[40:])
+		if (first != 0 || last != 0) && (first > last || last >= uint64(sectors)) {
+			return fmt.Errorf("invalid GPT partition %d", i)
+		}
+	}
+	return nil
+}
+
+// gptFS reads the partitions of a GPT disk from the sectors of their
+// partition entries, gpt.Partition computes the length of its section wrong.
+type gptFS struct {
+	fs.FS
+	r io.ReaderAt
+}
+
+func (fsys *gptFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := f.(*gpt.Partition); ok {
+		entry := p.Sys().(*gpt.PartitionEntry)
+		p.SectionReader = io.NewSectionReader(fsys.r, int64(entry.FirstLba())*sectorSize, p.Size())
+	}
+	return f, nil
+}
+
+// partitionGaps returns the unpartitioned sectors of a MBR or GPT disk.
+func partitionGaps(t *filetype.Filetype, r fsio.ReadSeekerAt) ([]Gap, error) {
+	size, err := fsio.GetSize(r)
+	if err != nil {
+		return nil, err
+	}
+	sectors := size / sectorSize
+	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	used := []Gap{{0, 0}} // the MBR or protective MBR
+	switch t {
+	case filetype.MBR:
+		table := mbr.MbrPartitionTable{}
+		if err := table.Decode(r); err != nil {
+			return nil, err
+		}
+		for _, p := range table.Partitions() {
+			if p.NumSectors() != 0 {
+				used = append(used, Gap{int64(p.LbaStart()), int64(p.LbaStart()) + int64(p.NumSectors()) - 1})
+			}
+		}
+	case filetype.GPT:
+		table := gpt.GptPartitionTable{}
+		if err := table.Decode(r); err != nil {
+			return nil, err
+		}
+		header := table.Primary()
+		if header == nil {
+			return nil, errors.New("invalid GPT header")
+		}
+		// partition tables and headers
+		used = append(used,
+			Gap{0, int64(header.FirstUsableLba()) - 1},
+			Gap{int64(header.LastUsableLba()) + 1, sectors - 1},
+		)
+		for _, p := range header.Entries() {
+			if p.FirstLba() != 0 || p.LastLba() != 0 {
+				used = append(used, Gap{int64(p.FirstLba()), int64(p.LastLba())})
+			}
+		}
+	}
+	_, _ = r.Seek(0, os.SEEK_SET)
+
+	sort.Slice(used, func(i, j int) bool { return used[i].FirstSector < used[j].FirstSector })
+	var gaps []Gap
+	next := int64(0)
+	for _, u := range used {
+		if u.FirstSector > next && next < sectors {
+			last := u.FirstSector - 1
+			if last >= sectors {
+				last = sectors - 1
+			}
+			gaps = append(gaps, Gap{next, last})
+		}
+		if u.LastSector+1 > next {
+			next = u.LastSector + 1
+		}
+	}
+	if next < sectors {
+		gaps = append(gaps, Gap{next, sectors - 1})
+	}
+	return gaps, nil
+}
+
+func withGaps(fsys fs.FS, t *filetype.Filetype, r fsio.ReadSeekerAt) (fs.FS, error) {
+	gaps, err := partitionGaps(t, r)
+	if err != nil {
+		return nil, err
+	}
+	return &gapFS{FS: fsys, r: r, gaps: gaps}, nil
+}
+
+// gapFS adds the unpartitioned sectors of a disk to the partitions of a
+// partition table file system.
+type gapFS struct {
+	fs.FS
+	r    io.ReaderAt
+	gaps []Gap
+}
+
+func (fsys *gapFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		return fsys.openRoot()
+	}
+	for _, g := range fsys.gaps {
+		if g.name() == name {
+			return fsys.gapFile(g), nil
+		}
+	}
+	return fsys.FS.Open(name)
+}
+
+// openRoot opens the root directory and lists its partitions and gaps.
+func (fsys *gapFS) openRoot() (fs.File, error) {
+	root, err := fsys.FS.Open(".")
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := root.(fs.ReadDirFile)
+	if !ok {
+		_ = root.Close()
+		return nil, &fs.PathError{Op: "readdir", Path: ".", Err: fs.ErrInvalid}
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		_ = root.Close()
+		return nil, err
+	}
+	for _, g := range fsys.gaps {
+		entries = append(entries, fsys.gapFile(g))
+	}
+	return &gapRoot{File: root, entries: entries}, nil
+}
+
+func (fsys *gapFS) gapFile(g Gap) *gapFile {
+	offset := g.FirstSector * sectorSize
+	size := (g.LastSector - g.FirstSector + 1) * sectorSize
+	return &gapFile{SectionReader: io.NewSectionReader(fsys.r, offset, size), gap: g}
+}
+
+// gapRoot lists the partitions and the gaps.
+type gapRoot struct {
+	fs.File
+	entries   []fs.DirEntry
+	dirOffset int
+}
+
+func (r *gapRoot) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, offset, err := dirEntries(n, r.entries, r.dirOffset)
+	r.dirOffset += offset
+	return entries, err
+}
+
+// gapFile is a file that contains the sectors of a gap.
+type gapFile struct {
+	*io.SectionReader
+	gap Gap
+}
+
+func (f *gapFile) Name() string               { return f.gap.name() }
+func (f *gapFile) IsDir() bool                { return false }
+func (f *gapFile) Mode() fs.FileMode          { return 0 }
+func (f *gapFile) Type() fs.FileMode          { return 0 }
+func (f *gapFile) ModTime() time.Time         { return time.Time{} }
+func (f *gapFile) Sys() interface{}           { return &f.gap }
+func (f *gapFile) Info() (fs.FileInfo, error) { return f, nil }
+func (f *gapFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *gapFile) Close() error               { return nil }
@@ -1,13 +1,28 @@
 module github.com/forensicanalysis/recursivefs
 
-go 1.16
+go 1.21
 
 require (
 	github.com/forensicanalysis/filetype v0.1.0
 	github.com/forensicanalysis/fscmd v0.2.0
 	github.com/forensicanalysis/fslib v0.15.1
 	github.com/forensicanalysis/goaff4 v0.3.0
-	github.com/nlepage/go-tarfs v1.1.0
+	github.com/h2non/filetype v1.1.1
+	github.com/klauspost/compress v1.13.6
 	github.com/spf13/cobra v1.7.0
+	www.velocidex.com/golang/go-ntfs v0.1.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/djherbis/times v1.5.0 // indirect
+	github.com/golang/snappy v0.0.2 // indirect
+	github.com/hashicorp/golang-lru v0.5.4 // indirect
+	github.com/knakk/rdf v0.0.0-20190304171630-8521bf4c5042 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/stretchr/testify v1.7.1 // indirect
+	github.com/xlab/treeprint v1.1.0 // indirect
 	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
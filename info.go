@@ -24,6 +24,7 @@ package recursivefs
 
 import (
 	"io/fs"
+	"sync"
 	"time"
 )
 
@@ -31,6 +32,21 @@ import (
 type Info struct {
 	internal fs.FileInfo
 	isFS     bool
+	layers   []Layer
+
+	// detect checks if the file is a container on first use
+	detect func() bool
+	once   sync.Once
+}
+
+// container returns if the file is a container.
+func (m *Info) container() bool {
+	m.once.Do(func() {
+		if m.detect != nil {
+			m.isFS = m.detect()
+		}
+	})
+	return m.isFS
 }
 
 func (m *Info) Type() fs.FileMode {
@@ -51,27 +67,52 @@ func (m *Info) Size() int64 {
 
 func (m *Info) Mode() fs.FileMode {
 	if m.IsDir() {
-		// return fs.ModeDir
 		return m.internal.Mode() | fs.ModeDir
 	}
-	// return 0
 	return m.internal.Mode()
 }
 
 func (m *Info) ModTime() time.Time {
-	// return time.Date(2020, 1, 1, 12, 12, 12, 12, time.UTC)
 	return m.internal.ModTime()
 }
 
+// Sys returns the Sys() of the underlying file or a *Provenance if the FS was
+// created with WithProvenance.
 func (m *Info) Sys() interface{} {
+	if m.layers != nil {
+		return &Provenance{Layers: m.layers, Sys: m.internal.Sys()}
+	}
 	return m.internal.Sys()
 }
 
+// IsContainer returns if the item is a file that is presented as directory
+// because it contains a file system (e.g. zip archives).
+func (m *Info) IsContainer() bool {
+	return !m.internal.IsDir() && m.container()
+}
+
+// RealMode returns the mode of the underlying file, which does not contain
+// fs.ModeDir for containers.
+func (m *Info) RealMode() fs.FileMode {
+	return m.internal.Mode()
+}
+
 // IsDir returns if the item is a directory. Returns true for files that are file
 // systems (e.g. zip archives).
 func (m *Info) IsDir() bool {
-	if m.isFS {
+	if m.container() {
 		return true
 	}
 	return m.internal.IsDir()
 }
+
+// entryInfo describes a directory entry whose fs.FileInfo could not be read,
+// only the name and the type are known.
+type entryInfo struct {
+	fs.DirEntry
+}
+
+func (e *entryInfo) Size() int64        { return 0 }
+func (e *entryInfo) Mode() fs.FileMode  { return e.Type() }
+func (e *entryInfo) ModTime() time.Time { return time.Time{} }
+func (e *entryInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,59 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+// Package direntries implements the paging of fs.ReadDirFile.ReadDir for
+// directories whose entries are read at once.
+package direntries
+
+import (
+	"io"
+	"io/fs"
+)
+
+// Read returns up to n entries starting at *offset and advances the offset.
+// If n > 0, io.EOF is returned at the end of the directory, otherwise all
+// remaining entries are returned.
+func Read(n int, entries []fs.DirEntry, offset *int) ([]fs.DirEntry, error) {
+	// directory already exhausted
+	if n <= 0 && *offset >= len(entries) {
+		return nil, nil
+	}
+
+	var err error
+	// read till end
+	if n > 0 && *offset+n > len(entries) {
+		err = io.EOF
+		if *offset > len(entries) {
+			return nil, err
+		}
+	}
+
+	if n > 0 && *offset+n <= len(entries) {
+		entries = entries[*offset : *offset+n]
+		*offset += n
+	} else {
+		entries = entries[*offset:]
+		*offset += len(entries)
+	}
+
+	return entries, err
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package direntries
+
+import (
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRead(t *testing.T) {
+	entries, err := fs.ReadDir(fstest.MapFS{"a": {}, "b": {}, "c": {}}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		n       []int
+		want    []int
+		wantErr []error
+	}{
+		{"all", []int{-1, -1}, []int{3, 0}, []error{nil, nil}},
+		{"pages", []int{2, 2, 2}, []int{2, 1, 0}, []error{nil, io.EOF, io.EOF}},
+		{"exact", []int{3, 1}, []int{3, 0}, []error{nil, io.EOF}},
+		{"rest", []int{1, 0}, []int{1, 2}, []error{nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset := 0
+			for i, n := range tt.n {
+				got, err := Read(n, entries, &offset)
+				if len(got) != tt.want[i] || err != tt.wantErr[i] {
+					t.Errorf("Read(%d) = %d entries, %v, want %d entries, %v", n, len(got), err, tt.want[i], tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+// Package seekfs wraps a fs.FS so that all files can be read at arbitrary
+// offsets. Files that implement io.ReaderAt and io.Seeker are returned
+// unchanged, other files are buffered while they are read. A Spool limits
+// the memory used for buffering: small files are kept in memory, larger files
+// are spilled to a temporary directory.
+// In contrast to fslib's bufferfs, closing a file closes the underlying file.
+package seekfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/forensicanalysis/fslib/fsio"
+)
+
+// ErrQuotaExceeded is returned if a file does not fit into the quota of the
+// temporary directory.
+var ErrQuotaExceeded = errors.New("temporary directory quota exceeded")
+
+// Spool decides where files are buffered. A single Spool can be shared by
+// many file systems so the quota covers all of them.
+type Spool struct {
+	memoryLimit int64
+	dir         string
+	quota       int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewSpool creates a Spool that keeps files of up to memoryLimit bytes in
+// memory and spills larger files to dir, which defaults to os.TempDir. The
+// temporary files use at most quota bytes, 0 disables the quota. A negative
+// memoryLimit keeps all files in memory.
+func NewSpool(memoryLimit int64, dir string, quota int64) *Spool {
+	return &Spool{memoryLimit: memoryLimit, dir: dir, quota: quota}
+}
+
+// Used returns the number of bytes currently stored in temporary files.
+func (s *Spool) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// spill reports whether a file of the given size is buffered on disk.
+func (s *Spool) spill(size int64) bool {
+	return s != nil && s.memoryLimit >= 0 && size > s.memoryLimit
+}
+
+// reserve allocates size bytes of the quota.
+func (s *Spool) reserve(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota > 0 && s.used+size > s.quota {
+		return ErrQuotaExceeded
+	}
+	s.used += size
+	return nil
+}
+
+// free returns size bytes to the quota.
+func (s *Spool) free(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= size
+}
+
+// FS wraps a fs.FS.
+type FS struct {
+	internal fs.FS
+	spool    *Spool
+}
+
+// New wraps the fs.FS. Files are buffered using the spool, a nil spool keeps
+// all files in memory.
+func New(fsys fs.FS, spool *Spool) *FS {
+	return &FS{internal: fsys, spool: spool}
+}
+
+// Open opens a file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	f, err := fsys.internal.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := Wrap(f, fsys.spool)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// Wrap returns f if it implements io.ReaderAt and io.Seeker, other files are
+// buffered using the spool.
+func Wrap(f fs.File, spool *Spool) (fs.File, error) {
+	if _, ok := f.(fsio.ReadSeekerAt); ok {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f, size: info.Size(), isDir: info.IsDir(), spool: spool}, nil
+}
+
+// Stat returns the fs.FileInfo of the file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.internal, name)
+}
+
+// File buffers the content of a file that does not support random access.
+// ReadAt can be called concurrently.
+type File struct {
+	fs.File
+	size   int64
+	isDir  bool
+	offset int64
+	spool  *Spool
+
+	// mu guards the buffer
+	mu       sync.Mutex
+	buf      []byte
+	tmp      *os.File // buffer of spilled files
+	reserved int64
+	filled   int64
+}
+
+// fill buffers the file up to end.
+func (f *File) fill(end int64) error {
+	if f.filled >= end {
+		return nil
+	}
+	if f.tmp == nil && f.spool.spill(f.size) {
+		if err := f.createTemp(); err != nil {
+			return err
+		}
+	}
+	var n int64
+	var err error
+	if f.tmp != nil {
+		n, err = io.CopyN(f.tmp, f.File, end-f.filled)
+	} else {
+		buf := make([]byte, end-f.filled)
+		var m int
+		m, err = io.ReadFull(f.File, buf)
+		f.buf = append(f.buf, buf[:m]...)
+		n = int64(m)
+	}
+	f.filled += n
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// createTemp creates the temporary file for a spilled file.
+func (f *File) createTemp() error {
+	if err := f.spool.reserve(f.size); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.spool.dir, "seekfs-*")
+	if err != nil {
+		f.spool.free(f.size)
+		return err
+	}
+	f.tmp, f.reserved = tmp, f.size
+	return nil
+}
+
+// Read reads bytes into the passed buffer.
+func (f *File) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads bytes starting at off into the passed buffer.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.isDir {
+		return 0, syscall.EISDIR
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fill(end); err != nil && err != io.EOF {
+		return 0, err
+	}
+	if off >= f.filled {
+		return 0, io.EOF
+	}
+	if f.tmp != nil {
+		n, err = f.tmp.ReadAt(p[:min(int64(len(p)), f.filled-off)], off)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	} else {
+		n = copy(p, f.buf[off:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Seek moves the current offset to the given position.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.size
+	default:
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir returns up to n entries of a directory.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	return dir.ReadDir(n)
+}
+
+// Close releases the buffer, removes the temporary file and closes the
+// underlying file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = nil
+	if f.tmp != nil {
+		_ = f.tmp.Close()
+		_ = os.Remove(f.tmp.Name())
+		f.spool.free(f.reserved)
+		f.tmp = nil
+	}
+	return f.File.Close()
+}
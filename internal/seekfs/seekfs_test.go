@@ -0,0 +1,154 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package seekfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+)
+
+// streamFS returns files that can only be read sequentially.
+type streamFS struct {
+	fs.FS
+	closed int
+}
+
+type streamFile struct {
+	fs.File
+	fsys *streamFS
+}
+
+func (s *streamFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &streamFile{File: f, fsys: s}, nil
+}
+
+func (f *streamFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return f.File.(fs.ReadDirFile).ReadDir(n)
+}
+
+func (f *streamFile) Close() error {
+	f.fsys.closed++
+	return f.File.Close()
+}
+
+func TestFS(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	tests := []struct {
+		name     string
+		fsys     fs.FS
+		spool    *Spool
+		buffered bool
+	}{
+		{"random access", fstest.MapFS{"file": &fstest.MapFile{Data: content}}, nil, false},
+		{"stream", &streamFS{FS: fstest.MapFS{"file": &fstest.MapFile{Data: content}}}, nil, true},
+		{"memory", &streamFS{FS: fstest.MapFS{"file": &fstest.MapFile{Data: content}}}, NewSpool(16, t.TempDir(), 0), true},
+		{"spill", &streamFS{FS: fstest.MapFS{"file": &fstest.MapFile{Data: content}}}, NewSpool(8, t.TempDir(), 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := New(tt.fsys, tt.spool)
+			f, err := fsys.Open("file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := f.(*File); ok != tt.buffered {
+				t.Errorf("Open() = %T", f)
+			}
+			if err := iotest.TestReader(f.(io.Reader), content); err != nil {
+				t.Error(err)
+			}
+
+			b := make([]byte, 4)
+			if n, err := f.(io.ReaderAt).ReadAt(b, 14); n != 2 || err != io.EOF || string(b[:n]) != "ef" {
+				t.Errorf("ReadAt() = %d, %v", n, err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if s, ok := tt.fsys.(*streamFS); ok && s.closed != 1 {
+				t.Errorf("underlying file closed %d times", s.closed)
+			}
+
+			if err := fstest.TestFS(fsys, "file"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSpool(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	dir := t.TempDir()
+	spool := NewSpool(4, dir, 24)
+	fsys := New(&streamFS{FS: fstest.MapFS{
+		"a":     &fstest.MapFile{Data: content},
+		"b":     &fstest.MapFile{Data: content},
+		"small": &fstest.MapFile{Data: content[:4]},
+	}}, spool)
+
+	a, err := fsys.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := a.(io.ReaderAt).ReadAt(b, 10); err != nil || string(b) != "ab" {
+		t.Fatalf("ReadAt() = %q, %v", b, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || spool.Used() != 16 {
+		t.Errorf("temp files = %d, used = %d", len(entries), spool.Used())
+	}
+
+	// a second spilled file exceeds the quota, small files stay in memory
+	f, err := fsys.Open("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(b); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	_ = f.Close()
+	small, err := fsys.Open("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(small); err != nil || string(data) != "0123" {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+	_ = small.Close()
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 || spool.Used() != 0 {
+		t.Errorf("temp files = %d, used = %d after Close", len(entries), spool.Used())
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+// Package segment provides a reader that concatenates byte ranges of an
+// underlying io.ReaderAt, e.g. the unallocated clusters of a file system.
+package segment
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+// Segment is a byte range of the underlying reader.
+type Segment struct {
+	Offset int64
+	Length int64
+}
+
+// Reader reads the segments as one contiguous stream.
+type Reader struct {
+	r        io.ReaderAt
+	segments []Segment
+	starts   []int64 // position of each segment in the stream
+	size     int64
+}
+
+// NewReader creates a new Reader, adjacent segments are merged.
+func NewReader(r io.ReaderAt, segments []Segment) *Reader {
+	sr := &Reader{r: r}
+	for _, s := range segments {
+		if s.Length <= 0 {
+			continue
+		}
+		if last := len(sr.segments) - 1; last >= 0 && sr.segments[last].Offset+sr.segments[last].Length == s.Offset {
+			sr.segments[last].Length += s.Length
+		} else {
+			sr.segments = append(sr.segments, s)
+			sr.starts = append(sr.starts, sr.size)
+		}
+		sr.size += s.Length
+	}
+	return sr
+}
+
+// Size returns the total length of all segments.
+func (r *Reader) Size() int64 { return r.size }
+
+// Segments returns the merged segments.
+func (r *Reader) Segments() []Segment { return r.segments }
+
+// ReadAt reads bytes starting at off into the passed buffer.
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("segment: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	i := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > off }) - 1
+	for n < len(p) {
+		s := r.segments[i]
+		within := off + int64(n) - r.starts[i]
+		chunk := p[n:]
+		if int64(len(chunk)) > s.Length-within {
+			chunk = chunk[:s.Length-within]
+		}
+		m, rerr := r.r.ReadAt(chunk, s.Offset+within)
+		n += m
+		if rerr != nil && !(rerr == io.EOF && m == len(chunk)) {
+			return n, rerr
+		}
+		i++
+	}
+	return n, err
+}
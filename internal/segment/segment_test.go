@@ -0,0 +1,56 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package segment
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	tests := []struct {
+		name     string
+		segments []Segment
+		want     string
+		merged   int
+	}{
+		{"empty", nil, "", 0},
+		{"single", []Segment{{2, 3}}, "234", 1},
+		{"adjacent", []Segment{{2, 3}, {5, 2}}, "23456", 1},
+		{"gaps", []Segment{{0, 2}, {10, 3}, {18, 2}}, "01abcij", 3},
+		{"zero length", []Segment{{0, 0}, {4, 1}}, "4", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(data), tt.segments)
+			if r.Size() != int64(len(tt.want)) || len(r.Segments()) != tt.merged {
+				t.Errorf("Size() = %d, Segments() = %v", r.Size(), r.Segments())
+			}
+			if err := iotest.TestReader(io.NewSectionReader(r, 0, r.Size()), []byte(tt.want)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
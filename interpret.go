@@ -0,0 +1,158 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package recursivefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/fslib/fsio"
+)
+
+// containerTypes are the file types that can be opened as file systems.
+var containerTypes = []*filetype.Filetype{
+	filetype.Zip, filetype.Xlsx, filetype.Pptx, filetype.Docx, filetype.Tar,
+	filetype.FAT16, FAT, filetype.MBR, filetype.GPT, filetype.NTFS, filetype.AFF4,
+	LVM, XFS, Btrfs, BitLocker,
+}
+
+// FiletypeByID returns the container file type with the given ID, e.g.
+// "ntfs" or "zip".
+func FiletypeByID(id string) (*filetype.Filetype, bool) {
+	for _, t := range containerTypes {
+		if string(t.ID) == id {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// interpretation forces the file type and the start offset of a container.
+type interpretation struct {
+	filetype *filetype.Filetype // detected if nil
+	offset   int64
+}
+
+// suffix returns the path suffix of the interpretation.
+func (in *interpretation) suffix() string {
+	switch {
+	case in == nil:
+		return ""
+	case in.filetype == nil:
+		return fmt.Sprintf("@offset=%d", in.offset)
+	}
+	return fmt.Sprintf("@offset=%d:%s", in.offset, in.filetype.ID)
+}
+
+// splitInterpretation splits a path element like
+// "disk.bin@offset=1048576:ntfs" into the file name and its interpretation.
+func splitInterpretation(elem string) (string, *interpretation, bool) {
+	i := strings.LastIndex(elem, "@")
+	if i <= 0 {
+		return elem, nil, false
+	}
+	spec := elem[i+1:]
+
+	in := &interpretation{}
+	if strings.HasPrefix(spec, "offset=") {
+		value := strings.TrimPrefix(spec, "offset=")
+		spec = ""
+		if j := strings.Index(value, ":"); j >= 0 {
+			value, spec = value[:j], value[j+1:]
+		}
+		offset, err := strconv.ParseInt(value, 0, 64)
+		if err != nil || offset < 0 {
+			return elem, nil, false
+		}
+		in.offset = offset
+	} else if spec == "" {
+		return elem, nil, false
+	}
+	if spec != "" {
+		t, ok := FiletypeByID(spec)
+		if !ok {
+			return elem, nil, false
+		}
+		in.filetype = t
+	}
+	return elem[:i], in, true
+}
+
+// containerSeparator marks path elements that are opened as containers if
+// explicit containers are enabled, e.g. "evidence.zip!/doc.pdf".
+const containerSeparator = "!"
+
+// splitContainer splits the container separator or the interpretation suffix
+// from a path element.
+func (fsys *FS) splitContainer(elem string) (string, *interpretation, bool) {
+	if fsys.explicit && len(elem) > len(containerSeparator) && strings.HasSuffix(elem, containerSeparator) {
+		elem = strings.TrimSuffix(elem, containerSeparator)
+		if name, in, ok := splitInterpretation(elem); ok {
+			return name, in, true
+		}
+		return elem, &interpretation{}, true
+	}
+	return splitInterpretation(elem)
+}
+
+// interpretFS opens the file as the forced type starting at the offset.
+func (fsys *FS) interpretFS(f fs.File, name string, in *interpretation) (*filetype.Filetype, fs.FS, error) {
+	readSeekerAt, ok := f.(fsio.ReadSeekerAt)
+	if !ok {
+		return nil, nil, &ContainerError{Kind: ErrUnsupportedFormat, Format: in.filetype, Err: errors.New("files must be ReadSeekerAt")}
+	}
+	size, err := fsio.GetSize(readSeekerAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in.offset > size {
+		return nil, nil, fmt.Errorf("%w: offset %d is behind the end of %s", fs.ErrInvalid, in.offset, name)
+	}
+	section := io.NewSectionReader(readSeekerAt, in.offset, size-in.offset)
+
+	t := in.filetype
+	var cfsys fs.FS
+	if t == nil {
+		t, cfsys, err = fsys.detectFS(section, name)
+	} else {
+		cfsys, err = fsys.parse(t, section, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfsys == nil {
+		return nil, nil, &ContainerError{Kind: ErrUnsupportedFormat, Format: in.filetype, Err: fmt.Errorf("could not open %s as %s", name, typeName(in.filetype))}
+	}
+	return t, cfsys, nil
+}
+
+func typeName(t *filetype.Filetype) string {
+	if t == nil {
+		return "container"
+	}
+	return string(t.ID)
+}
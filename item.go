@@ -23,82 +23,173 @@
 package recursivefs
 
 import (
+	"context"
+	"errors"
 	"io"
 	"io/fs"
 	"path"
 	"sort"
+	"sync"
 
 	"github.com/forensicanalysis/fslib"
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+	"github.com/forensicanalysis/recursivefs/internal/seekfs"
 )
 
-// Item describes files and directories in the file system.
+// Item describes files and directories in the file system. Containers are
+// directories, but Read still returns the bytes of the container file.
 type Item struct {
+	fsys      *FS
+	name      string
 	parentFS  fs.FS
 	localPath string
 
 	internal fs.File
 	childFS  fs.FS
+	layers   []Layer
 
+	// owner holds the file systems the item depends on
+	owner     *node
+	closeOnce sync.Once
+
+	// ctx aborts reads of items opened with OpenContext
+	ctx context.Context
+
+	// dirMu guards the directory state
+	dirMu     sync.Mutex
+	entries   []fs.DirEntry
+	dirRead   bool
 	dirOffset int
 }
 
 func (i *Item) Read(bytes []byte) (int, error) {
+	if err := i.ctx.Err(); err != nil {
+		return 0, err
+	}
 	return i.internal.Read(bytes)
 }
 
-func (i *Item) Close() error {
-	return i.internal.Close()
+// ReadAt reads len(p) bytes starting at off, see io.ReaderAt.
+func (i *Item) ReadAt(p []byte, off int64) (int, error) {
+	if err := i.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return i.internal.(io.ReaderAt).ReadAt(p, off)
+}
+
+// Seek sets the offset for the next Read, see io.Seeker.
+func (i *Item) Seek(offset int64, whence int) (int64, error) {
+	return i.internal.(io.Seeker).Seek(offset, whence)
+}
+
+// openFile opens a file that supports random access. Files of stream-only
+// file systems are buffered.
+func (fsys *FS) openFile(parent fs.FS, name string) (fs.File, error) {
+	f, err := parent.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seekfs.Wrap(f, fsys.spool)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// Close closes the file and releases the containers it is located in.
+func (i *Item) Close() (err error) {
+	err = fs.ErrClosed
+	i.closeOnce.Do(func() {
+		err = i.internal.Close()
+		i.owner.release()
+	})
+	return err
+}
+
+// Raw opens the file of the item without parsing it as container, e.g. to
+// read the bytes of a zip file. The returned file must be closed separately.
+func (i *Item) Raw() (fs.File, error) {
+	f, err := i.fsys.openFile(i.parentFS, i.localPath)
+	if err != nil {
+		return nil, err
+	}
+	raw := &Item{fsys: i.fsys, name: i.name, parentFS: i.parentFS, localPath: i.localPath, internal: f, owner: i.owner.acquire(), ctx: i.ctx}
+	if i.layers != nil {
+		raw.layers = append([]Layer{}, i.layers...)
+		raw.layers[len(raw.layers)-1].Format = nil
+		raw.layers[len(raw.layers)-1].FormatOffset = 0
+	}
+	return raw, nil
 }
 
 // ReadDir returns up to n child items of a directory.
 func (i *Item) ReadDir(n int) (entries []fs.DirEntry, err error) {
-	if i.childFS != nil {
-		entries, err = fs.ReadDir(i.childFS, ".")
-		if err != nil {
-			return nil, err
-		}
-		entries, err = recEntries(entries, ".", i.childFS)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		entries, err = fslib.ReadDir(i.internal, -1)
-		if err != nil {
-			return nil, err
-		}
-		entries, err = recEntries(entries, i.localPath, i.parentFS)
-		if err != nil {
+	// the entries are read once, so the directory can be read in parts
+	if err := i.ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.dirMu.Lock()
+	defer i.dirMu.Unlock()
+	if !i.dirRead {
+		if i.entries, err = i.readDir(); err != nil {
 			return nil, err
 		}
+		i.dirRead = true
 	}
 
-	entries, offset, err := dirEntries(n, entries, i.dirOffset)
+	entries, offset, err := dirEntries(n, i.entries, i.dirOffset)
 	i.dirOffset += offset
 
 	return entries, err
 }
 
-func recEntries(ditems []fs.DirEntry, p string, fsys fs.FS) (items []fs.DirEntry, err error) {
+func (i *Item) readDir() (entries []fs.DirEntry, err error) {
+	// the entries that were read before an error are listed in tolerant mode
+	if i.childFS != nil {
+		entries, err = fs.ReadDir(i.childFS, ".")
+		if err != nil && !i.fsys.tolerate(i.name, err) {
+			return nil, err
+		}
+		return i.fsys.recEntries(entries, i.owner, i.name, ".", i.childFS)
+	}
+	entries, err = fslib.ReadDir(i.internal, -1)
+	if err != nil && !i.fsys.tolerate(i.name, err) {
+		return nil, err
+	}
+	return i.fsys.recEntries(entries, i.owner, i.name, i.localPath, i.parentFS)
+}
+
+// recEntries wraps the entries of a directory. Whether a file is a container
+// is only detected when the entry is inspected, so listing a directory does
+// not parse all files in it. Every entry holds a reference to owner until it
+// is inspected, as the directory may be closed before. The result is kept,
+// so it is not detected with the context of the listing, which may be done
+// by then.
+func (fsys *FS) recEntries(ditems []fs.DirEntry, owner *node, name, p string, parentFS fs.FS) (items []fs.DirEntry, err error) {
 	for _, item := range ditems {
+		key, name := path.Join(p, item.Name()), path.Join(name, item.Name())
 		info, err := item.Info()
 		if err != nil {
-			return nil, err
-		}
-		isFS := false
-		if !item.IsDir() {
-			f, err := fsys.Open(path.Join(p, item.Name()))
-			if err != nil {
+			if !fsys.tolerate(name, err) {
 				return nil, err
 			}
-			cfsys, err := childFS(f, item.Name())
-			if err != nil {
-				return nil, err
+			info = &entryInfo{DirEntry: item}
+		}
+		entry := &Info{internal: info}
+		if !item.IsDir() && !fsys.explicit {
+			l := newLease(owner)
+			entry.detect = func() bool {
+				defer l.release()
+				n, err := fsys.container(context.Background(), parentFS, l.node, key, name, nil)
+				n.release()
+				if err != nil && !errors.Is(err, errNoKeys) {
+					fsys.tolerate(name, err)
+				}
+				return err == nil && n != nil
 			}
-
-			isFS = cfsys != nil
 		}
-
-		items = append(items, &Info{info, isFS})
+		items = append(items, entry)
 	}
 	return items, nil
 }
@@ -108,34 +199,13 @@ func dirEntries(n int, items []fs.DirEntry, dirOffset int) ([]fs.DirEntry, int,
 		return items[i].Name() < items[j].Name()
 	})
 
-	// directory already exhausted
-	if n <= 0 && dirOffset >= len(items) {
-		return nil, 0, nil
-	}
-
-	var err error
-	// read till end
-	if n > 0 && dirOffset+n > len(items) {
-		err = io.EOF
-		if dirOffset > len(items) {
-			return nil, 0, err
-		}
-	}
-
-	offset := 0
-	if n > 0 && dirOffset+n <= len(items) {
-		items = items[dirOffset : dirOffset+n]
-		offset += n
-	} else {
-		items = items[dirOffset:]
-		offset += len(items)
-	}
-
-	return items, offset, err
+	offset := dirOffset
+	entries, err := direntries.Read(n, items, &offset)
+	return entries, offset - dirOffset, err
 }
 
 // Stat return an fs.FileInfo object that describes a file.
 func (i *Item) Stat() (fs.FileInfo, error) {
 	info, err := i.internal.Stat()
-	return &Info{info, i.childFS != nil}, err
+	return &Info{internal: info, isFS: i.childFS != nil, layers: i.layers}, err
 }
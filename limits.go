@@ -0,0 +1,169 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/fslib/fsio"
+)
+
+// ErrSelfReference is returned for containers that contain a copy of
+// themselves, e.g. zip quines. It is wrapped in an error of kind
+// ErrLimitExceeded.
+var ErrSelfReference = errors.New("container contains itself")
+
+// fingerprintSize is the number of bytes at the start of a container that
+// identify it together with its size.
+const fingerprintSize = 64 << 10
+
+// fingerprint identifies the content of a container.
+type fingerprint struct {
+	size int64
+	head [sha256.Size]byte
+}
+
+// newFingerprint hashes the start of the file. As a container is larger than
+// any file in it, a nested container with the same fingerprint as one of its
+// ancestors can only be created by compression.
+func newFingerprint(r fsio.ReadSeekerAt) (fingerprint, error) {
+	size, err := fsio.GetSize(r)
+	if err != nil {
+		return fingerprint{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, fingerprintSize)); err != nil {
+		return fingerprint{}, err
+	}
+	fp := fingerprint{size: size}
+	copy(fp.head[:], h.Sum(nil))
+	return fp, nil
+}
+
+// checkSelfReference returns an error if an ancestor of the container has the
+// same fingerprint.
+func checkSelfReference(t *filetype.Filetype, fp fingerprint, owner *node) error {
+	for n := owner; n != nil; n = n.parent {
+		if n.fingerprint == fp {
+			return &ContainerError{Kind: ErrLimitExceeded, Format: t, Err: ErrSelfReference}
+		}
+	}
+	return nil
+}
+
+// checkDepth returns an error if a container in owner exceeds the nesting
+// depth.
+func (fsys *FS) checkDepth(owner *node) error {
+	if fsys.maxDepth > 0 && owner.level() >= fsys.maxDepth {
+		return &ContainerError{Kind: ErrLimitExceeded, Err: fmt.Errorf("nesting depth exceeds %d", fsys.maxDepth)}
+	}
+	return nil
+}
+
+// withDeadline limits the time to open a container. The returned function
+// must be called with the error of the operation, it cancels the context and
+// converts the expired deadline into an error of kind ErrLimitExceeded.
+func (fsys *FS) withDeadline(ctx context.Context) (context.Context, func(error) error) {
+	if fsys.maxDuration <= 0 {
+		return ctx, func(err error) error { return err }
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, fsys.maxDuration)
+	return ctx, func(err error) error {
+		cancel()
+		if err != nil && errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+			return &ContainerError{Kind: ErrLimitExceeded, Err: fmt.Errorf("opening took longer than %s: %w", fsys.maxDuration, err)}
+		}
+		return err
+	}
+}
+
+// layerLimits restricts the bytes that are read from the files of a layer
+// and the number of entries of its directories. The counters are guarded by
+// the lock of the layer.
+type layerLimits struct {
+	format  *filetype.Filetype
+	bytes   int64
+	entries int
+
+	// read is the furthest offset that was read from each file, so bytes
+	// that are read again are not counted
+	read  map[string]int64
+	total int64
+}
+
+// layerLimits returns the limits of a container of the given size, nil is
+// returned if no limits are configured.
+func (fsys *FS) layerLimits(t *filetype.Filetype, size int64) *layerLimits {
+	limits := &layerLimits{format: t, bytes: fsys.maxBytes, entries: fsys.maxEntries, read: map[string]int64{}}
+	if fsys.maxRatio > 0 {
+		ratioBytes := int64(fsys.maxRatio * float64(size))
+		if limits.bytes == 0 || ratioBytes < limits.bytes {
+			limits.bytes = ratioBytes
+		}
+	}
+	if limits.bytes == 0 && limits.entries == 0 {
+		return nil
+	}
+	return limits
+}
+
+// count records that the file name was read up to the offset end.
+func (l *layerLimits) count(name string, end int64) error {
+	if l == nil || l.bytes == 0 || end <= l.read[name] {
+		return nil
+	}
+	l.total += end - l.read[name]
+	l.read[name] = end
+	if l.total > l.bytes {
+		return &ContainerError{Kind: ErrLimitExceeded, Format: l.format, Err: fmt.Errorf("read more than %d bytes", l.bytes)}
+	}
+	return nil
+}
+
+// checkEntries returns an error if a directory has more than the allowed
+// number of entries.
+func (l *layerLimits) checkEntries(n int) error {
+	if l == nil || l.entries == 0 || n <= l.entries {
+		return nil
+	}
+	return entriesError(l.format, l.entries)
+}
+
+// entriesError is the error for containers with more than max entries.
+func entriesError(t *filetype.Filetype, max int) error {
+	return &ContainerError{Kind: ErrLimitExceeded, Format: t, Err: fmt.Errorf("more than %d entries", max)}
+}
+
+// recoverPanic converts a panic of a parser into an error of kind
+// ErrCorruptContainer. It must be deferred.
+func recoverPanic(t *filetype.Filetype, err *error) {
+	if r := recover(); r != nil {
+		*err = &ContainerError{Kind: ErrCorruptContainer, Format: t, Err: fmt.Errorf("parser failed: %v", r)}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testZipFiles(t *testing.T, files map[string][]byte) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range names {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLimits(t *testing.T) {
+	many := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		many[fmt.Sprintf("file%d.txt", i)] = []byte("content")
+	}
+	root := fstest.MapFS{
+		"archive.tar": &fstest.MapFile{Data: testTar(t)},
+		"bomb.zip":    &fstest.MapFile{Data: testZipFiles(t, map[string][]byte{"zeros": make([]byte, 1<<20)})},
+		"many.zip":    &fstest.MapFile{Data: testZipFiles(t, many)},
+		"many.tar":    &fstest.MapFile{Data: testTarFiles(t, many)},
+		"fat.dd":      &fstest.MapFile{Data: gunzip(t, "fat/testdata/test.fat12.dd.gz")},
+		"sixty.zip":   &fstest.MapFile{Data: testZipFiles(t, map[string][]byte{"a": make([]byte, 60), "b": make([]byte, 60)})},
+	}
+
+	readFile := func(name string) func(fsys *FS) error {
+		return func(fsys *FS) error {
+			_, err := fs.ReadFile(fsys, name)
+			return err
+		}
+	}
+	readDir := func(name string) func(fsys *FS) error {
+		return func(fsys *FS) error {
+			_, err := fsys.ReadDir(name)
+			return err
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options []Option
+		op      func(fsys *FS) error
+	}{
+		{"depth", []Option{WithMaxDepth(1)}, readFile("archive.tar/nested.zip/doc.txt")},
+		{"depth of last element", []Option{WithMaxDepth(1)}, readDir("archive.tar/nested.zip")},
+		{"bytes", []Option{WithMaxBytes(1000)}, readFile("bomb.zip/zeros")},
+		{"ratio", []Option{WithMaxRatio(10)}, readFile("bomb.zip/zeros")},
+		{"bytes of all files", []Option{WithMaxBytes(100)}, func(fsys *FS) error {
+			if _, err := fs.ReadFile(fsys, "sixty.zip/a"); err != nil {
+				return err
+			}
+			_, err := fs.ReadFile(fsys, "sixty.zip/b")
+			return err
+		}},
+		{"zip entries", []Option{WithMaxEntries(3)}, readFile("many.zip/file0.txt")},
+		{"tar entries", []Option{WithMaxEntries(3)}, readDir("many.tar")},
+		{"directory entries", []Option{WithMaxEntries(1)}, readDir("fat.dd")},
+		{"duration", []Option{WithMaxDuration(time.Nanosecond)}, readFile("archive.tar/tar.txt")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unlimited := NewFS(root)
+			defer unlimited.Close()
+			if err := tt.op(unlimited); err != nil {
+				t.Fatalf("without limits: %v", err)
+			}
+
+			fsys := NewFS(root, tt.options...)
+			defer fsys.Close()
+			err := tt.op(fsys)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("error = %v, want %v", err, ErrLimitExceeded)
+			}
+			var ce *ContainerError
+			if !errors.As(err, &ce) {
+				t.Errorf("error = %#v, want ContainerError", err)
+			}
+		})
+	}
+
+	t.Run("bytes read again", func(t *testing.T) {
+		fsys := NewFS(root, WithMaxBytes(100))
+		defer fsys.Close()
+		for i := 0; i < 2; i++ {
+			if _, err := fs.ReadFile(fsys, "sixty.zip/a"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := fsys.Open("sixty.zip/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for i := 0; i < 2; i++ {
+			if _, err := f.(io.ReaderAt).ReadAt(make([]byte, 60), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("listed as plain files", func(t *testing.T) {
+		fsys := NewFS(root, WithMaxDepth(1))
+		defer fsys.Close()
+		info, err := fs.Stat(fsys, "archive.tar")
+		if err != nil || !info.IsDir() {
+			t.Fatalf("Stat() = %v, %v", info, err)
+		}
+		entries, err := fsys.ReadDir("archive.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				t.Errorf("%s is a directory", entry.Name())
+			}
+		}
+	})
+
+	t.Run("duration wraps the deadline", func(t *testing.T) {
+		fsys := NewFS(root, WithMaxDuration(time.Nanosecond))
+		defer fsys.Close()
+		_, err := fsys.Open("archive.tar/tar.txt")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestCheckSelfReference(t *testing.T) {
+	data := testZip(t)
+	fp, err := newFingerprint(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newFingerprint(bytes.NewReader(testTar(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer := newNode(nil, nil, nil, nil)
+	outer.fingerprint = fp
+	inner := newNode(nil, nil, nil, outer)
+	inner.fingerprint = other
+
+	if err := checkSelfReference(nil, other, nil); err != nil {
+		t.Errorf("checkSelfReference() without ancestors = %v", err)
+	}
+	if err := checkSelfReference(nil, fp, inner); !errors.Is(err, ErrSelfReference) || !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("checkSelfReference() = %v, want %v", err, ErrSelfReference)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+
+	"github.com/forensicanalysis/filetype"
+)
+
+// lockedFS serializes the access to a child file system and its files. The
+// parsers share a single reader of the container file and many keep state
+// like caches, so they are not safe for concurrent use. As parsers only read
+// from their parent layer, locks are always taken from the inner to the outer
+// layer.
+type lockedFS struct {
+	mu     *sync.Mutex
+	fsys   fs.FS
+	format *filetype.Filetype
+	limits *layerLimits
+}
+
+func newLockedFS(fsys fs.FS, format *filetype.Filetype, limits *layerLimits) *lockedFS {
+	return &lockedFS{mu: &sync.Mutex{}, fsys: fsys, format: format, limits: limits}
+}
+
+// Open opens a file whose methods hold the lock of the file system.
+func (l *lockedFS) Open(name string) (_ fs.File, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer recoverPanic(l.format, &err)
+	f, err := l.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedFile{mu: l.mu, file: f, name: name, format: l.format, limits: l.limits}, nil
+}
+
+// Stat returns the fs.FileInfo of the file.
+func (l *lockedFS) Stat(name string) (_ fs.FileInfo, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer recoverPanic(l.format, &err)
+	return fs.Stat(l.fsys, name)
+}
+
+// lockedFile is a file of a lockedFS. Panics of the parser are returned as
+// errors.
+type lockedFile struct {
+	mu     *sync.Mutex
+	file   fs.File
+	name   string
+	format *filetype.Filetype
+	limits *layerLimits
+	offset int64
+	listed int
+}
+
+func (f *lockedFile) Stat() (_ fs.FileInfo, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer recoverPanic(f.format, &err)
+	return f.file.Stat()
+}
+
+func (f *lockedFile) Read(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer recoverPanic(f.format, &err)
+	n, err = f.file.Read(p)
+	f.offset += int64(n)
+	if lerr := f.limits.count(f.name, f.offset); lerr != nil {
+		return n, lerr
+	}
+	return n, err
+}
+
+func (f *lockedFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer recoverPanic(f.format, &err)
+	n, err = f.file.(io.ReaderAt).ReadAt(p, off)
+	if lerr := f.limits.count(f.name, off+int64(n)); lerr != nil {
+		return n, lerr
+	}
+	return n, err
+}
+
+func (f *lockedFile) Seek(offset int64, whence int) (pos int64, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer recoverPanic(f.format, &err)
+	pos, err = f.file.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		f.offset = pos
+	}
+	return pos, err
+}
+
+func (f *lockedFile) ReadDir(n int) (_ []fs.DirEntry, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer recoverPanic(f.format, &err)
+	dir, ok := f.file.(fs.ReadDirFile)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	entries, err := dir.ReadDir(n)
+	f.listed += len(entries)
+	if lerr := f.limits.checkEntries(f.listed); lerr != nil {
+		return nil, lerr
+	}
+	// some file systems return their cached slice, which must not be changed
+	locked := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		locked = append(locked, &lockedEntry{DirEntry: entry, mu: f.mu, format: f.format})
+	}
+	return locked, err
+}
+
+func (f *lockedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// lockedEntry holds the lock while the fs.FileInfo is created, as some file
+// systems read it lazily.
+type lockedEntry struct {
+	fs.DirEntry
+	mu     *sync.Mutex
+	format *filetype.Filetype
+}
+
+func (e *lockedEntry) Info() (_ fs.FileInfo, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	defer recoverPanic(e.format, &err)
+	return e.DirEntry.Info()
+}
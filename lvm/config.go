@@ -0,0 +1,212 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package lvm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// section is a section of the LVM2 text metadata format. Values are int64,
+// string or []interface{}.
+type section struct {
+	values   map[string]interface{}
+	sections map[string]*section
+}
+
+func newSection() *section {
+	return &section{values: map[string]interface{}{}, sections: map[string]*section{}}
+}
+
+func (s *section) int(key string) (int64, error) {
+	v, ok := s.values[key].(int64)
+	if !ok {
+		return 0, fmt.Errorf("lvm: metadata value %s missing", key)
+	}
+	return v, nil
+}
+
+func (s *section) string(key string) string {
+	v, _ := s.values[key].(string)
+	return v
+}
+
+type parser struct {
+	data []byte
+	pos  int
+}
+
+// parseConfig parses the LVM2 text metadata format.
+func parseConfig(data []byte) (*section, error) {
+	p := &parser{data: data}
+	s, err := p.section()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.next(); tok != "" {
+		return nil, fmt.Errorf("lvm: unexpected %q in metadata", tok)
+	}
+	return s, nil
+}
+
+func (p *parser) section() (*section, error) {
+	s := newSection()
+	for {
+		name := p.next()
+		switch name {
+		case "", "}":
+			p.pos -= len(name)
+			return s, nil
+		case "{", "[", "]", "=", ",":
+			return nil, fmt.Errorf("lvm: unexpected %q in metadata", name)
+		}
+
+		switch tok := p.next(); tok {
+		case "=":
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			s.values[unquote(name)] = v
+		case "{":
+			sub, err := p.section()
+			if err != nil {
+				return nil, err
+			}
+			if p.next() != "}" {
+				return nil, errors.New("lvm: unterminated section in metadata")
+			}
+			s.sections[unquote(name)] = sub
+		default:
+			return nil, fmt.Errorf("lvm: unexpected %q in metadata", tok)
+		}
+	}
+}
+
+func (p *parser) value() (interface{}, error) {
+	tok := p.next()
+	switch {
+	case tok == "[":
+		var l []interface{}
+		for {
+			switch tok := p.peek(); tok {
+			case "]":
+				p.next()
+				return l, nil
+			case ",":
+				p.next()
+			case "":
+				return nil, errors.New("lvm: unterminated array in metadata")
+			default:
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, v)
+			}
+		}
+	case tok == "" || tok == "{" || tok == "}" || tok == "]" || tok == "=" || tok == ",":
+		return nil, fmt.Errorf("lvm: unexpected %q in metadata", tok)
+	case tok[0] == '"':
+		return unquote(tok), nil
+	default:
+		if i, err := strconv.ParseInt(tok, 10, 64); err == nil {
+			return i, nil
+		}
+		return tok, nil
+	}
+}
+
+func (p *parser) peek() string {
+	pos := p.pos
+	tok := p.next()
+	p.pos = pos
+	return tok
+}
+
+// next returns the next token, quoted strings keep their quotes.
+func (p *parser) next() string {
+	p.skip()
+	if p.pos >= len(p.data) {
+		return ""
+	}
+	start := p.pos
+	switch c := p.data[p.pos]; {
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.data) && p.data[p.pos] != '"' {
+			if p.data[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		p.pos++
+		if p.pos > len(p.data) {
+			p.pos = len(p.data)
+		}
+	case isDelimiter(c):
+		p.pos++
+	default:
+		for p.pos < len(p.data) && !isDelimiter(p.data[p.pos]) && !unicode.IsSpace(rune(p.data[p.pos])) && p.data[p.pos] != '#' {
+			p.pos++
+		}
+	}
+	return string(p.data[start:p.pos])
+}
+
+// skip skips whitespace and comments.
+func (p *parser) skip() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case unicode.IsSpace(rune(c)) || c == 0:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isDelimiter(c byte) bool {
+	return c == '{' || c == '}' || c == '[' || c == ']' || c == '=' || c == ','
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
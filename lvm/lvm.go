@@ -0,0 +1,347 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+// Package lvm provides an io/fs implementation for the logical volumes of
+// LVM2 volume groups.
+//
+// Each logical volume is exposed as a file named like the device mapper names
+// them (e.g. vg0-root). Linear and striped segments are supported, logical
+// volumes with other segment types or segments on physical volumes that were
+// not passed to New are omitted.
+package lvm
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+)
+
+// FS implements a read-only file system for LVM2 logical volumes.
+type FS struct {
+	volumes map[string]*volume
+}
+
+// New creates a new lvm FS from the physical volumes of one or more volume
+// groups.
+func New(pvs ...io.ReaderAt) (*FS, error) {
+	byUUID := map[string]*physicalVolume{}
+	groups := map[string]*physicalVolume{}
+	for _, r := range pvs {
+		pv, err := readPhysicalVolume(r)
+		if err != nil {
+			return nil, err
+		}
+		byUUID[pv.uuid] = pv
+		if current, ok := groups[pv.vgName]; !ok || seqno(pv) > seqno(current) {
+			groups[pv.vgName] = pv
+		}
+	}
+
+	fsys := &FS{volumes: map[string]*volume{}}
+	for vgName, pv := range groups {
+		volumes, err := logicalVolumes(vgName, pv.vgSection, byUUID)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range volumes {
+			fsys.volumes[v.name()] = v
+		}
+	}
+	return fsys, nil
+}
+
+func seqno(pv *physicalVolume) int64 {
+	i, _ := pv.vgSection.int("seqno")
+	return i
+}
+
+// Open opens a logical volume for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &Root{fsys: fsys}, nil
+	}
+	v, ok := fsys.volumes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return newLogicalVolume(v), nil
+}
+
+func (fsys *FS) entries() []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, v := range fsys.volumes {
+		entries = append(entries, newLogicalVolume(v))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// Root is the root directory that contains the logical volumes.
+type Root struct {
+	fsys      *FS
+	dirOffset int
+}
+
+func (r *Root) Read([]byte) (int, error) { return 0, syscall.EPERM }
+
+func (r *Root) Name() string { return "." }
+
+// ReadDir returns up to n logical volumes.
+func (r *Root) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := r.fsys.entries()
+	return direntries.Read(n, entries, &r.dirOffset)
+}
+
+func (r *Root) Size() int64 { return 0 }
+
+func (r *Root) Mode() fs.FileMode { return fs.ModeDir }
+
+func (r *Root) ModTime() time.Time { return time.Time{} }
+
+func (r *Root) IsDir() bool { return true }
+
+func (r *Root) Sys() interface{} { return nil }
+
+func (r *Root) Close() error { return nil }
+
+func (r *Root) Stat() (fs.FileInfo, error) { return r, nil }
+
+// LogicalVolume is a logical volume of a volume group.
+type LogicalVolume struct {
+	*io.SectionReader
+	volume *volume
+}
+
+func newLogicalVolume(v *volume) *LogicalVolume {
+	return &LogicalVolume{SectionReader: io.NewSectionReader(v, 0, v.size), volume: v}
+}
+
+func (lv *LogicalVolume) Name() string { return lv.volume.name() }
+
+// VolumeGroup returns the name of the volume group.
+func (lv *LogicalVolume) VolumeGroup() string { return lv.volume.vg }
+
+// ID returns the UUID of the logical volume.
+func (lv *LogicalVolume) ID() string { return lv.volume.id }
+
+func (lv *LogicalVolume) Close() error { return nil }
+
+func (lv *LogicalVolume) Stat() (fs.FileInfo, error) { return lv, nil }
+
+func (lv *LogicalVolume) IsDir() bool { return false }
+
+func (lv *LogicalVolume) Mode() fs.FileMode { return 0 }
+
+func (lv *LogicalVolume) ModTime() time.Time { return time.Time{} }
+
+func (lv *LogicalVolume) Sys() interface{} { return lv }
+
+func (lv *LogicalVolume) Type() fs.FileMode { return lv.Mode() }
+
+func (lv *LogicalVolume) Info() (fs.FileInfo, error) { return lv, nil }
+
+type stripe struct {
+	r      io.ReaderAt
+	offset int64
+}
+
+type segment struct {
+	start, size int64
+	stripeSize  int64
+	stripes     []stripe
+}
+
+// locate returns the physical location of an offset inside the segment and
+// the number of bytes that are contiguous there.
+func (s *segment) locate(off int64) (io.ReaderAt, int64, int64) {
+	if len(s.stripes) == 1 {
+		return s.stripes[0].r, s.stripes[0].offset + off, s.size - off
+	}
+	chunk, within := off/s.stripeSize, off%s.stripeSize
+	st := s.stripes[chunk%int64(len(s.stripes))]
+	row := chunk / int64(len(s.stripes))
+	return st.r, st.offset + row*s.stripeSize + within, s.stripeSize - within
+}
+
+// volume maps the logical volume to the physical volumes.
+type volume struct {
+	vg, lv, id string
+	size       int64
+	segments   []segment
+}
+
+// name returns the device mapper name of the logical volume.
+func (v *volume) name() string {
+	return strings.ReplaceAll(v.vg, "-", "--") + "-" + strings.ReplaceAll(v.lv, "-", "--")
+}
+
+func (v *volume) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		seg := v.segment(pos)
+		if seg == nil {
+			return n, io.EOF
+		}
+		r, physical, contiguous := seg.locate(pos - seg.start)
+		chunk := p[n:]
+		if int64(len(chunk)) > contiguous {
+			chunk = chunk[:contiguous]
+		}
+		m, err := r.ReadAt(chunk, physical)
+		n += m
+		if err != nil && !(err == io.EOF && m == len(chunk)) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (v *volume) segment(off int64) *segment {
+	for i := range v.segments {
+		if off >= v.segments[i].start && off < v.segments[i].start+v.segments[i].size {
+			return &v.segments[i]
+		}
+	}
+	return nil
+}
+
+func logicalVolumes(vgName string, vg *section, pvs map[string]*physicalVolume) ([]*volume, error) {
+	extentSize, err := vg.int("extent_size")
+	if err != nil {
+		return nil, err
+	}
+	extentSize *= sectorSize
+
+	// physical volume names of the metadata mapped to the readers
+	areas := map[string]stripe{}
+	if s, ok := vg.sections["physical_volumes"]; ok {
+		for name, pvSection := range s.sections {
+			pv, ok := pvs[pvSection.string("id")]
+			if !ok {
+				continue
+			}
+			peStart, err := pvSection.int("pe_start")
+			if err != nil {
+				return nil, err
+			}
+			areas[name] = stripe{r: pv.r, offset: peStart * sectorSize}
+		}
+	}
+
+	var volumes []*volume
+	if s, ok := vg.sections["logical_volumes"]; ok {
+		for lvName, lvSection := range s.sections {
+			v, err := logicalVolume(lvSection, extentSize, areas)
+			if err != nil {
+				return nil, fmt.Errorf("lvm: logical volume %s: %w", lvName, err)
+			}
+			if v == nil {
+				continue
+			}
+			v.vg, v.lv, v.id = vgName, lvName, lvSection.string("id")
+			volumes = append(volumes, v)
+		}
+	}
+	return volumes, nil
+}
+
+// logicalVolume returns the mapping of a logical volume or nil if it cannot be
+// read.
+func logicalVolume(lv *section, extentSize int64, areas map[string]stripe) (*volume, error) {
+	count, err := lv.int("segment_count")
+	if err != nil {
+		return nil, err
+	}
+
+	v := &volume{}
+	for i := int64(1); i <= count; i++ {
+		s, ok := lv.sections[fmt.Sprintf("segment%d", i)]
+		if !ok {
+			return nil, fmt.Errorf("segment%d missing", i)
+		}
+		if s.string("type") != segmentStriped {
+			return nil, nil
+		}
+		seg, err := stripedSegment(s, extentSize, areas)
+		if err != nil || seg == nil {
+			return nil, err
+		}
+		v.segments = append(v.segments, *seg)
+		if end := seg.start + seg.size; end > v.size {
+			v.size = end
+		}
+	}
+	return v, nil
+}
+
+func stripedSegment(s *section, extentSize int64, areas map[string]stripe) (*segment, error) {
+	start, err := s.int("start_extent")
+	if err != nil {
+		return nil, err
+	}
+	count, err := s.int("extent_count")
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{start: start * extentSize, size: count * extentSize}
+
+	stripes, _ := s.values["stripes"].([]interface{})
+	if len(stripes) == 0 || len(stripes)%2 != 0 {
+		return nil, fmt.Errorf("invalid stripes")
+	}
+	for i := 0; i < len(stripes); i += 2 {
+		name, _ := stripes[i].(string)
+		pe, ok := stripes[i+1].(int64)
+		area, found := areas[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid stripe %s", name)
+		}
+		if !found {
+			// physical volume is not available
+			return nil, nil
+		}
+		seg.stripes = append(seg.stripes, stripe{r: area.r, offset: area.offset + pe*extentSize})
+	}
+
+	if len(seg.stripes) > 1 {
+		seg.stripeSize, err = s.int("stripe_size")
+		if err != nil {
+			return nil, err
+		}
+		seg.stripeSize *= sectorSize
+		if seg.stripeSize <= 0 {
+			return nil, fmt.Errorf("invalid stripe size")
+		}
+	}
+	return seg, nil
+}
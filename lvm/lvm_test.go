@@ -0,0 +1,272 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package lvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+const (
+	testMDAOffset  = 4096
+	testMDASize    = 0x10000
+	testPEStart    = 0x20000
+	testExtentSize = 4096
+	testPVSize     = testPEStart + 16*testExtentSize
+)
+
+const testMetadata = `vg0 {
+id = "Mi3tMu-0bYh-LTgR-9TD8-DZ3R-aNYp-q6Ae1J"
+seqno = 4
+format = "lvm2" # informational
+status = ["RESIZEABLE", "READ", "WRITE"]
+extent_size = 8
+
+physical_volumes {
+
+pv0 {
+id = "aaaaaa-aaaa-aaaa-aaaa-aaaa-aaaa-aaaaaa"
+device = "/dev/sda1"
+status = ["ALLOCATABLE"]
+pe_start = 256
+pe_count = 16
+}
+
+pv1 {
+id = "bbbbbb-bbbb-bbbb-bbbb-bbbb-bbbb-bbbbbb"
+device = "/dev/sdb1"
+pe_start = 256
+pe_count = 16
+}
+}
+
+logical_volumes {
+
+root {
+id = "rrrrrr-rrrr-rrrr-rrrr-rrrr-rrrr-rrrrrr"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+
+segment1 {
+start_extent = 0
+extent_count = 2
+type = "striped"
+stripe_count = 1 # linear
+stripes = [
+"pv0", 0
+]
+}
+}
+
+my-data {
+id = "dddddd-dddd-dddd-dddd-dddd-dddd-dddddd"
+segment_count = 2
+
+segment1 {
+start_extent = 0
+extent_count = 1
+type = "striped"
+stripe_count = 1
+stripes = [
+"pv0", 4
+]
+}
+segment2 {
+start_extent = 1
+extent_count = 2
+type = "striped"
+stripe_count = 2
+stripe_size = 2
+stripes = [
+"pv0", 6,
+"pv0", 8
+]
+}
+}
+
+pool {
+id = "pppppp-pppp-pppp-pppp-pppp-pppp-pppppp"
+segment_count = 1
+
+segment1 {
+start_extent = 0
+extent_count = 1
+type = "thin-pool"
+}
+}
+
+multi {
+id = "mmmmmm-mmmm-mmmm-mmmm-mmmm-mmmm-mmmmmm"
+segment_count = 1
+
+segment1 {
+start_extent = 0
+extent_count = 1
+type = "striped"
+stripe_count = 1
+stripes = [
+"pv1", 2
+]
+}
+}
+}
+}
+# Generated by LVM2
+contents = "Text Format Volume Group"
+version = 1
+description = "Created *after* executing 'lvcreate'"
+`
+
+func testPV(uuid string) []byte {
+	pv := make([]byte, testPVSize)
+	for i := testPEStart; i < testPVSize; i += 4 {
+		binary.LittleEndian.PutUint32(pv[i:], uint32(i)|uint32(uuid[0])<<24)
+	}
+
+	label := pv[512:]
+	copy(label, labelID)
+	binary.LittleEndian.PutUint64(label[8:], 1)
+	binary.LittleEndian.PutUint32(label[20:], 32)
+	copy(label[24:], labelType)
+
+	header := label[32:]
+	copy(header, bytes.ReplaceAll([]byte(uuid), []byte("-"), nil))
+	binary.LittleEndian.PutUint64(header[32:], testPVSize)
+	binary.LittleEndian.PutUint64(header[40:], testPEStart)
+	binary.LittleEndian.PutUint64(header[72:], testMDAOffset)
+	binary.LittleEndian.PutUint64(header[80:], testMDASize)
+
+	mda := pv[testMDAOffset:]
+	copy(mda[4:], mdaMagic)
+	binary.LittleEndian.PutUint32(mda[20:], 1)
+	binary.LittleEndian.PutUint64(mda[24:], testMDAOffset)
+	binary.LittleEndian.PutUint64(mda[32:], testMDASize)
+	binary.LittleEndian.PutUint64(mda[40:], mdaHeaderSize)
+	binary.LittleEndian.PutUint64(mda[48:], uint64(len(testMetadata)))
+	copy(mda[mdaHeaderSize:], testMetadata)
+	return pv
+}
+
+// corruptPV returns a physical volume modified by corrupt.
+func corruptPV(corrupt func(pv []byte)) []byte {
+	pv := testPV("cccccc-cccc-cccc-cccc-cccc-cccc-cccccc")
+	corrupt(pv)
+	return pv
+}
+
+func TestFS(t *testing.T) {
+	pv0 := testPV("aaaaaa-aaaa-aaaa-aaaa-aaaa-aaaa-aaaaaa")
+	pv1 := testPV("bbbbbb-bbbb-bbbb-bbbb-bbbb-bbbb-bbbbbb")
+
+	extent := func(pv []byte, pe int) []byte {
+		return pv[testPEStart+pe*testExtentSize : testPEStart+(pe+1)*testExtentSize]
+	}
+	var striped []byte
+	for row := 0; row < 4; row++ {
+		for _, pe := range []int{6, 8} {
+			striped = append(striped, extent(pv0, pe)[row*1024:(row+1)*1024]...)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pvs     []io.ReaderAt
+		want    map[string][]byte
+		wantErr bool
+	}{
+		{"single pv", []io.ReaderAt{bytes.NewReader(pv0)}, map[string][]byte{
+			"vg0-root":     append(append([]byte{}, extent(pv0, 0)...), extent(pv0, 1)...),
+			"vg0-my--data": append(append([]byte{}, extent(pv0, 4)...), striped...),
+		}, false},
+		{"two pvs", []io.ReaderAt{bytes.NewReader(pv0), bytes.NewReader(pv1)}, map[string][]byte{
+			"vg0-root":     append(append([]byte{}, extent(pv0, 0)...), extent(pv0, 1)...),
+			"vg0-my--data": append(append([]byte{}, extent(pv0, 4)...), striped...),
+			"vg0-multi":    extent(pv1, 2),
+		}, false},
+		{"no label", []io.ReaderAt{bytes.NewReader(make([]byte, testPVSize))}, nil, true},
+		{"header offset", []io.ReaderAt{bytes.NewReader(corruptPV(func(pv []byte) {
+			binary.LittleEndian.PutUint32(pv[512+20:], 0xffffffff)
+		}))}, nil, true},
+		{"metadata size", []io.ReaderAt{bytes.NewReader(corruptPV(func(pv []byte) {
+			binary.LittleEndian.PutUint64(pv[512+32+80:], 1<<62)
+			binary.LittleEndian.PutUint64(pv[testMDAOffset+48:], 1<<40)
+		}))}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, err := New(tt.pvs...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			entries, err := fs.ReadDir(fsys, ".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names, wantNames []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			for name := range tt.want {
+				wantNames = append(wantNames, name)
+			}
+			if len(names) != len(wantNames) {
+				t.Errorf("ReadDir() = %v, want %v", names, wantNames)
+			}
+
+			for name, want := range tt.want {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("ReadFile(%s) differs", name)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := parseConfig([]byte(testMetadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vg := config.sections["vg0"]
+	if got := vg.values["status"]; !reflect.DeepEqual(got, []interface{}{"RESIZEABLE", "READ", "WRITE"}) {
+		t.Errorf("status = %v", got)
+	}
+	if got := config.string("description"); got != "Created *after* executing 'lvcreate'" {
+		t.Errorf("description = %v", got)
+	}
+	if _, err := parseConfig([]byte("vg0 { a = [1, 2 }")); err == nil {
+		t.Error("parseConfig() error = nil for invalid metadata")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package lvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	sectorSize     = 512
+	labelScan      = 4
+	mdaHeaderSize  = 512
+	labelID        = "LABELONE"
+	labelType      = "LVM2 001"
+	mdaMagic       = " LVM2 x[5A%r0N*>"
+	segmentStriped = "striped"
+
+	// maxMetadataSize limits the size of the metadata text, it is a few KiB
+	// for typical volume groups
+	maxMetadataSize = 16 << 20
+)
+
+// Match checks if the buffer contains a LVM2 physical volume label.
+func Match(buf []byte) bool {
+	return labelOffset(buf) >= 0
+}
+
+func labelOffset(buf []byte) int {
+	for i := 0; i < labelScan; i++ {
+		off := i * sectorSize
+		if len(buf) >= off+32 && string(buf[off:off+8]) == labelID && string(buf[off+24:off+32]) == labelType {
+			return off
+		}
+	}
+	return -1
+}
+
+type area struct {
+	offset, size int64
+}
+
+// physicalVolume is the parsed label of a LVM2 physical volume.
+type physicalVolume struct {
+	r         io.ReaderAt
+	uuid      string
+	metadata  []area
+	vgName    string
+	vgSection *section
+}
+
+func readPhysicalVolume(r io.ReaderAt) (*physicalVolume, error) {
+	buf := make([]byte, labelScan*sectorSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	off := labelOffset(buf)
+	if off < 0 {
+		return nil, errors.New("lvm: no physical volume label")
+	}
+	label := buf[off : off+sectorSize]
+	headerOffset := binary.LittleEndian.Uint32(label[20:])
+	if headerOffset < 32 || headerOffset > sectorSize-40 {
+		return nil, errors.New("lvm: invalid physical volume header")
+	}
+	header := label[headerOffset:]
+
+	pv := &physicalVolume{r: r, uuid: formatUUID(header[:32])}
+
+	// skip the data areas, the metadata areas follow the terminating entry
+	areas := header[40:]
+	for i := 0; i < 2; i++ {
+		for len(areas) >= 16 {
+			a := area{int64(binary.LittleEndian.Uint64(areas)), int64(binary.LittleEndian.Uint64(areas[8:]))}
+			areas = areas[16:]
+			if a.offset == 0 {
+				break
+			}
+			if i == 1 {
+				pv.metadata = append(pv.metadata, a)
+			}
+		}
+	}
+
+	if err := pv.readMetadata(); err != nil {
+		return nil, err
+	}
+	return pv, nil
+}
+
+// readMetadata reads the volume group metadata from the first valid metadata
+// area.
+func (pv *physicalVolume) readMetadata() (err error) {
+	if len(pv.metadata) == 0 {
+		return errors.New("lvm: physical volume has no metadata area")
+	}
+	for _, mda := range pv.metadata {
+		var text []byte
+		text, err = readMetadataArea(pv.r, mda)
+		if err != nil {
+			continue
+		}
+		var config *section
+		config, err = parseConfig(text)
+		if err != nil {
+			continue
+		}
+		for name, s := range config.sections {
+			pv.vgName, pv.vgSection = name, s
+			return nil
+		}
+		err = errors.New("lvm: no volume group in metadata")
+	}
+	return err
+}
+
+func readMetadataArea(r io.ReaderAt, mda area) ([]byte, error) {
+	header := make([]byte, mdaHeaderSize)
+	if _, err := r.ReadAt(header, mda.offset); err != nil {
+		return nil, err
+	}
+	if string(header[4:20]) != mdaMagic {
+		return nil, fmt.Errorf("lvm: invalid metadata area at %d", mda.offset)
+	}
+
+	// the first raw location points to the current metadata
+	locn := header[40:]
+	offset := int64(binary.LittleEndian.Uint64(locn))
+	size := int64(binary.LittleEndian.Uint64(locn[8:]))
+	if offset == 0 || size <= 0 || offset >= mda.size || size > mda.size {
+		return nil, fmt.Errorf("lvm: no metadata in area at %d", mda.offset)
+	}
+	if size > maxMetadataSize {
+		return nil, fmt.Errorf("lvm: metadata of %d bytes in area at %d is too large", size, mda.offset)
+	}
+
+	text := make([]byte, size)
+	first := size
+	if offset+size > mda.size {
+		// the metadata wraps around in the circular buffer
+		first = mda.size - offset
+	}
+	if _, err := r.ReadAt(text[:first], mda.offset+offset); err != nil {
+		return nil, err
+	}
+	if first < size {
+		if _, err := r.ReadAt(text[first:], mda.offset+mdaHeaderSize); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimRight(text, "\x00"), nil
+}
+
+func formatUUID(b []byte) string {
+	s := string(b)
+	if len(s) != 32 {
+		return s
+	}
+	return strings.Join([]string{s[0:6], s[6:10], s[10:14], s[14:18], s[18:22], s[22:26], s[26:32]}, "-")
+}
@@ -0,0 +1,384 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/forensicanalysis/fslib/fsio"
+)
+
+// RawName is the Info.Sys() of files that are listed under a different name
+// because their name is not a valid path element, e.g. "../x" or a name with
+// a NUL byte, or because it is not unique in its directory.
+type RawName struct {
+	// Name is the name as stored in the container, for zip and tar files the
+	// full path of the entry, e.g. "/x".
+	Name string
+	// Sys is the Sys() of the underlying file.
+	Sys interface{}
+}
+
+// validName reports if name can be used as path element unchanged.
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." || !utf8.ValidString(name) {
+		return false
+	}
+	return strings.IndexFunc(name, escapeRune) < 0
+}
+
+func escapeRune(r rune) bool {
+	return r < 0x20 || r == 0x7f || r == '/' || r == '\\'
+}
+
+// escapeName returns a valid path element for name. Separators, control
+// characters and invalid UTF-8 are percent-encoded, as are the dots of "."
+// and "..". Empty names are replaced by "_".
+func escapeName(name string) string {
+	switch {
+	case validName(name):
+		return name
+	case name == "":
+		return "_"
+	case name == "." || name == "..":
+		return strings.Repeat("%2E", len(name))
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if (r == utf8.RuneError && size == 1) || escapeRune(r) {
+			fmt.Fprintf(b, "%%%02X", name[i])
+			i++
+			continue
+		}
+		b.WriteString(name[i : i+size])
+		i += size
+	}
+	return b.String()
+}
+
+// renameEntries returns unique and valid names for the raw names of the
+// entries of a directory. Valid names keep their name on first use, all other
+// names are escaped and get a suffix like "~2" if they are already taken.
+func renameEntries(raw []string) []string {
+	names := make([]string, len(raw))
+	taken := map[string]bool{}
+	for i, name := range raw {
+		if validName(name) && !taken[name] {
+			names[i] = name
+			taken[name] = true
+		}
+	}
+	for i, name := range raw {
+		if names[i] != "" {
+			continue
+		}
+		name = escapeName(name)
+		unique := name
+		for n := 2; taken[unique]; n++ {
+			unique = fmt.Sprintf("%s~%d", name, n)
+		}
+		names[i] = unique
+		taken[unique] = true
+	}
+	return names
+}
+
+// renamedInfo is the fs.FileInfo of a renamed file.
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+	raw  string
+}
+
+func (i *renamedInfo) Name() string { return i.name }
+
+func (i *renamedInfo) Sys() interface{} {
+	return &RawName{Name: i.raw, Sys: i.FileInfo.Sys()}
+}
+
+// renamedEntry is the fs.DirEntry of a renamed file.
+type renamedEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e *renamedEntry) Name() string { return e.name }
+
+func (e *renamedEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return &renamedInfo{FileInfo: info, name: e.name, raw: e.DirEntry.Name()}, nil
+}
+
+// entryOpener is implemented by the directory entries of parsers that can
+// open the file of an entry without looking up its name.
+type entryOpener interface {
+	Open() (fs.File, error)
+}
+
+// namedFS normalises the names of a file system whose directories can
+// contain names that are invalid or not unique. Renamed files and the files
+// in renamed directories are opened through their directory entries, which
+// must implement entryOpener.
+type namedFS struct {
+	fsys fs.FS
+
+	mu sync.Mutex
+	// dirs maps the normalised names of the listed directories to their
+	// entries by normalised name. Only renamed entries are stored, unless the
+	// directory itself can only be reached through a renamed entry.
+	dirs map[string]map[string]fs.DirEntry
+}
+
+func newNamedFS(fsys fs.FS) *namedFS {
+	return &namedFS{fsys: fsys, dirs: map[string]map[string]fs.DirEntry{}}
+}
+
+// Open opens the file with the normalised name.
+func (n *namedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, raw, err := n.open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	base := path.Base(name)
+	if info.IsDir() {
+		return &namedDir{File: f, fsys: n, name: name, raw: raw}, nil
+	}
+	if raw == base {
+		return f, nil
+	}
+	renamed := &renamedFile{File: f, name: base, raw: raw}
+	if rsa, ok := f.(fsio.ReadSeekerAt); ok {
+		return &renamedReaderFile{renamedFile: renamed, rsa: rsa}, nil
+	}
+	return renamed, nil
+}
+
+// open opens the file with the normalised name in the underlying file system
+// and returns its raw name. The raw path is used up to the first renamed
+// element, further elements are opened through their directory entries. If
+// the file does not exist, the directories that were not listed yet are
+// listed, as the name may be renamed in them.
+func (n *namedFS) open(name string) (fs.File, string, error) {
+	if name == "." {
+		f, err := n.fsys.Open(name)
+		return f, name, err
+	}
+	f, raw, err := n.lookup(name, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return n.lookup(name, true)
+	}
+	return f, raw, err
+}
+
+// lookup opens the file with the normalised name using the renamed entries
+// stored for its directories. Directories without stored entries are only
+// listed if list is set or if they are reached through a renamed entry.
+func (n *namedFS) lookup(name string, list bool) (fs.File, string, error) {
+	elems := strings.Split(name, "/")
+	raw := "."
+	var entry fs.DirEntry
+	for i, elem := range elems {
+		entries, err := n.entries(path.Join(append([]string{"."}, elems[:i]...)...), list || entry != nil)
+		if err != nil {
+			return nil, "", err
+		}
+		e, ok := entries[elem]
+		switch {
+		case ok:
+			entry = e
+		case entry != nil:
+			return nil, "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		default:
+			raw = path.Join(raw, elem)
+		}
+	}
+	if entry == nil {
+		f, err := n.fsys.Open(raw)
+		return f, path.Base(raw), err
+	}
+	opener, ok := entry.(entryOpener)
+	if !ok {
+		// the raw name may be invalid or not unique
+		return nil, "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f, err := opener.Open()
+	return f, entry.Name(), err
+}
+
+// entries returns the stored entries of a directory. The directory is listed
+// if it has not been listed before and list is set, otherwise nil is
+// returned.
+func (n *namedFS) entries(dir string, list bool) (map[string]fs.DirEntry, error) {
+	n.mu.Lock()
+	entries, ok := n.dirs[dir]
+	n.mu.Unlock()
+	if ok || !list {
+		return entries, nil
+	}
+	f, _, err := n.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rdf, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	all, err := rdf.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	n.rename(dir, all)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dirs[dir], nil
+}
+
+// rename returns the entries with normalised names and stores the renamed
+// entries of the directory. All entries are stored if the directory is
+// reached through a renamed entry itself, as the raw path does not lead to
+// it.
+func (n *namedFS) rename(dir string, entries []fs.DirEntry) []fs.DirEntry {
+	raw := make([]string, len(entries))
+	for i, entry := range entries {
+		raw[i] = entry.Name()
+	}
+	n.mu.Lock()
+	_, all := n.dirs[path.Dir(dir)][path.Base(dir)]
+	n.mu.Unlock()
+	all = all && dir != "."
+	stored := map[string]fs.DirEntry{}
+	named := make([]fs.DirEntry, len(entries))
+	for i, name := range renameEntries(raw) {
+		named[i] = entries[i]
+		if name != raw[i] {
+			named[i] = &renamedEntry{DirEntry: entries[i], name: name}
+		}
+		if all || name != raw[i] {
+			stored[name] = entries[i]
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dirs[dir] = stored
+	return named
+}
+
+// Stat returns the fs.FileInfo of the file with the normalised name.
+func (n *namedFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := n.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// renamedFile is a file that is listed under a different name.
+type renamedFile struct {
+	fs.File
+	name string
+	raw  string
+}
+
+func (f *renamedFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &renamedInfo{FileInfo: info, name: f.name, raw: f.raw}, nil
+}
+
+// renamedReaderFile is a renamed file that supports random access.
+type renamedReaderFile struct {
+	*renamedFile
+	rsa fsio.ReadSeekerAt
+}
+
+func (f *renamedReaderFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.rsa.ReadAt(p, off)
+}
+
+func (f *renamedReaderFile) Seek(offset int64, whence int) (int64, error) {
+	return f.rsa.Seek(offset, whence)
+}
+
+// namedDir is a directory whose entries are listed with normalised names.
+type namedDir struct {
+	fs.File
+	fsys *namedFS
+	// name is the normalised path, raw the raw name of the directory
+	name string
+	raw  string
+
+	entries   []fs.DirEntry
+	dirRead   bool
+	dirOffset int
+}
+
+func (d *namedDir) Stat() (fs.FileInfo, error) {
+	info, err := d.File.Stat()
+	if err != nil || d.name == "." || path.Base(d.name) == d.raw {
+		return info, err
+	}
+	return &renamedInfo{FileInfo: info, name: path.Base(d.name), raw: d.raw}, nil
+}
+
+// ReadDir returns up to n entries, all entries are read at once as the
+// names must be unique in the whole directory.
+func (d *namedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.dirRead {
+		dir, ok := d.File.(fs.ReadDirFile)
+		if !ok {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: syscall.ENOTDIR}
+		}
+		entries, err := dir.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = d.fsys.rename(d.name, entries)
+		d.dirRead = true
+	}
+	entries, offset, err := dirEntries(n, d.entries, d.dirOffset)
+	d.dirOffset += offset
+	return entries, err
+}
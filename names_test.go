@@ -0,0 +1,351 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+)
+
+func TestEscapeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"doc.txt", "doc.txt"},
+		{"", "_"},
+		{".", "%2E"},
+		{"..", "%2E%2E"},
+		{"a/b.txt", "a%2Fb.txt"},
+		{"a\\b.txt", "a%5Cb.txt"},
+		{"nul\x00.txt", "nul%00.txt"},
+		{"bad\xff.txt", "bad%FF.txt"},
+		{"grüße.txt", "grüße.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := escapeName(tt.name); got != tt.want {
+				t.Errorf("escapeName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenameEntries(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []string
+		want []string
+	}{
+		{"valid", []string{"a", "b"}, []string{"a", "b"}},
+		{"duplicates", []string{"a", "a", "a"}, []string{"a", "a~2", "a~3"}},
+		{"escaped", []string{"..", ".", ""}, []string{"%2E%2E", "%2E", "_"}},
+		// valid names keep their name even if an escaped name comes first
+		{"collision", []string{"a\x00", "a%00"}, []string{"a%00~2", "a%00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renameEntries(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("renameEntries(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+type testEntry struct {
+	name string
+	data string
+}
+
+// testTarEntries writes a tar file with the entries in order, names are not
+// cleaned and can repeat.
+func testTarEntries(t *testing.T, entries []testEntry) []byte {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		if err := w.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHostileNames(t *testing.T) {
+	root := fstest.MapFS{
+		"hostile.tar": &fstest.MapFile{Data: testTarEntries(t, []testEntry{
+			{"../evil.txt", "evil"},
+			{"/abs.txt", "abs"},
+			{"a\\b.txt", "backslash"},
+			{"ctrl\x01.txt", "ctrl"},
+			{"dup.txt", "first"},
+			{"dup.txt", "second"},
+		})},
+		"hostile.zip": &fstest.MapFile{Data: testZipFiles(t, map[string][]byte{
+			"../evil.txt": []byte("evil"),
+			"./doc.txt":   []byte("doc"),
+		})},
+	}
+	fsys := NewFS(root)
+
+	tests := []struct {
+		name    string
+		rawName string
+		want    string
+	}{
+		{"hostile.tar/%2E%2E/evil.txt", "../evil.txt", "evil"},
+		{"hostile.tar/abs.txt", "/abs.txt", "abs"},
+		{"hostile.tar/a%5Cb.txt", "a\\b.txt", "backslash"},
+		{"hostile.tar/ctrl%01.txt", "ctrl\x01.txt", "ctrl"},
+		{"hostile.tar/dup.txt", "", "first"},
+		{"hostile.tar/dup.txt~2", "dup.txt", "second"},
+		{"hostile.zip/%2E%2E/evil.txt", "../evil.txt", "evil"},
+		{"hostile.zip/doc.txt", "./doc.txt", "doc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := fs.ReadFile(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("ReadFile() = %q, want %q", data, tt.want)
+			}
+
+			info, err := fs.Stat(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, ok := info.Sys().(*RawName)
+			if ok != (tt.rawName != "") {
+				t.Fatalf("Sys() = %#v, want raw name %q", info.Sys(), tt.rawName)
+			}
+			if ok && raw.Name != tt.rawName {
+				t.Errorf("Sys().Name = %q, want %q", raw.Name, tt.rawName)
+			}
+		})
+	}
+
+	entries, err := fs.ReadDir(fsys, "hostile.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{"%2E%2E", "a%5Cb.txt", "abs.txt", "ctrl%01.txt", "dup.txt", "dup.txt~2"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir() = %q, want %q", names, want)
+	}
+
+	if err := fstest.TestFS(fsys, "hostile.tar/dup.txt~2", "hostile.zip/%2E%2E/evil.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testNode is a file or directory of a testNodeFS.
+type testNode struct {
+	name     string
+	data     string
+	children []*testNode
+}
+
+// testNodeFS is a file system like the disk image parsers, names can be
+// invalid or repeat and are looked up in directory order. Its directory
+// entries implement entryOpener.
+type testNodeFS struct {
+	root *testNode
+}
+
+func (t *testNodeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n := t.root
+	if name != "." {
+		for _, elem := range strings.Split(name, "/") {
+			var found *testNode
+			for _, child := range n.children {
+				if child.name == elem {
+					found = child
+					break
+				}
+			}
+			if found == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			n = found
+		}
+	}
+	return n.Open()
+}
+
+func (n *testNode) Open() (fs.File, error) {
+	return &testNodeFile{node: n, Reader: strings.NewReader(n.data)}, nil
+}
+
+func (n *testNode) Name() string               { return n.name }
+func (n *testNode) Size() int64                { return int64(len(n.data)) }
+func (n *testNode) ModTime() time.Time         { return time.Time{} }
+func (n *testNode) IsDir() bool                { return n.children != nil }
+func (n *testNode) Sys() interface{}           { return nil }
+func (n *testNode) Type() fs.FileMode          { return n.Mode().Type() }
+func (n *testNode) Info() (fs.FileInfo, error) { return n, nil }
+
+func (n *testNode) Mode() fs.FileMode {
+	if n.IsDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type testNodeFile struct {
+	*strings.Reader
+	node   *testNode
+	offset int
+}
+
+func (f *testNodeFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+
+func (f *testNodeFile) Close() error { return nil }
+
+func (f *testNodeFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := make([]fs.DirEntry, len(f.node.children))
+	for i, child := range f.node.children {
+		entries[i] = child
+	}
+	return direntries.Read(n, entries, &f.offset)
+}
+
+func TestNamedFS(t *testing.T) {
+	fsys := newNamedFS(&testNodeFS{root: &testNode{name: ".", children: []*testNode{
+		{name: "dup.txt", data: "first"},
+		{name: "dup.txt", data: "second"},
+		{name: "../x", data: "dotdot"},
+		{name: "a/b", data: "slash"},
+		{name: "nul\x00", data: "nul"},
+		{name: "100%.txt", data: "percent"},
+		{name: "backup~2", data: "tilde"},
+		{name: "bad\\dir", children: []*testNode{
+			{name: "dup.txt", data: "third"},
+			{name: "dup.txt", data: "fourth"},
+			{name: "plain.txt", data: "plain"},
+		}},
+	}}})
+
+	tests := []struct {
+		name    string
+		rawName string
+		want    string
+	}{
+		{"dup.txt", "", "first"},
+		{"dup.txt~2", "dup.txt", "second"},
+		{"..%2Fx", "../x", "dotdot"},
+		{"a%2Fb", "a/b", "slash"},
+		{"nul%00", "nul\x00", "nul"},
+		{"100%.txt", "", "percent"},
+		{"backup~2", "", "tilde"},
+		{"bad%5Cdir/dup.txt", "", "third"},
+		{"bad%5Cdir/dup.txt~2", "dup.txt", "fourth"},
+		{"bad%5Cdir/plain.txt", "", "plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := fs.ReadFile(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("ReadFile() = %q, want %q", data, tt.want)
+			}
+
+			info, err := fs.Stat(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, ok := info.Sys().(*RawName)
+			if ok != (tt.rawName != "") {
+				t.Fatalf("Sys() = %#v, want raw name %q", info.Sys(), tt.rawName)
+			}
+			if ok && raw.Name != tt.rawName {
+				t.Errorf("Sys().Name = %q, want %q", raw.Name, tt.rawName)
+			}
+		})
+	}
+
+	if _, err := fs.Stat(fsys, "bad%5Cdir/missing~2"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if err := fstest.TestFS(fsys, "dup.txt~2", "..%2Fx", "bad%5Cdir/dup.txt~2", "bad%5Cdir/plain.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unlistedFS is a file system whose directories can not be listed.
+type unlistedFS struct {
+	fs.FS
+}
+
+func (u *unlistedFS) Open(name string) (fs.File, error) {
+	f, err := u.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+func TestNamedFS_Unlisted(t *testing.T) {
+	// names that look like escapes or suffixes are opened without listing
+	// their directories
+	fsys := newNamedFS(&unlistedFS{&testNodeFS{root: &testNode{name: ".", children: []*testNode{
+		{name: "PROGRA~1", children: []*testNode{
+			{name: "50%.txt", data: "half"},
+			{name: "_", data: "underscore"},
+		}},
+	}}}})
+
+	for _, name := range []string{"PROGRA~1/50%.txt", "PROGRA~1/_"} {
+		if _, err := fs.Stat(fsys, name); err != nil {
+			t.Errorf("Stat(%q) error = %v", name, err)
+		}
+	}
+	if _, err := fs.Stat(fsys, "PROGRA~1/missing~2"); err == nil {
+		t.Errorf("Stat() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package ntfs
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+
+	"www.velocidex.com/golang/go-ntfs/parser"
+)
+
+const (
+	deletedDir = "$Deleted"
+	orphanDir  = "$Orphan"
+
+	// records below are reserved for metadata files
+	firstUserRecord = 24
+)
+
+// record is a file of the $Deleted or $Orphan directory.
+type record struct {
+	name      string
+	entry     *parser.MFT_ENTRY
+	info      *parser.FileInfo
+	allocated bool
+}
+
+func (fsys *FS) virtualDirEntry(name string) *DirEntry {
+	return &DirEntry{fsys: fsys, info: &parser.FileInfo{Name: name, IsDir: true}, allocated: true}
+}
+
+// scan reads all MFT records to find deleted and orphaned files.
+func (fsys *FS) scan() error {
+	if fsys.scanned {
+		return nil
+	}
+	mft, err := fsys.ntfsCtx.GetMFT(0)
+	if err != nil {
+		return err
+	}
+	info, err := fsys.stat(mft, "")
+	if err != nil {
+		return err
+	}
+
+	count := info.Size / fsys.ntfsCtx.GetRecordSize()
+	for id := int64(0); id < count; id++ {
+		r := fsys.record(id)
+		switch {
+		case r == nil:
+		case !r.allocated:
+			fsys.deletedRecords = append(fsys.deletedRecords, r)
+		default:
+			fsys.orphanRecords = append(fsys.orphanRecords, r)
+		}
+	}
+	fsys.scanned = true
+	return nil
+}
+
+// record returns deleted files and orphaned files or directories, it returns
+// nil for all other records.
+func (fsys *FS) record(id int64) (r *record) {
+	defer func() {
+		if recover() != nil {
+			r = nil
+		}
+	}()
+
+	entry, err := fsys.ntfsCtx.GetMFT(id)
+	if err != nil || !entry.Magic().IsValid() || entry.Base_record_reference() != 0 {
+		return nil
+	}
+	allocated := entry.Flags().IsSet("ALLOCATED")
+	if allocated && (id < firstUserRecord || !fsys.orphan(entry)) {
+		return nil
+	}
+	info, err := fsys.stat(entry, "")
+	if err != nil || info.Name == "" || (!allocated && info.IsDir) {
+		return nil
+	}
+	if !allocated && fsys.reused(entry) {
+		return nil
+	}
+	return &record{
+		name:      fmt.Sprintf("%d-%s", id, info.Name),
+		entry:     entry,
+		info:      info,
+		allocated: allocated,
+	}
+}
+
+// reused checks if any cluster of the data streams of an unallocated record
+// is allocated again. Resident data is stored in the record itself.
+func (fsys *FS) reused(entry *parser.MFT_ENTRY) bool {
+	bitmap, err := fsys.clusterBitmap()
+	if err != nil {
+		return false
+	}
+	for _, attr := range entry.EnumerateAttributes(fsys.ntfsCtx) {
+		if attr.Type().Value != attributeData || attr.IsResident() {
+			continue
+		}
+		var lcn int64
+		for _, run := range attr.RunList() {
+			if run.RelativeUrnOffset == 0 {
+				// sparse run
+				continue
+			}
+			lcn += run.RelativeUrnOffset
+			for c := lcn; c < lcn+run.Length; c++ {
+				if c < 0 || c/8 >= int64(len(bitmap)) || bitmap[c/8]&(1<<(c%8)) != 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// orphan checks if none of the parent directories of the record exist.
+func (fsys *FS) orphan(entry *parser.MFT_ENTRY) bool {
+	names := entry.FileName(fsys.ntfsCtx)
+	if len(names) == 0 {
+		return false
+	}
+	for _, name := range names {
+		parent, err := fsys.ntfsCtx.GetMFT(int64(name.MftReference()))
+		if err == nil && parent.Magic().IsValid() && parent.Flags().IsSet("ALLOCATED") &&
+			parent.IsDir(fsys.ntfsCtx) && parent.Sequence_value() == name.Seq_num() {
+			return false
+		}
+	}
+	return true
+}
+
+func (fsys *FS) records(dir string) ([]*record, error) {
+	if err := fsys.scan(); err != nil {
+		return nil, err
+	}
+	if dir == deletedDir {
+		return fsys.deletedRecords, nil
+	}
+	return fsys.orphanRecords, nil
+}
+
+// openRecord returns the MFT entry of a path in the $Deleted or $Orphan
+// directory.
+func (fsys *FS) openRecord(dir, name string) (*parser.MFT_ENTRY, error) {
+	records, err := fsys.records(dir)
+	if err != nil {
+		return nil, err
+	}
+	first, rest := splitFirst(name)
+	for _, r := range records {
+		if r.name != first {
+			continue
+		}
+		if rest == "" {
+			return r.entry, nil
+		}
+		entry, err := r.entry.Open(fsys.ntfsCtx, "/"+rest)
+		if err != nil {
+			return nil, fs.ErrNotExist
+		}
+		return entry, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (fsys *FS) openVirtual(name, dir string) (fs.File, error) {
+	records, err := fsys.records(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	entry := fsys.virtualDirEntry(dir)
+	return &virtualItem{
+		Item:    Item{fsys: fsys, name: dir, info: entry.info, allocated: true},
+		records: records,
+	}, nil
+}
+
+// virtualItem is the $Deleted or $Orphan directory.
+type virtualItem struct {
+	Item
+	records []*record
+}
+
+// ReadDir returns up to n deleted or orphaned files.
+func (v *virtualItem) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := make([]fs.DirEntry, 0, len(v.records))
+	for _, r := range v.records {
+		entries = append(entries, &DirEntry{fsys: v.fsys, info: r.info, name: r.name, allocated: r.allocated})
+	}
+	return direntries.Read(n, entries, &v.dirOffset)
+}
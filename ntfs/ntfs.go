@@ -0,0 +1,250 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+// Package ntfs provides an io/fs implementation of the New Technology File
+// System (NTFS).
+//
+// Alternate data streams can be opened with the path syntax of Windows, e.g.
+// "file.txt:Zone.Identifier". They are only listed in directories if the FS is
+// created with the WithAlternateDataStreams option.
+//
+// With the WithDeleted option the root contains the virtual directories
+// $Deleted, which lists the files of unallocated MFT records whose clusters
+// have not been reused, and $Orphan, which lists allocated records whose
+// parent directory no longer exists.
+// With the WithUnallocated option the free clusters are available as
+// $Unallocated and the slack space of files as the stream "file:$Slack".
+package ntfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"www.velocidex.com/golang/go-ntfs/parser"
+
+	"github.com/forensicanalysis/recursivefs/internal/segment"
+)
+
+const (
+	defaultPageSize  = 1024 * 1024
+	defaultCacheSize = 100 * 1024 * 1024
+
+	// compressionCacheSize is the number of decompressed units cached per
+	// open file
+	compressionCacheSize = 4
+
+	attributeData = 128
+	rootRecord    = 5
+)
+
+// FS implements a read-only file system for the NTFS.
+type FS struct {
+	ntfsCtx *parser.NTFSContext
+
+	streams bool
+
+	deleted        bool
+	scanned        bool
+	deletedRecords []*record
+	orphanRecords  []*record
+
+	unallocated       bool
+	unallocatedReader *segment.Reader
+
+	bitmap []byte
+}
+
+// Option configures a FS.
+type Option func(*FS)
+
+// WithAlternateDataStreams lists the alternate data streams of files as
+// separate directory entries named "file:stream".
+func WithAlternateDataStreams() Option {
+	return func(fsys *FS) {
+		fsys.streams = true
+	}
+}
+
+// WithDeleted adds the virtual directories $Deleted and $Orphan to the root.
+func WithDeleted() Option {
+	return func(fsys *FS) {
+		fsys.deleted = true
+	}
+}
+
+// WithUnallocated adds the virtual file $Unallocated to the root that
+// contains all clusters marked as free in $Bitmap and lists the slack space
+// of files as the stream "file:$Slack".
+func WithUnallocated() Option {
+	return func(fsys *FS) {
+		fsys.unallocated = true
+	}
+}
+
+// New creates a new ntfs FS.
+func New(r io.ReaderAt, options ...Option) (fsys *FS, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("error parsing file system as NTFS")
+		}
+	}()
+	reader, err := parser.NewPagedReader(r, defaultPageSize, defaultCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	ntfsCtx, err := parser.GetNTFSContext(reader, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys = &FS{ntfsCtx: ntfsCtx}
+	for _, option := range options {
+		option(fsys)
+	}
+	return fsys, nil
+}
+
+// Open opens a file or an alternate data stream for reading.
+func (fsys *FS) Open(name string) (item fs.File, err error) {
+	valid := fs.ValidPath(name)
+	if !valid || strings.Contains(name, `\`) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	filePath, stream := splitStream(name)
+	if strings.Contains(path.Dir(filePath), ":") || strings.Contains(stream, ":") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if fsys.unallocated && filePath == unallocatedFile && stream == "" {
+		return fsys.openUnallocated(name)
+	}
+
+	var entry *parser.MFT_ENTRY
+	dir, rest := splitFirst(filePath)
+	if fsys.deleted && (dir == deletedDir || dir == orphanDir) {
+		if rest == "" {
+			if stream != "" {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			return fsys.openVirtual(name, dir)
+		}
+		entry, err = fsys.openRecord(dir, rest)
+	} else {
+		entry, err = fsys.open(filePath)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return fsys.openEntry(name, entry, stream)
+}
+
+// openEntry opens the stream of an MFT entry under the given name.
+func (fsys *FS) openEntry(name string, entry *parser.MFT_ENTRY, stream string) (fs.File, error) {
+	if fsys.unallocated && stream == slackStream {
+		return fsys.openSlack(name, entry)
+	}
+
+	info, err := fsys.stat(entry, stream)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	// names are matched regardless of case, the name as stored is reported
+	base := path.Base(name)
+	if strings.EqualFold(info.Name, base) {
+		base = info.Name
+	}
+
+	return &Item{
+		fsys:      fsys,
+		entry:     entry,
+		name:      base,
+		stream:    stream,
+		info:      info,
+		allocated: entry.Flags().IsSet("ALLOCATED"),
+	}, nil
+}
+
+// mftEntry returns the MFT entry of the MFTId of a parser.FileInfo.
+func (fsys *FS) mftEntry(mftID string) (*parser.MFT_ENTRY, error) {
+	id, err := strconv.ParseInt(strings.Split(mftID, "-")[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.ntfsCtx.GetMFT(id)
+}
+
+func (fsys *FS) open(filePath string) (*parser.MFT_ENTRY, error) {
+	root, err := fsys.ntfsCtx.GetMFT(rootRecord)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := root.Open(fsys.ntfsCtx, "/"+filePath)
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	return entry, nil
+}
+
+// splitFirst splits the first element from a path.
+func splitFirst(name string) (first, rest string) {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// splitStream splits the name of an alternate data stream from the path.
+func splitStream(name string) (filePath, stream string) {
+	base := path.Base(name)
+	if i := strings.Index(base, ":"); i >= 0 {
+		return path.Join(path.Dir(name), base[:i]), base[i+1:]
+	}
+	return name, ""
+}
+
+// stat returns the information of the default data stream or directory index,
+// or of the named alternate data stream.
+func (fsys *FS) stat(entry *parser.MFT_ENTRY, stream string) (*parser.FileInfo, error) {
+	var found *parser.FileInfo
+	for _, info := range parser.Stat(fsys.ntfsCtx, entry) {
+		_, s := splitStream(info.Name)
+		if s != stream {
+			continue
+		}
+		// prefer the index of directories over unnamed data streams
+		if found == nil || (stream == "" && info.IsDir && !found.IsDir) {
+			found = info
+		}
+	}
+	if found == nil {
+		if stream != "" {
+			return nil, fs.ErrNotExist
+		}
+		return nil, fmt.Errorf("no file information for MFT entry %d", entry.Record_number())
+	}
+	return found, nil
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package ntfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const (
+	testFile   = "Folder A/Folder B/Hello world text document.txt"
+	testStream = testFile + ":goodbye.txt"
+)
+
+// testSub checks the directory that contains the test file, the compressed
+// files in the root are too slow for the small reads of fstest.
+func testSub(t *testing.T, fsys fs.FS, expected ...string) {
+	sub, err := fs.Sub(fsys, "Folder A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		expected[i] = strings.TrimPrefix(expected[i], "Folder A/")
+	}
+	if err := fstest.TestFS(sub, expected...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testFS opens the test image of go-ntfs, it contains a file with an
+// alternate data stream and a compressed file.
+func testFS(t *testing.T, options ...Option) *FS {
+	f, err := os.Open("testdata/test.ntfs.dd.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := New(bytes.NewReader(b), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestFS(t *testing.T) {
+	fsys := testFS(t)
+	testSub(t, fsys, testFile)
+
+	b, err := fs.ReadFile(fsys, "ones.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, bytes.Repeat([]byte("ONES"), 2949120/4)) {
+		t.Errorf("ReadFile(ones.bin) = %q...", b[:16])
+	}
+
+	entries, err := fs.ReadDir(fsys, "Folder A/Folder B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("ReadDir() = %v, want only the file", entries)
+	}
+}
+
+func TestAlternateDataStreams(t *testing.T) {
+	fsys := testFS(t, WithAlternateDataStreams())
+	testSub(t, fsys, testFile, testStream)
+
+	tests := []struct {
+		name       string
+		want       string
+		wantStream string
+	}{
+		{testFile, "Hello world!", ""},
+		{testStream, "Goodbye cruel world.", "goodbye.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := fs.ReadFile(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("ReadFile() = %q, want %q", b, tt.want)
+			}
+
+			info, err := fs.Stat(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat := info.Sys().(*Stat); stat.Stream != tt.wantStream {
+				t.Errorf("Stream = %q, want %q", stat.Stream, tt.wantStream)
+			}
+		})
+	}
+}
+
+func TestOpenStreamErrors(t *testing.T) {
+	fsys := testFS(t)
+	for _, name := range []string{testFile + ":missing", "Folder A:x/Folder B", testStream + ":x"} {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("Open(%q) error = nil", name)
+		}
+	}
+
+	// streams can be opened without being listed
+	if _, err := fs.ReadFile(fsys, testStream); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	fsys := testFS(t, WithDeleted())
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	for _, name := range []string{deletedDir, orphanDir} {
+		if !strings.Contains(strings.Join(names, "/"), name) {
+			t.Errorf("ReadDir(.) = %v, missing %s", names, name)
+		}
+	}
+
+	deleted, err := fs.ReadDir(fsys, deletedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].Name() != "37-deleted.bin" {
+		t.Fatalf("ReadDir(%s) = %v", deletedDir, deleted)
+	}
+	name := deletedDir + "/37-deleted.bin"
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Sys().(*Stat).Allocated {
+		t.Errorf("Stat(%s).Allocated = true", name)
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != info.Size() {
+		t.Errorf("ReadFile(%s) read %d bytes, want %d", name, len(data), info.Size())
+	}
+
+	orphans, err := fs.ReadDir(fsys, orphanDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("ReadDir(%s) = %v, want none", orphanDir, orphans)
+	}
+
+	info, err = fs.Stat(fsys, testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Sys().(*Stat).Allocated {
+		t.Errorf("Stat(%s).Allocated = false", testFile)
+	}
+
+	if _, err := testFS(t).Open(deletedDir); err == nil {
+		t.Errorf("Open(%s) succeeded without WithDeleted", deletedDir)
+	}
+}
+
+func TestReused(t *testing.T) {
+	fsys := testFS(t)
+	f, err := fsys.Open("ones.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entry := f.(*Item).entry
+
+	if !fsys.reused(entry) {
+		t.Error("reused(ones.bin) = false for allocated clusters")
+	}
+	// mark all clusters as free
+	for i := range fsys.bitmap {
+		fsys.bitmap[i] = 0
+	}
+	if fsys.reused(entry) {
+		t.Error("reused(ones.bin) = true for free clusters")
+	}
+}
+
+func TestUnallocated(t *testing.T) {
+	fsys := testFS(t, WithUnallocated())
+
+	// small files are resident and have no slack
+	testSub(t, fsys, testFile)
+	if _, err := fs.Stat(fsys, testFile+":"+slackStream); err != nil {
+		t.Fatal(err)
+	}
+
+	const slackFile = "$AttrDef:" + slackStream
+	slack, err := fs.ReadFile(fsys, slackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(fsys, slackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slack) != 512 || int64(len(slack)) != info.Size() || info.Sys().(*Stat).Stream != slackStream {
+		t.Errorf("slack = %d bytes, Stat() = %d %#v", len(slack), info.Size(), info.Sys())
+	}
+
+	data, err := fs.ReadFile(fsys, unallocatedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = fs.Stat(fsys, unallocatedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || int64(len(data)) != info.Size() || info.Sys().(*Stat).Allocated {
+		t.Errorf("%s = %d bytes, Stat() = %d %#v", unallocatedFile, len(data), info.Size(), info.Sys())
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]int64{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed[entry.Name()] = info.Size()
+	}
+	if listed[slackFile] != 512 || listed[unallocatedFile] != int64(len(data)) {
+		t.Errorf("ReadDir(.) = %v", listed)
+	}
+
+	if _, err := fsys.Open("Folder A:" + slackStream); err == nil {
+		t.Error("Open() of directory slack succeeded")
+	}
+}
+
+func TestDirEntry_Open(t *testing.T) {
+	fsys := testFS(t, WithAlternateDataStreams(), WithDeleted(), WithUnallocated())
+	for _, dir := range []string{".", "Folder A/Folder B", deletedDir} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			f, err := entry.(*DirEntry).Open()
+			if err != nil {
+				t.Fatalf("Open() of %s: %v", name, err)
+			}
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := fs.Stat(fsys, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Name() != want.Name() || info.Size() != want.Size() || info.IsDir() != want.IsDir() {
+				t.Errorf("Stat() of %s = %s %d, want %s %d", name, info.Name(), info.Size(), want.Name(), want.Size())
+			}
+			if stat, wantStat := info.Sys().(*Stat), want.Sys().(*Stat); stat.Stream != wantStat.Stream || stat.Allocated != wantStat.Allocated {
+				t.Errorf("Stat() of %s = %#v, want %#v", name, stat, wantStat)
+			}
+			f.Close()
+		}
+	}
+
+	entries, err := fs.ReadDir(fsys, "Folder A/Folder B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != path.Base(testStream) {
+			continue
+		}
+		f, err := entry.(*DirEntry).Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := fs.ReadFile(fsys, testStream); !bytes.Equal(data, want) {
+			t.Errorf("ReadAll() of %s = %q, want %q", testStream, data, want)
+		}
+		return
+	}
+	t.Errorf("%s not listed", testStream)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package ntfs
+
+import (
+	"io/fs"
+	"time"
+
+	"www.velocidex.com/golang/go-ntfs/parser"
+)
+
+// Stat contains NTFS specific attributes of a file.
+type Stat struct {
+	*parser.FileInfo
+
+	// Stream is the name of the alternate data stream, it is empty for the
+	// default data stream and directories.
+	Stream string
+
+	// Allocated is false for files of unallocated MFT records.
+	Allocated bool
+}
+
+// DirEntry describes a file, directory or alternate data stream and
+// implements fs.DirEntry and fs.FileInfo.
+type DirEntry struct {
+	fsys      *FS
+	info      *parser.FileInfo
+	name      string
+	stream    string
+	allocated bool
+}
+
+func (d *DirEntry) Name() string {
+	if d.name != "" {
+		return d.name
+	}
+	return d.info.Name
+}
+
+func (d *DirEntry) IsDir() bool {
+	return d.info.IsDir && d.stream == ""
+}
+
+func (d *DirEntry) Size() int64 {
+	if d.IsDir() {
+		return 0
+	}
+	return d.info.Size
+}
+
+func (d *DirEntry) Mode() fs.FileMode {
+	if d.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (d *DirEntry) ModTime() time.Time {
+	return d.info.Mtime
+}
+
+// Sys returns the *Stat of the entry.
+func (d *DirEntry) Sys() interface{} {
+	return &Stat{FileInfo: d.info, Stream: d.stream, Allocated: d.allocated}
+}
+
+func (d *DirEntry) Type() fs.FileMode {
+	if d.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (d *DirEntry) Info() (fs.FileInfo, error) {
+	return d, nil
+}
+
+// Open opens the file of the entry. In contrast to FS.Open, the file is
+// found by its MFT entry, so names that are not unique or contain a
+// backslash can be opened.
+func (d *DirEntry) Open() (fs.File, error) {
+	if d.info.MFTId == "" {
+		// $Deleted, $Orphan and $Unallocated
+		return d.fsys.Open(d.Name())
+	}
+	entry, err := d.fsys.mftEntry(d.info.MFTId)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: d.Name(), Err: err}
+	}
+	return d.fsys.openEntry(d.Name(), entry, d.stream)
+}
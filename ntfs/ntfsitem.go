@@ -0,0 +1,168 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package ntfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+
+	"www.velocidex.com/golang/go-ntfs/parser"
+)
+
+// Item describes files and directories in the NTFS.
+type Item struct {
+	fsys      *FS
+	entry     *parser.MFT_ENTRY
+	name      string
+	stream    string
+	info      *parser.FileInfo
+	allocated bool
+	data      io.ReaderAt
+	offset    int64
+	dirOffset int
+}
+
+func (i *Item) isDir() bool {
+	return i.info.IsDir && i.stream == ""
+}
+
+// Read reads bytes into the passed buffer.
+func (i *Item) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := i.ReadAt(p, i.offset)
+	i.offset += int64(c)
+	return c, err
+}
+
+// ReadAt reads bytes starting at off into passed buffer.
+func (i *Item) ReadAt(p []byte, off int64) (n int, err error) {
+	if i.isDir() {
+		return 0, syscall.EISDIR
+	}
+	if i.data == nil {
+		if i.data, err = i.openStream(); err != nil {
+			return 0, err
+		}
+	}
+
+	size := i.info.Size
+	if off >= size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		err = io.EOF
+	}
+	n, rerr := i.data.ReadAt(p, off)
+	if rerr != nil && rerr != io.EOF {
+		return n, rerr
+	}
+	return n, err
+}
+
+// openStream opens the data attribute with the name of the stream.
+// Compressed streams are cached per compression unit, so small reads do not
+// decompress the same unit again.
+func (i *Item) openStream() (io.ReaderAt, error) {
+	for _, attr := range i.entry.EnumerateAttributes(i.fsys.ntfsCtx) {
+		if attr.Type().Value == attributeData && attr.Name() == i.stream {
+			r, err := parser.OpenStream(i.fsys.ntfsCtx, i.entry, attributeData, attr.Attribute_id())
+			if err != nil || attr.IsResident() || attr.Compression_unit_size() == 0 {
+				return r, err
+			}
+			unit := i.fsys.ntfsCtx.ClusterSize << attr.Compression_unit_size()
+			return parser.NewPagedReader(r, unit, compressionCacheSize)
+		}
+	}
+	return nil, errors.New("data attribute not found")
+}
+
+// Seek move the current offset to the given position.
+func (i *Item) Seek(pos int64, whence int) (offset int64, err error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		pos += i.offset
+	case os.SEEK_END:
+		pos += i.info.Size
+	default:
+		return 0, syscall.EINVAL
+	}
+	if pos < 0 {
+		return 0, syscall.EINVAL
+	}
+	i.offset = pos
+	return i.offset, nil
+}
+
+// ReadDir returns up to n child items of a directory.
+func (i *Item) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !i.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	infos := parser.ListDir(i.fsys.ntfsCtx, i.entry)
+
+	var entries []fs.DirEntry
+	for _, info := range infos {
+		if info.Name == "" || info.Name == "." {
+			continue
+		}
+		_, stream := splitStream(info.Name)
+		if stream != "" && !i.fsys.streams {
+			continue
+		}
+		entries = append(entries, &DirEntry{fsys: i.fsys, info: info, stream: stream, allocated: true})
+		if i.fsys.unallocated && stream == "" && !info.IsDir {
+			if slack := i.fsys.slackDirEntry(info); slack != nil {
+				entries = append(entries, slack)
+			}
+		}
+	}
+	if i.entry.Record_number() == rootRecord {
+		if i.fsys.deleted {
+			entries = append(entries, i.fsys.virtualDirEntry(deletedDir), i.fsys.virtualDirEntry(orphanDir))
+		}
+		if i.fsys.unallocated {
+			unallocated, err := i.fsys.unallocatedDirEntry()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, unallocated)
+		}
+	}
+	return direntries.Read(n, entries, &i.dirOffset)
+}
+
+// Close does not do anything for NTFS items.
+func (i *Item) Close() error { return nil }
+
+// Stat returns the fs.FileInfo of the item.
+func (i *Item) Stat() (fs.FileInfo, error) {
+	return &DirEntry{fsys: i.fsys, info: i.info, name: i.name, stream: i.stream, allocated: i.allocated}, nil
+}
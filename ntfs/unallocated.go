@@ -0,0 +1,185 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+package ntfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+
+	"www.velocidex.com/golang/go-ntfs/parser"
+
+	"github.com/forensicanalysis/recursivefs/internal/segment"
+)
+
+const (
+	unallocatedFile = "$Unallocated"
+	slackStream     = "$Slack"
+
+	bitmapRecord = 6
+)
+
+// clusterBitmap returns the content of $Bitmap, a bit is set for every
+// allocated cluster.
+func (fsys *FS) clusterBitmap() ([]byte, error) {
+	if fsys.bitmap != nil {
+		return fsys.bitmap, nil
+	}
+
+	entry, err := fsys.ntfsCtx.GetMFT(bitmapRecord)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.stat(entry, "")
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{fsys: fsys, entry: entry, info: info}
+	bitmap := make([]byte, info.Size)
+	if _, err := item.ReadAt(bitmap, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	fsys.bitmap = bitmap
+	return bitmap, nil
+}
+
+// unallocatedData returns the clusters that are marked as free in $Bitmap.
+func (fsys *FS) unallocatedData() (*segment.Reader, error) {
+	if fsys.unallocatedReader != nil {
+		return fsys.unallocatedReader, nil
+	}
+
+	bitmap, err := fsys.clusterBitmap()
+	if err != nil {
+		return nil, err
+	}
+
+	// bits behind the end of the volume are set
+	clusterSize := fsys.ntfsCtx.ClusterSize
+	var segments []segment.Segment
+	for c := int64(0); c < int64(len(bitmap))*8; c++ {
+		if bitmap[c/8]&(1<<(c%8)) == 0 {
+			segments = append(segments, segment.Segment{Offset: c * clusterSize, Length: clusterSize})
+		}
+	}
+	fsys.unallocatedReader = segment.NewReader(fsys.ntfsCtx.DiskReader, segments)
+	return fsys.unallocatedReader, nil
+}
+
+func (fsys *FS) openUnallocated(name string) (fs.File, error) {
+	data, err := fsys.unallocatedData()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &Item{
+		fsys: fsys,
+		name: unallocatedFile,
+		info: &parser.FileInfo{Name: unallocatedFile, Size: data.Size()},
+		data: data,
+	}, nil
+}
+
+func (fsys *FS) unallocatedDirEntry() (*DirEntry, error) {
+	data, err := fsys.unallocatedData()
+	if err != nil {
+		return nil, err
+	}
+	return &DirEntry{fsys: fsys, info: &parser.FileInfo{Name: unallocatedFile, Size: data.Size()}}, nil
+}
+
+// slack returns the bytes between the end of the default data stream and the
+// end of its last cluster. Resident, compressed and sparse parts of files
+// have no slack.
+func (fsys *FS) slack(entry *parser.MFT_ENTRY) *segment.Reader {
+	clusterSize := fsys.ntfsCtx.ClusterSize
+	for _, attr := range entry.EnumerateAttributes(fsys.ntfsCtx) {
+		if attr.Type().Value != attributeData || attr.Name() != "" || attr.IsResident() ||
+			attr.Runlist_vcn_start() != 0 || attr.Compression_unit_size() != 0 {
+			continue
+		}
+
+		size := attr.DataSize()
+		var segments []segment.Segment
+		var lcn, vcn int64
+		for _, run := range attr.RunList() {
+			start, end := vcn*clusterSize, (vcn+run.Length)*clusterSize
+			vcn += run.Length
+			if run.RelativeUrnOffset == 0 {
+				// sparse run
+				continue
+			}
+			lcn += run.RelativeUrnOffset
+			if end <= size {
+				continue
+			}
+			offset := lcn*clusterSize - start
+			if start < size {
+				start = size
+			}
+			segments = append(segments, segment.Segment{Offset: offset + start, Length: end - start})
+		}
+		if vcn*clusterSize < size {
+			// the run list is continued in another attribute
+			break
+		}
+		return segment.NewReader(fsys.ntfsCtx.DiskReader, segments)
+	}
+	return segment.NewReader(fsys.ntfsCtx.DiskReader, nil)
+}
+
+func (fsys *FS) openSlack(name string, entry *parser.MFT_ENTRY) (fs.File, error) {
+	info, err := fsys.stat(entry, "")
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.IsDir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	data := fsys.slack(entry)
+	slackInfo := *info
+	slackInfo.Size = data.Size()
+	return &Item{
+		fsys:      fsys,
+		entry:     entry,
+		name:      path.Base(name),
+		stream:    slackStream,
+		info:      &slackInfo,
+		allocated: entry.Flags().IsSet("ALLOCATED"),
+		data:      data,
+	}, nil
+}
+
+// slackDirEntry returns the directory entry of the slack of a file or nil if
+// the file has no slack.
+func (fsys *FS) slackDirEntry(info *parser.FileInfo) *DirEntry {
+	entry, err := fsys.mftEntry(info.MFTId)
+	if err != nil {
+		return nil
+	}
+	data := fsys.slack(entry)
+	if data.Size() == 0 {
+		return nil
+	}
+	slackInfo := *info
+	slackInfo.Size = data.Size()
+	return &DirEntry{fsys: fsys, info: &slackInfo, name: info.Name + ":" + slackStream, stream: slackStream, allocated: true}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package recursivefs
+
+import (
+	"context"
+	"io/fs"
+
+	"github.com/forensicanalysis/filetype"
+	"github.com/forensicanalysis/fslib/gpt"
+	"github.com/forensicanalysis/fslib/mbr"
+)
+
+// Layer describes a file in one level of a nested path, e.g. a zip file on a
+// NTFS partition.
+type Layer struct {
+	// Path is the path of the file in the file system of the previous layer
+	// or the root file system for the first layer.
+	Path string
+	// Offset is the position of the file in the file of the previous layer,
+	// -1 if it is unknown. Offsets are known for partitions and partition
+	// gaps.
+	Offset int64
+	// Size is the size of the file.
+	Size int64
+	// Format is the type of the file system inside of the file, nil if the
+	// file is not opened as container.
+	Format *filetype.Filetype
+	// FormatOffset is the start of the file system inside of the file as
+	// given by the "@offset=" path syntax or OpenAs.
+	FormatOffset int64
+	// Sys contains the parser metadata of the file, e.g. a *ntfs.Stat.
+	Sys interface{}
+}
+
+// Provenance is returned by Info.Sys() if the FS was created with
+// WithProvenance.
+type Provenance struct {
+	// Layers is the nesting chain of the file, the first layer is a file in
+	// the root file system, the last layer is the file itself.
+	Layers []Layer
+	// Sys is the Sys() of the file itself.
+	Sys interface{}
+}
+
+// Resolve returns the nesting chain of a path, e.g. "ntfs.dd/docs.zip/a.pdf"
+// consists of the layers "ntfs.dd" (NTFS), "docs.zip" (zip) and "a.pdf".
+func (fsys *FS) Resolve(name string) ([]Layer, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "resolve", Path: name, Err: fs.ErrInvalid}
+	}
+	elems, owner, err := fsys.resolve(context.Background(), fsys.root, fsys.join(name), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer owner.release()
+	return layers(elems)
+}
+
+func layers(elems []element) ([]Layer, error) {
+	var layers []Layer
+	for _, elem := range elems {
+		info, err := fs.Stat(elem.FS, elem.Key)
+		if err != nil {
+			return nil, err
+		}
+		layer := Layer{
+			Path:   elem.Key,
+			Offset: offset(info.Sys()),
+			Size:   info.Size(),
+			Format: elem.format,
+			Sys:    info.Sys(),
+		}
+		if elem.as != nil {
+			layer.FormatOffset = elem.as.offset
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// offset returns the position of a partition or gap on its disk.
+func offset(sys interface{}) int64 {
+	switch sys := sys.(type) {
+	case *mbr.PartitionEntry:
+		return int64(sys.LbaStart()) * sectorSize
+	case *gpt.PartitionEntry:
+		return int64(sys.FirstLba()) * sectorSize
+	case *Gap:
+		return sys.FirstSector * sectorSize
+	}
+	return -1
+}
@@ -24,6 +24,7 @@ package recursivefs
 
 import (
 	"archive/zip"
+	"context"
 	"errors"
 	"io"
 	"io/fs"
@@ -31,68 +32,220 @@ import (
 	"path"
 	"strings"
 
-	"github.com/nlepage/go-tarfs"
-
 	"github.com/forensicanalysis/filetype"
-	"github.com/forensicanalysis/fslib/bufferfs"
-	"github.com/forensicanalysis/fslib/fat16"
 	"github.com/forensicanalysis/fslib/fsio"
 	"github.com/forensicanalysis/fslib/gpt"
 	"github.com/forensicanalysis/fslib/mbr"
-	"github.com/forensicanalysis/fslib/ntfs"
 	"github.com/forensicanalysis/goaff4"
+	"github.com/forensicanalysis/recursivefs/bitlocker"
+	"github.com/forensicanalysis/recursivefs/btrfs"
+	"github.com/forensicanalysis/recursivefs/fat"
+	"github.com/forensicanalysis/recursivefs/internal/seekfs"
+	"github.com/forensicanalysis/recursivefs/lvm"
+	"github.com/forensicanalysis/recursivefs/ntfs"
+	"github.com/forensicanalysis/recursivefs/xfs"
 )
 
-func parseRealPath(fsys fs.FS, sample string) (rpath []element, err error) {
+func (fsys *FS) parseRealPath(root fs.FS, sample string) (rpath []element, err error) {
+	rpath, owner, err := fsys.resolve(context.Background(), root, sample, nil, false)
+	owner.release()
+	return rpath, err
+}
+
+// resolve splits the path into the files in the nested file systems. The
+// returned node owns the file system of the last element, the caller must
+// release it. The last element is parsed as container unless raw is set, as
+// forces its interpretation. Resolving stops when ctx is done.
+func (fsys *FS) resolve(ctx context.Context, root fs.FS, sample string, forced *interpretation, raw bool) (rpath []element, owner *node, err error) {
+	defer func() {
+		if err != nil {
+			owner.release()
+			owner = nil
+		}
+	}()
+
 	parts := strings.Split(sample, "/")
 
 	if len(parts) == 0 {
-		return []element{{fsys, "."}}, nil
+		return []element{{FS: root, Key: "."}}, nil, nil
 	}
 
-	key := "."
+	// pending is the error of the last file that could not be opened as
+	// container, it is returned if the path continues inside of that file
+	var pending error
+
+	key, prefix := ".", "."
 	for len(parts) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, owner, openError(sample, rpath, err)
+		}
+		dir := key
 		key = path.Join(key, parts[0])
-		parts = parts[1:]
-		info, err := fs.Stat(fsys, key)
+		prefix = path.Join(prefix, parts[0])
+		info, err := fs.Stat(root, key)
+		var as *interpretation
+		if err == nil && info.Name() != parts[0] && strings.EqualFold(info.Name(), parts[0]) {
+			// the name as stored in a case-insensitive file system
+			key = path.Join(dir, info.Name())
+			prefix = path.Join(path.Dir(prefix), info.Name())
+		}
 		if err != nil {
-			return nil, err
+			name, in, ok := fsys.splitContainer(parts[0])
+			if !ok {
+				return nil, owner, openError(sample, rpath, notFound(err, pending))
+			}
+			key = path.Join(dir, name)
+			if info, err = fs.Stat(root, key); err != nil {
+				return nil, owner, openError(sample, rpath, notFound(err, pending))
+			}
+			if info.IsDir() {
+				return nil, owner, &fs.PathError{Op: "open", Path: sample, Err: fs.ErrInvalid}
+			}
+			as = in
+		}
+		parts = parts[1:]
+		pending = nil
+
+		if len(parts) == 0 && forced != nil {
+			as = forced
+			prefix += forced.suffix()
 		}
 
 		if !info.IsDir() {
-			rpath = append(rpath, element{fsys, key})
-			f, err := fsys.Open(key)
-			if err != nil {
-				return nil, err
+			rpath = append(rpath, element{FS: root, Key: key, as: as})
+			if (fsys.explicit && as == nil) || (len(parts) == 0 && raw) {
+				// only recurse where requested
+				continue
+			}
+			n, err := fsys.container(ctx, root, owner, key, prefix, as)
+			// volumes without keys are plain files, a full temporary
+			// directory must not hide the containers
+			plain := as == nil && errors.Is(err, errNoKeys)
+			if err != nil && !plain && (as != nil || len(parts) == 0 || errors.Is(err, ErrLimitExceeded)) {
+				// damaged files are plain files in tolerant mode
+				if as != nil || len(parts) > 0 || !fsys.tolerate(sample, err) {
+					return nil, owner, openError(sample, rpath, err)
+				}
 			}
-			cfsys, err := childFS(f, key)
-			if err != nil || cfsys == nil {
+			if err != nil || n == nil {
+				pending = err
 				continue
 			}
-			fsys = cfsys
+			rpath[len(rpath)-1].format = n.format
+			owner.release()
+			owner = n
+			root = n.fsys
 
 			key = "."
 		} else if len(parts) == 0 {
-			rpath = append(rpath, element{fsys, key})
+			rpath = append(rpath, element{FS: root, Key: key, as: as})
 		}
 	}
-	return rpath, nil
+	return rpath, owner, nil
 }
 
-// func childFS(fsys fs.FS, name string) (fs.FS, error) {
-func childFS(r io.Reader, name string) (fs.FS, error) { // nolint: gocyclo
-	t, err := filetype.DetectReaderByExtension(r, path.Ext(name))
+// notFound returns the error of a container the path continues in instead of
+// the error that the file does not exist.
+func notFound(err, pending error) error {
+	if pending != nil && errors.Is(err, fs.ErrNotExist) {
+		return pending
+	}
+	return err
+}
+
+func (fsys *FS) childFS(r io.Reader, name string) (fs.FS, error) {
+	_, cfsys, err := fsys.detectFS(r, name)
+	return cfsys, err
+}
+
+// detectFS is like childFS but also returns the detected file type.
+func (fsys *FS) detectFS(r io.Reader, name string) (*filetype.Filetype, fs.FS, error) {
+	t, err := detect(r, name)
 	if err != nil && err != io.EOF {
-		return nil, err
+		return nil, nil, containerError(nil, err, nil)
 	}
 
 	readSeekerAt, ok := r.(fsio.ReadSeekerAt)
 	if !ok {
-		return nil, errors.New("files must be ReadSeekerAt")
+		return nil, nil, &ContainerError{Kind: ErrUnsupportedFormat, Err: errors.New("files must be ReadSeekerAt")}
 	}
 	_, _ = readSeekerAt.Seek(0, os.SEEK_SET)
 
-	var fsys fs.FS
+	cfsys, err := fsys.parse(t, readSeekerAt, name)
+	if err != nil || cfsys == nil {
+		return nil, cfsys, err
+	}
+	return t, cfsys, nil
+}
+
+// container returns the node of the file system inside of the file key of
+// parent, nil is returned if the file is not a container. The results are
+// cached by name, which is the path of the file in the recursive FS. The
+// caller must release the returned node. Detection and parsing are aborted
+// when ctx is done.
+func (fsys *FS) container(ctx context.Context, parent fs.FS, owner *node, key, name string, as *interpretation) (*node, error) {
+	if n, ok := fsys.cache.get(name); ok {
+		return n, nil
+	}
+	if !owner.tryAcquire() {
+		return nil, fs.ErrClosed
+	}
+	defer owner.release()
+	if err := fsys.checkDepth(owner); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pf, err := parent.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	ctx, done := fsys.withDeadline(ctx)
+	f := &contextFile{File: pf, ctx: ctx}
+	t, cfsys, fp, err := fsys.openContainer(f, key, as, owner)
+	err = done(err)
+	if err != nil || cfsys == nil {
+		if closer, ok := cfsys.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		_ = f.Close()
+		if err == nil {
+			fsys.cache.add(name, nil)
+		}
+		return nil, err
+	}
+	f.setContext(nil)
+	n := newNode(f, cfsys, t, owner)
+	n.fingerprint = fp
+	fsys.cache.add(name, n)
+	return n, nil
+}
+
+// openContainer detects or interprets the file and parses the container.
+// Containers that are identical to one of their ancestors are rejected.
+func (fsys *FS) openContainer(f *contextFile, key string, as *interpretation, owner *node) (t *filetype.Filetype, cfsys fs.FS, fp fingerprint, err error) {
+	if as != nil {
+		t, cfsys, err = fsys.interpretFS(f, key, as)
+	} else {
+		t, cfsys, err = fsys.detectFS(f, key)
+	}
+	if err != nil || cfsys == nil {
+		return nil, cfsys, fp, err
+	}
+	fp, err = newFingerprint(f)
+	if err == nil {
+		err = checkSelfReference(t, fp, owner)
+	}
+	return t, cfsys, fp, err
+}
+
+// parse creates the file system of the given type, nil is returned for
+// types that are not containers.
+func (fsys *FS) parse(t *filetype.Filetype, readSeekerAt fsio.ReadSeekerAt, name string) (cfsys fs.FS, err error) { // nolint: gocyclo
+	defer recoverPanic(t, &err)
+
 	switch t {
 	case filetype.Zip, filetype.Xlsx, filetype.Pptx, filetype.Docx:
 		var size int64
@@ -100,30 +253,92 @@ func childFS(r io.Reader, name string) (fs.FS, error) { // nolint: gocyclo
 		if err != nil {
 			return nil, err
 		}
-		fsys, err = zip.NewReader(readSeekerAt, size)
+		var zr *zip.Reader
+		// insecure names are normalised by the archive file system
+		if zr, err = zip.NewReader(readSeekerAt, size); err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+			break
+		}
+		if fsys.maxEntries > 0 && len(zr.File) > fsys.maxEntries {
+			return nil, entriesError(t, fsys.maxEntries)
+		}
+		cfsys, err = newZipFS(zr, readSeekerAt), nil
 	case filetype.Tar:
-		fsys, err = tarfs.New(readSeekerAt)
-	case filetype.FAT16:
-		return fat16.New(readSeekerAt)
+		var size int64
+		if size, err = fsio.GetSize(readSeekerAt); err == nil {
+			cfsys, err = newTarFS(readSeekerAt, size, fsys.maxEntries)
+		}
+	case filetype.FAT16, FAT:
+		cfsys, err = fat.New(readSeekerAt, fsys.fatOptions...)
 	case filetype.MBR:
-		fsys, err = mbr.New(readSeekerAt)
+		cfsys, err = mbr.New(readSeekerAt)
+		if err == nil && fsys.unallocated {
+			cfsys, err = withGaps(cfsys, t, readSeekerAt)
+		}
 	case filetype.GPT:
-		return gpt.New(readSeekerAt)
+		var g *gpt.FS
+		if err = checkGPT(readSeekerAt); err == nil {
+			if g, err = gpt.New(readSeekerAt); err == nil {
+				cfsys = &gptFS{FS: g, r: readSeekerAt}
+			}
+		}
+		if err == nil && fsys.unallocated {
+			cfsys, err = withGaps(cfsys, t, readSeekerAt)
+		}
 	case filetype.NTFS:
-		fsys, err = ntfs.New(readSeekerAt)
+		cfsys, err = ntfs.New(readSeekerAt, fsys.ntfsOptions...)
 	case filetype.AFF4:
 		var size int64
 		size, err = fsio.GetSize(readSeekerAt)
 		if err != nil {
 			return nil, err
 		}
-		fsys, err = goaff4.New(readSeekerAt, size)
+		cfsys, err = goaff4.New(readSeekerAt, size)
+	case LVM:
+		cfsys, err = lvm.New(readSeekerAt)
+	case XFS:
+		cfsys, err = xfs.New(readSeekerAt)
+	case Btrfs:
+		cfsys, err = btrfs.New(readSeekerAt)
+	case BitLocker:
+		cfsys, err = fsys.bitlockerFS(readSeekerAt, name)
+		if err != nil {
+			return nil, containerError(t, err, ErrCorruptContainer)
+		}
+		return cfsys, nil
 	default:
 		return nil, nil
 	}
+	if err != nil {
+		return nil, containerError(t, err, ErrCorruptContainer)
+	}
+
+	if _, ok := cfsys.(*archiveFS); !ok {
+		cfsys = newNamedFS(cfsys)
+	}
+	if caseInsensitive[t] && !fsys.caseSensitive {
+		cfsys = newFoldFS(cfsys)
+	}
+
+	size, err := fsio.GetSize(readSeekerAt)
 	if err != nil {
 		return nil, err
 	}
+	return newLockedFS(seekfs.New(cfsys, fsys.spool), t, fsys.layerLimits(t, size)), nil
+}
 
-	return bufferfs.New(fsys), nil
+// bitlockerFS decrypts a BitLocker volume and returns the file system inside.
+// Volumes are treated as plain files if no keys are configured.
+func (fsys *FS) bitlockerFS(r fsio.ReadSeekerAt, name string) (fs.FS, error) {
+	if fsys.bitlockerKeys.Empty() {
+		return nil, errNoKeys
+	}
+	size, err := fsio.GetSize(r)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := bitlocker.New(r, size, &fsys.bitlockerKeys)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.childFS(io.NewSectionReader(volume, 0, size), name)
 }
@@ -26,77 +26,511 @@
 package recursivefs
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"io"
 	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/forensicanalysis/fslib/bufferfs"
+	"github.com/forensicanalysis/filetype"
 	"github.com/forensicanalysis/fslib/osfs"
+	"github.com/forensicanalysis/recursivefs/bitlocker"
+	"github.com/forensicanalysis/recursivefs/fat"
+	"github.com/forensicanalysis/recursivefs/internal/seekfs"
+	"github.com/forensicanalysis/recursivefs/ntfs"
 )
 
 type element struct {
-	// Parser *filetype.Filetype
 	FS  fs.FS
 	Key string
+
+	// as forces the interpretation of the file
+	as *interpretation
+	// format is the type of the file system in the file
+	format *filetype.Filetype
 }
 
 // FS implements a read-only meta file system that can access nested file system
 // structures.
+//
+// A FS is safe for concurrent use by multiple goroutines if the root file
+// system is. Each parsed child file system is guarded by its own lock, so
+// reads in different containers run in parallel while reads in the same
+// container are serialized. ReadAt of opened files can be called
+// concurrently, other methods of a file must not.
 type FS struct {
 	root fs.FS
+
+	bitlockerKeys bitlocker.Keys
+	ntfsOptions   []ntfs.Option
+	fatOptions    []fat.Option
+	unallocated   bool
+	explicit      bool
+	provenance    bool
+	caseSensitive bool
+	tolerant      bool
+	onError       func(name string, err error)
+
+	maxDepth    int
+	maxBytes    int64
+	maxRatio    float64
+	maxEntries  int
+	maxDuration time.Duration
+
+	cacheSize int
+	cache     *cache
+
+	memoryLimit int64
+	tempDir     string
+	tempQuota   int64
+	spool       *seekfs.Spool
+
+	// dir is the directory of a FS returned by Sub
+	dir string
 }
 
-// New creates a new recursive FS.
-func New() *FS {
-	return &FS{root: bufferfs.New(osfs.New())}
+// Option configures a FS.
+type Option func(*FS)
+
+// WithBitLockerRecoveryPassword adds a recovery password that is tried on
+// BitLocker encrypted volumes.
+func WithBitLockerRecoveryPassword(password string) Option {
+	return func(fsys *FS) {
+		fsys.bitlockerKeys.RecoveryPasswords = append(fsys.bitlockerKeys.RecoveryPasswords, password)
+	}
+}
+
+// WithBitLockerStartupKey adds the content of a startup key file (.BEK) that is
+// tried on BitLocker encrypted volumes.
+func WithBitLockerStartupKey(bek []byte) Option {
+	return func(fsys *FS) {
+		fsys.bitlockerKeys.StartupKeys = append(fsys.bitlockerKeys.StartupKeys, bek)
+	}
+}
+
+// WithBitLockerFVEK sets the full volume encryption key that is used to
+// decrypt BitLocker encrypted volumes.
+func WithBitLockerFVEK(fvek []byte) Option {
+	return func(fsys *FS) {
+		fsys.bitlockerKeys.FVEK = fvek
+	}
+}
+
+// WithAlternateDataStreams lists the alternate data streams of NTFS files as
+// directory entries named "file:stream". Streams can always be opened by
+// their path, their Info.Sys() is a *ntfs.Stat with the stream name.
+func WithAlternateDataStreams() Option {
+	return func(fsys *FS) {
+		fsys.ntfsOptions = append(fsys.ntfsOptions, ntfs.WithAlternateDataStreams())
+	}
+}
+
+// WithDeleted adds virtual directories for deleted files to the root of NTFS
+// and FAT file systems. $Deleted lists the files of unallocated MFT records or
+// deleted directory entries whose clusters have not been reused. On NTFS,
+// $Orphan lists files whose parent directory no longer exists. The
+// Info.Sys() of these files reports Allocated as false.
+func WithDeleted() Option {
+	return func(fsys *FS) {
+		fsys.ntfsOptions = append(fsys.ntfsOptions, ntfs.WithDeleted())
+		fsys.fatOptions = append(fsys.fatOptions, fat.WithDeleted())
+	}
+}
+
+// WithUnallocated adds virtual files for space that is not used by files.
+// MBR and GPT disks list the sectors outside of partitions as
+// "unallocated-<first sector>-<last sector>", their Info.Sys() is a *Gap.
+// NTFS and FAT file systems contain $Unallocated with all free clusters and
+// list the slack space of files as "name:$Slack".
+func WithUnallocated() Option {
+	return func(fsys *FS) {
+		fsys.unallocated = true
+		fsys.ntfsOptions = append(fsys.ntfsOptions, ntfs.WithUnallocated())
+		fsys.fatOptions = append(fsys.fatOptions, fat.WithUnallocated())
+	}
+}
+
+// WithExplicitContainers disables the automatic recursion into container
+// files. Containers are only opened where a path element ends with "!", e.g.
+// "evidence.zip!/doc.pdf", while "evidence.zip" is the plain zip file. If a
+// file with the full name including the "!" exists, that file is used.
+func WithExplicitContainers() Option {
+	return func(fsys *FS) {
+		fsys.explicit = true
+	}
+}
+
+// WithProvenance changes the Info.Sys() of opened files to a *Provenance
+// that contains the nesting chain of the file in addition to the Sys() of the
+// underlying file.
+func WithProvenance() Option {
+	return func(fsys *FS) {
+		fsys.provenance = true
+	}
+}
+
+// WithCaseSensitive disables the case-insensitive resolution of paths in
+// NTFS and FAT file systems, so only paths with the exact case of the stored
+// names can be opened.
+func WithCaseSensitive() Option {
+	return func(fsys *FS) {
+		fsys.caseSensitive = true
+	}
+}
+
+// WithTolerance lists damaged containers instead of failing. Files whose
+// container can not be opened are presented as plain files and entries whose
+// information can not be read are listed with their name and type only. The
+// errors are passed to onError, which can be nil. onError may be called
+// concurrently and more than once for the same file.
+func WithTolerance(onError func(name string, err error)) Option {
+	return func(fsys *FS) {
+		fsys.tolerant = true
+		fsys.onError = onError
+	}
+}
+
+// WithMaxDepth limits the nesting depth of containers, e.g. a zip file in a
+// zip file has a depth of 2. Deeper containers fail with ErrLimitExceeded
+// when they are opened and are listed as plain files.
+func WithMaxDepth(depth int) Option {
+	return func(fsys *FS) {
+		fsys.maxDepth = depth
+	}
+}
+
+// WithMaxBytes limits the number of bytes that are read from the files of a
+// single container, e.g. the decompressed content of a zip file. Bytes that
+// are read again are not counted. Reads beyond the limit fail with
+// ErrLimitExceeded.
+func WithMaxBytes(size int64) Option {
+	return func(fsys *FS) {
+		fsys.maxBytes = size
+	}
+}
+
+// WithMaxRatio limits the number of bytes that are read from the files of a
+// container to ratio times the size of the container file. This stops
+// decompression bombs regardless of their size.
+func WithMaxRatio(ratio float64) Option {
+	return func(fsys *FS) {
+		fsys.maxRatio = ratio
+	}
+}
+
+// WithMaxEntries limits the number of entries of a zip or tar file and of
+// each directory in a container.
+func WithMaxEntries(entries int) Option {
+	return func(fsys *FS) {
+		fsys.maxEntries = entries
+	}
+}
+
+// WithMaxDuration limits the time to detect and parse a single container.
+func WithMaxDuration(d time.Duration) Option {
+	return func(fsys *FS) {
+		fsys.maxDuration = d
+	}
+}
+
+// WithCacheSize sets the number of parsed child file systems, e.g. zip files
+// or partitions, that are kept between calls to Open. The default is 64, a
+// size of 0 disables the cache.
+func WithCacheSize(size int) Option {
+	return func(fsys *FS) {
+		fsys.cacheSize = size
+	}
+}
+
+// defaultMemoryLimit is the size up to which stream-only files are buffered in
+// memory.
+const defaultMemoryLimit = 64 << 20
+
+// WithMemoryLimit sets the size up to which files of stream-only file
+// systems, e.g. tar files, are buffered in memory to allow random access.
+// Larger files are spilled to a temporary directory. The default is 64 MiB, a
+// negative limit keeps all files in memory.
+func WithMemoryLimit(size int64) Option {
+	return func(fsys *FS) {
+		fsys.memoryLimit = size
+	}
+}
+
+// WithTempDir sets the directory for spilled files, the default is
+// os.TempDir.
+func WithTempDir(dir string) Option {
+	return func(fsys *FS) {
+		fsys.tempDir = dir
+	}
+}
+
+// WithTempQuota limits the total size of spilled files. Opening a file that
+// exceeds the quota fails with ErrQuotaExceeded. The default of 0
+// disables the quota.
+func WithTempQuota(size int64) Option {
+	return func(fsys *FS) {
+		fsys.tempQuota = size
+	}
 }
 
 // New creates a new recursive FS.
-func NewFS(root fs.FS) *FS {
-	return &FS{root: bufferfs.New(root)}
+func New(options ...Option) *FS {
+	return NewFS(osfs.New(), options...)
+}
+
+// NewFS creates a new recursive FS on top of the given root.
+func NewFS(root fs.FS, options ...Option) *FS {
+	fsys := &FS{cacheSize: defaultCacheSize, memoryLimit: defaultMemoryLimit}
+	for _, option := range options {
+		option(fsys)
+	}
+	fsys.spool = seekfs.NewSpool(fsys.memoryLimit, fsys.tempDir, fsys.tempQuota)
+	fsys.root = seekfs.New(root, fsys.spool)
+	fsys.cache = newCache(fsys.cacheSize)
+	return fsys
+}
+
+// tolerate reports if err can be ignored in tolerant mode and passes it to
+// the error handler. Canceled operations are never ignored, unlike exceeded
+// limits.
+func (fsys *FS) tolerate(name string, err error) bool {
+	canceled := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	if !fsys.tolerant || (canceled && !errors.Is(err, ErrLimitExceeded)) {
+		return false
+	}
+	if fsys.onError != nil {
+		fsys.onError(name, err)
+	}
+	return true
+}
+
+// Purge removes all parsed child file systems from the cache, e.g. after
+// files in the root file system were changed.
+func (fsys *FS) Purge() {
+	fsys.cache.purge()
 }
 
 // Open returns a File for the given location.
+//
+// A path element can force the parser and start offset of a file with the
+// suffix "@offset=<bytes>:<type>", e.g. "disk.bin@offset=1048576:ntfs". Both
+// parts are optional ("disk.bin@ntfs", "disk.bin@offset=1048576"), the type
+// is detected if it is omitted. The suffix is only used if no file with the
+// full name exists.
+//
+// With WithExplicitContainers, containers are only opened where a path
+// element ends with "!", e.g. "evidence.zip!/doc.pdf".
 func (fsys *FS) Open(name string) (f fs.File, err error) {
-	valid := fs.ValidPath(name)
-	if !valid {
-		return nil, fmt.Errorf("path %s invalid", name)
+	return fsys.open(context.Background(), name, nil, false)
+}
+
+// OpenRaw opens a file without parsing it as container. Containers like zip
+// files are returned as plain files, so their bytes can be read and hashed.
+func (fsys *FS) OpenRaw(name string) (fs.File, error) {
+	return fsys.open(context.Background(), name, nil, true)
+}
+
+// OpenAs opens a file and parses it as the given type starting at offset. The
+// type is detected if t is nil.
+func (fsys *FS) OpenAs(name string, t *filetype.Filetype, offset int64) (fs.File, error) {
+	if offset < 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.open(context.Background(), name, &interpretation{filetype: t, offset: offset}, false)
+}
+
+func (fsys *FS) open(ctx context.Context, name string, forced *interpretation, raw bool) (f fs.File, err error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
 	}
 
-	elems, err := parseRealPath(fsys.root, name)
+	name = fsys.join(name)
+	elems, owner, err := fsys.resolve(ctx, fsys.root, name, forced, raw)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	localFS := fsys.root
-	var childName = ""
-	for _, elem := range elems {
-		f, err = elem.FS.Open(elem.Key)
+	defer func() {
 		if err != nil {
+			owner.release()
+		}
+	}()
+
+	last := elems[len(elems)-1]
+	f, err = fsys.openFile(last.FS, last.Key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if (fi.IsDir() || raw) && last.as != nil {
+		_ = f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	item := &Item{fsys: fsys, name: name + forced.suffix(), parentFS: last.FS, localPath: last.Key, internal: f, owner: owner, ctx: ctx}
+	if last.format != nil {
+		item.childFS = owner.fsys
+	}
+
+	if fsys.provenance {
+		if item.layers, err = layers(elems); err != nil {
+			_ = f.Close()
 			return nil, err
 		}
+	}
+	return item, nil
+}
 
-		childName = elem.Key
-		localFS = elem.FS
+// Close releases all cached file systems. Files that are still open keep the
+// file systems they depend on until they are closed, directory entries until
+// they are inspected or garbage collected.
+func (fsys *FS) Close() error {
+	fsys.cache.purge()
+	return nil
+}
+
+// join returns the path of name in the root file system.
+func (fsys *FS) join(name string) string {
+	if fsys.dir == "" {
+		return name
 	}
+	return path.Join(fsys.dir, name)
+}
 
-	fi, err := f.Stat()
+// Stat returns the fs.FileInfo of a file without opening it.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.stat(context.Background(), name)
+}
+
+func (fsys *FS) stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	elems, owner, err := fsys.resolve(ctx, fsys.root, fsys.join(name), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer owner.release()
+
+	last := elems[len(elems)-1]
+	info, err := fs.Stat(last.FS, last.Key)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() && last.as != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	stat := &Info{internal: info, isFS: last.format != nil}
+	if fsys.provenance {
+		if stat.layers, err = layers(elems); err != nil {
+			return nil, err
+		}
+	}
+	return stat, nil
+}
+
+// ReadDir returns the sorted entries of a directory or container.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+	return f.(*Item).ReadDir(-1)
+}
 
-	if fi.IsDir() {
-		return &Item{parentFS: localFS, localPath: childName, internal: f}, nil
+// ReadFile returns the content of a file. Containers return their raw bytes.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.OpenRaw(name)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
 
-	subFS, err := childFS(f, childName)
+// Glob returns the names of all files matching pattern. Containers are
+// matched like directories, e.g. "*.zip/*.pdf" returns the pdf files in all
+// zip files.
+func (fsys *FS) Glob(pattern string) (matches []string, err error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !hasMeta(pattern) {
+		if _, err := fsys.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := path.Split(pattern)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+	if !hasMeta(dir) {
+		return fsys.glob(dir, file, nil)
+	}
+
+	dirs, err := fsys.Glob(dir)
 	if err != nil {
 		return nil, err
 	}
+	for _, d := range dirs {
+		if matches, err = fsys.glob(d, file, matches); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
 
-	return &Item{
-		parentFS:  localFS,
-		localPath: childName,
-		internal:  f,
-		childFS:   subFS,
-	}, nil
+// glob adds the entries of dir that match pattern to matches.
+func (fsys *FS) glob(dir, pattern string, matches []string) ([]string, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		// ignore files that are not directories
+		return matches, nil // nolint: nilerr
+	}
+	for _, entry := range entries {
+		matched, err := path.Match(pattern, entry.Name())
+		if err != nil {
+			return matches, err
+		}
+		if matched {
+			matches = append(matches, path.Join(dir, entry.Name()))
+		}
+	}
+	return matches, nil
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+// Sub returns a FS rooted at dir, which can be a directory or a container,
+// e.g. "case/disk.E01/p1". The returned FS shares the options and the cache
+// with fsys.
+func (fsys *FS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	if dir == "." {
+		return fsys, nil
+	}
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+	sub := *fsys
+	sub.dir = fsys.join(dir)
+	return &sub, nil
 }
@@ -23,32 +23,62 @@
 package recursivefs
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 
+	"github.com/forensicanalysis/filetype"
 	"github.com/forensicanalysis/fslib"
-	"github.com/forensicanalysis/fslib/bufferfs"
-	"github.com/forensicanalysis/fslib/fat16"
 	fslibtest "github.com/forensicanalysis/fslib/fstest"
+	"github.com/forensicanalysis/fslib/gpt"
+	"github.com/forensicanalysis/fslib/mbr"
 	"github.com/forensicanalysis/fslib/osfs"
+	"github.com/forensicanalysis/recursivefs/bitlocker"
+	"github.com/forensicanalysis/recursivefs/btrfs"
+	"github.com/forensicanalysis/recursivefs/ntfs"
 )
 
-/*
 func TestFS(t *testing.T) {
-	osfsys := os.DirFS("testdata/data/document")
-
-	fsys := NewFS(osfsys)
+	root := fstest.MapFS{
+		"evidence.zip":   &fstest.MapFile{Data: testZip(t)},
+		"archive.tar":    &fstest.MapFile{Data: testTar(t)},
+		"fat.dd":         &fstest.MapFile{Data: gunzip(t, "fat/testdata/test.fat12.dd.gz")},
+		"plain/file.txt": &fstest.MapFile{Data: []byte("plain")},
+	}
+	fsys := NewFS(root)
 
-	err := fstest.TestFS(fsys, "Design_of_the_FAT_file_system.xlsx/[Content_Types].xml")
+	err := fstest.TestFS(fsys,
+		"evidence.zip/doc.txt",
+		"evidence.zip/dir/doc.txt",
+		"archive.tar/tar.txt",
+		"archive.tar/nested.zip/dir/doc.txt",
+		"fat.dd/Long File Name.txt",
+		"fat.dd/SUB/nested.txt",
+		"plain/file.txt",
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	if err := fstest.TestFS(NewFS(ntfsRoot(t)), "ntfs.dd/Folder A/Folder B/Hello world text document.txt"); err != nil {
+		t.Fatal(err)
+	}
 }
-*/
 
 func TestRecursiveFS_OpenRead(t *testing.T) {
 	type args struct {
@@ -219,8 +249,9 @@ func TestParseRealPath(t *testing.T) {
 		wantRpath []element
 		wantErr   bool
 	}{
-		{"Test zip", args{"testdata/data/container/zip.zip/image"}, []element{{&osfs.FS{}, zippath}, {&bufferfs.FS{}, "image"}}, false},
-		{"Test fat16", args{"testdata/data/filesystem/mbr_fat16.dd/p0/IMAGE"}, []element{{&osfs.FS{}, fatpath}, {&bufferfs.FS{}, "p0"}, {&fat16.FS{}, "IMAGE"}}, false},
+		// the file systems of containers are wrapped by lockedFS
+		{"Test zip", args{"testdata/data/container/zip.zip/image"}, []element{{FS: &osfs.FS{}, Key: zippath}, {FS: &lockedFS{}, Key: "image"}}, false},
+		{"Test fat16", args{"testdata/data/filesystem/mbr_fat16.dd/p0/IMAGE"}, []element{{FS: &osfs.FS{}, Key: fatpath}, {FS: &lockedFS{}, Key: "p0"}, {FS: &lockedFS{}, Key: "IMAGE"}}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -229,7 +260,7 @@ func TestParseRealPath(t *testing.T) {
 				t.Error(err)
 				return
 			}
-			gotRpath, err := parseRealPath(osfs.New(), name)
+			gotRpath, err := New().parseRealPath(osfs.New(), name)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ParseRealPath() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -257,3 +288,868 @@ func elementsEqual(rpath []element, rpath2 []element) bool {
 	}
 	return true
 }
+
+func TestBitLocker(t *testing.T) {
+	header := make([]byte, 8192)
+	copy(header[3:], bitlocker.Signature)
+	header[510], header[511] = 0x55, 0xaa
+
+	tests := []struct {
+		name    string
+		options []Option
+		wantDir bool
+		wantErr bool
+	}{
+		{"no keys", nil, false, false},
+		{"invalid metadata", []Option{WithBitLockerRecoveryPassword("111111-222222-333333-444444-555555-666666-123420-011011")}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(fstest.MapFS{"bitlocker.dd": &fstest.MapFile{Data: header}}, tt.options...)
+			fi, err := fs.Stat(fsys, "bitlocker.dd")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fs.Stat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && fi.IsDir() != tt.wantDir {
+				t.Errorf("IsDir() = %v, want %v", fi.IsDir(), tt.wantDir)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	xfsImage := make([]byte, 8192)
+	copy(xfsImage, "XFSB")
+	btrfsImage := make([]byte, btrfs.SuperblockOffset+4096)
+	copy(btrfsImage[btrfs.SuperblockOffset+0x40:], "_BHRfS_M")
+
+	tests := []struct {
+		name  string
+		data  []byte
+		short bool
+		want  *filetype.Filetype
+	}{
+		{"xfs", xfsImage, false, XFS},
+		{"btrfs", btrfsImage, false, Btrfs},
+		{"empty", make([]byte, 100), false, nil},
+		{"short reads", testZip(t), true, filetype.Zip},
+		{"short reads xfs", xfsImage, true, XFS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tt.data)
+			if tt.short {
+				r = iotest.OneByteReader(r)
+			}
+			got, err := detect(r, tt.name+".dd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && got != tt.want {
+				t.Errorf("detect() = %v, want %v", got, tt.want)
+			}
+			if tt.want == nil && (got == XFS || got == Btrfs) {
+				t.Errorf("detect() = %v", got)
+			}
+		})
+	}
+}
+
+// gunzip returns the content of a gzip compressed file.
+func gunzip(t *testing.T, name string) []byte {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testTar returns a tar file that contains "tar.txt" and the zip file of
+// testZip as "nested.zip".
+func testTar(t *testing.T) []byte {
+	return testTarFiles(t, map[string][]byte{"tar.txt": []byte("tar"), "nested.zip": testZip(t)})
+}
+
+func testTarFiles(t *testing.T, files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for name, data := range files {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ntfsRoot returns a root file system that contains the NTFS test image of the
+// ntfs package as "ntfs.dd".
+func ntfsRoot(t *testing.T) fs.FS {
+	return fstest.MapFS{"ntfs.dd": &fstest.MapFile{Data: gunzip(t, "ntfs/testdata/test.ntfs.dd.gz")}}
+}
+
+func TestAlternateDataStreams(t *testing.T) {
+	root := ntfsRoot(t)
+
+	const stream = "ntfs.dd/Folder A/Folder B/Hello world text document.txt:goodbye.txt"
+	tests := []struct {
+		name        string
+		options     []Option
+		wantEntries []string
+	}{
+		{"default", nil, []string{"Hello world text document.txt"}},
+		{"streams", []Option{WithAlternateDataStreams()}, []string{"Hello world text document.txt", "Hello world text document.txt:goodbye.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(root, tt.options...)
+
+			entries, err := fs.ReadDir(fsys, path.Dir(stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if !reflect.DeepEqual(names, tt.wantEntries) {
+				t.Errorf("ReadDir() = %v, want %v", names, tt.wantEntries)
+			}
+
+			b, err := fs.ReadFile(fsys, stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "Goodbye cruel world." {
+				t.Errorf("ReadFile() = %q", b)
+			}
+			info, err := fs.Stat(fsys, stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat, ok := info.Sys().(*ntfs.Stat); !ok || stat.Stream != "goodbye.txt" {
+				t.Errorf("Sys() = %#v", info.Sys())
+			}
+		})
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	const deleted = "ntfs.dd/$Deleted/37-deleted.bin"
+
+	if _, err := fs.Stat(NewFS(ntfsRoot(t)), deleted); err == nil {
+		t.Errorf("Stat(%s) succeeded without WithDeleted", deleted)
+	}
+
+	fsys := NewFS(ntfsRoot(t), WithDeleted())
+	entries, err := fs.ReadDir(fsys, path.Dir(deleted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != path.Base(deleted) {
+		t.Errorf("ReadDir() = %v", entries)
+	}
+	info, err := fs.Stat(fsys, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, ok := info.Sys().(*ntfs.Stat); !ok || stat.Allocated {
+		t.Errorf("Sys() = %#v", info.Sys())
+	}
+}
+
+func TestUnallocatedGaps(t *testing.T) {
+	mbrDisk := testMBR()
+	copy(mbrDisk[5000*sectorSize:], "hidden")
+
+	gptDisk := testGPT()
+	copy(gptDisk[5000*sectorSize:], "hidden")
+
+	root := fstest.MapFS{
+		"mbr.dd": &fstest.MapFile{Data: mbrDisk},
+		"gpt.dd": &fstest.MapFile{Data: gptDisk},
+	}
+	tests := []struct {
+		name   string
+		want   []string
+		hidden string
+	}{
+		{"mbr.dd", []string{"p0", "p1", "unallocated-0000000001-0000002047", "unallocated-0000004096-0000006143", "unallocated-0000007168-0000008191"}, "unallocated-0000004096-0000006143"},
+		{"gpt.dd", []string{"p0", "unallocated-0000000034-0000002047", "unallocated-0000004096-0000008158"}, "unallocated-0000004096-0000008158"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := fs.ReadDir(NewFS(root), tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.want)-strings.Count(strings.Join(tt.want, " "), "unallocated") {
+				t.Errorf("ReadDir() without WithUnallocated = %v", entries)
+			}
+
+			fsys := NewFS(root, WithUnallocated())
+			entries, err = fs.ReadDir(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("ReadDir() = %v, want %v", names, tt.want)
+			}
+
+			b, err := fs.ReadFile(fsys, tt.name+"/"+tt.hidden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(b, []byte("hidden")) {
+				t.Errorf("ReadFile(%s) does not contain the hidden data", tt.hidden)
+			}
+			info, err := fs.Stat(fsys, tt.name+"/"+tt.hidden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gap, ok := info.Sys().(*Gap); !ok || gap.LastSector-gap.FirstSector+1 != info.Size()/sectorSize {
+				t.Errorf("Sys() = %#v", info.Sys())
+			}
+
+			sub, err := fs.Sub(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(sub, tt.hidden); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGapFS(t *testing.T) {
+	tests := []struct {
+		name string
+		t    *filetype.Filetype
+		disk []byte
+		gap  string
+		new  func(r io.ReadSeeker) (fs.FS, error)
+	}{
+		{"mbr", filetype.MBR, testMBR(), "unallocated-0000004096-0000006143", func(r io.ReadSeeker) (fs.FS, error) { return mbr.New(r) }},
+		{"gpt", filetype.GPT, testGPT(), "unallocated-0000004096-0000008158", func(r io.ReadSeeker) (fs.FS, error) {
+			g, err := gpt.New(r)
+			return &gptFS{FS: g, r: r.(io.ReaderAt)}, err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.disk)
+			fsys, err := tt.new(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gaps, err := withGaps(fsys, tt.t, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(gaps, "p0", tt.gap); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGPT(t *testing.T) {
+	root := fstest.MapFS{"gpt.dd": &fstest.MapFile{Data: testGPT()}}
+	for _, options := range [][]Option{nil, {WithUnallocated()}} {
+		fsys := NewFS(root, options...)
+		if _, err := fs.Stat(fsys, "gpt.dd/p0"); err != nil {
+			t.Fatal(err)
+		}
+
+		// GPT disks are wrapped like all other containers
+		n, ok := fsys.cache.get("gpt.dd")
+		if !ok {
+			t.Fatal("gpt.dd is not cached")
+		}
+		if _, ok := n.fsys.(*lockedFS); !ok {
+			t.Errorf("FS of gpt.dd is %T, want *lockedFS", n.fsys)
+		}
+		n.release()
+	}
+}
+
+func TestSplitInterpretation(t *testing.T) {
+	tests := []struct {
+		elem     string
+		name     string
+		filetype *filetype.Filetype
+		offset   int64
+		ok       bool
+	}{
+		{"disk.bin@offset=1048576:ntfs", "disk.bin", filetype.NTFS, 1048576, true},
+		{"disk.bin@offset=0x100000", "disk.bin", nil, 1048576, true},
+		{"disk.bin@xfs", "disk.bin", XFS, 0, true},
+		{"disk.bin", "disk.bin", nil, 0, false},
+		{"user@example.com", "user@example.com", nil, 0, false},
+		{"disk.bin@offset=-1:ntfs", "disk.bin@offset=-1:ntfs", nil, 0, false},
+		{"disk.bin@offset=1:unknown", "disk.bin@offset=1:unknown", nil, 0, false},
+		{"disk.bin@", "disk.bin@", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.elem, func(t *testing.T) {
+			name, in, ok := splitInterpretation(tt.elem)
+			if name != tt.name || ok != tt.ok {
+				t.Fatalf("splitInterpretation() = %s, %v", name, ok)
+			}
+			if ok && (in.filetype != tt.filetype || in.offset != tt.offset) {
+				t.Errorf("splitInterpretation() = %#v", in)
+			}
+		})
+	}
+}
+
+func TestOpenAs(t *testing.T) {
+	image, err := fs.ReadFile(ntfsRoot(t), "ntfs.dd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const offset = 1048576
+	disk := append(bytes.Repeat([]byte("header"), offset/6), make([]byte, offset%6)...)
+	disk = append(disk, image...)
+	fsys := NewFS(fstest.MapFS{"disk.bin": &fstest.MapFile{Data: disk}})
+
+	if _, err := fs.ReadDir(fsys, "disk.bin/Folder A"); err == nil {
+		t.Error("ReadDir() without interpretation succeeded")
+	}
+
+	for _, name := range []string{"disk.bin@offset=1048576:ntfs", "disk.bin@offset=1048576"} {
+		entries, err := fs.ReadDir(fsys, name+"/Folder A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "Folder B" {
+			t.Errorf("ReadDir(%s) = %v", name, entries)
+		}
+	}
+
+	f, err := fsys.OpenAs("disk.bin", filetype.NTFS, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Error("OpenAs() is not a directory")
+	}
+	entries, err := f.(fs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("OpenAs() has no entries")
+	}
+
+	if _, err := fsys.OpenAs("disk.bin", filetype.NTFS, 0); err == nil {
+		t.Error("OpenAs() at offset 0 succeeded")
+	}
+	if _, err := fs.Stat(fsys, "disk.bin@offset=0:xfs"); err == nil {
+		t.Error("Stat() of a wrong type succeeded")
+	}
+}
+
+// testDisk returns a MBR disk with the zip file of testZip in partition p0
+// at sector 2048.
+func testDisk(t *testing.T) []byte {
+	zipFile := testZip(t)
+	disk := make([]byte, 4096*sectorSize)
+	entry := disk[0x1be:]
+	entry[4] = 0x83
+	binary.LittleEndian.PutUint32(entry[8:], 2048)
+	binary.LittleEndian.PutUint32(entry[12:], uint32(len(zipFile)+sectorSize-1)/sectorSize)
+	disk[510], disk[511] = 0x55, 0xaa
+	copy(disk[2048*sectorSize:], zipFile)
+	return disk
+}
+
+// testGPT returns a GPT disk of 8192 sectors with one partition from sector
+// 2048 to 4095.
+// testMBR returns a MBR disk with the partitions 2048-4095 and 6144-7167.
+func testMBR() []byte {
+	const sectors = 8192
+	disk := make([]byte, sectors*sectorSize)
+	for i, p := range [][2]uint32{{2048, 2048}, {6144, 1024}} {
+		entry := disk[0x1be+16*i:]
+		entry[4] = 0x83
+		binary.LittleEndian.PutUint32(entry[8:], p[0])
+		binary.LittleEndian.PutUint32(entry[12:], p[1])
+	}
+	disk[510], disk[511] = 0x55, 0xaa
+	return disk
+}
+
+func testGPT() []byte {
+	const sectors = 8192
+	disk := make([]byte, sectors*sectorSize)
+	copy(disk[sectorSize:], "EFI PART")
+	binary.LittleEndian.PutUint64(disk[sectorSize+40:], 34)
+	binary.LittleEndian.PutUint64(disk[sectorSize+48:], sectors-34)
+	binary.LittleEndian.PutUint64(disk[sectorSize+72:], 2)
+	binary.LittleEndian.PutUint32(disk[sectorSize+80:], 128)
+	binary.LittleEndian.PutUint32(disk[sectorSize+84:], 128)
+	binary.LittleEndian.PutUint64(disk[2*sectorSize+32:], 2048)
+	binary.LittleEndian.PutUint64(disk[2*sectorSize+40:], 4095)
+	disk[510], disk[511] = 0x55, 0xaa
+	return disk
+}
+
+// testZip returns a zip file that contains "doc.txt" and "dir/doc.txt".
+func testZip(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range []string{"doc.txt", "dir/doc.txt"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExplicitContainers(t *testing.T) {
+	data := testZip(t)
+	root := fstest.MapFS{
+		"evidence.zip": &fstest.MapFile{Data: data},
+		"plain.txt!":   &fstest.MapFile{Data: []byte("plain")},
+	}
+
+	tests := []struct {
+		name     string
+		explicit bool
+		want     []byte
+		isDir    bool
+		wantErr  bool
+	}{
+		{"evidence.zip", false, nil, true, false},
+		{"evidence.zip/dir/doc.txt", false, []byte("content"), false, false},
+		{"evidence.zip", true, data, false, false},
+		{"evidence.zip!", true, nil, true, false},
+		{"evidence.zip!/doc.txt", true, []byte("content"), false, false},
+		{"evidence.zip!/dir/doc.txt", true, []byte("content"), false, false},
+		{"evidence.zip/doc.txt", true, nil, false, true},
+		{"evidence.zip!/doc.txt!", true, nil, false, true},
+		{"plain.txt!", true, []byte("plain"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.name, tt.explicit), func(t *testing.T) {
+			var options []Option
+			if tt.explicit {
+				options = append(options, WithExplicitContainers())
+			}
+			fsys := NewFS(root, options...)
+
+			info, err := fs.Stat(fsys, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Stat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if info.IsDir() != tt.isDir {
+				t.Errorf("IsDir() = %v, want %v", info.IsDir(), tt.isDir)
+			}
+			if tt.isDir {
+				return
+			}
+			data, err := fs.ReadFile(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.want) {
+				t.Errorf("ReadFile() = %q, want %q", data, tt.want)
+			}
+		})
+	}
+
+	entries, err := fs.ReadDir(NewFS(root, WithExplicitContainers()), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("%s is listed as directory", entry.Name())
+		}
+	}
+}
+
+func TestOpenRaw(t *testing.T) {
+	data := testZip(t)
+	fsys := NewFS(fstest.MapFS{"evidence.zip": &fstest.MapFile{Data: data, Mode: 0640}})
+
+	f, err := fsys.Open("evidence.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := fi.(*Info)
+	if !info.IsDir() || !info.IsContainer() || info.Mode() != fs.ModeDir|0640 || info.RealMode() != 0640 {
+		t.Errorf("Stat() = %v %v %v %v", info.IsDir(), info.IsContainer(), info.Mode(), info.RealMode())
+	}
+
+	raw, err := f.(*Item).Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	openRaw, err := fsys.OpenRaw("evidence.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer openRaw.Close()
+
+	for _, f := range []fs.File{raw, openRaw} {
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.IsDir() || fi.(*Info).IsContainer() || fi.Mode() != 0640 {
+			t.Errorf("Stat() = %v %v", fi.IsDir(), fi.Mode())
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("raw content differs")
+		}
+	}
+
+	dir, err := fsys.OpenRaw("evidence.zip/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if fi, err := dir.Stat(); err != nil || !fi.IsDir() || fi.(*Info).IsContainer() {
+		t.Errorf("Stat() = %v, %v", fi, err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	disk := testDisk(t)
+	root := fstest.MapFS{"case/disk.dd": &fstest.MapFile{Data: disk}}
+
+	type layer struct {
+		path   string
+		offset int64
+		format *filetype.Filetype
+	}
+	tests := []struct {
+		name string
+		want []layer
+	}{
+		{"case", []layer{{"case", -1, nil}}},
+		{"case/disk.dd", []layer{{"case/disk.dd", -1, filetype.MBR}}},
+		{"case/disk.dd/p0/dir/doc.txt", []layer{
+			{"case/disk.dd", -1, filetype.MBR},
+			{"p0", 2048 * sectorSize, filetype.Zip},
+			{"dir/doc.txt", -1, nil},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := NewFS(root, WithProvenance())
+			layers, err := fsys.Resolve(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []layer
+			for _, l := range layers {
+				got = append(got, layer{l.Path, l.Offset, l.Format})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+
+			info, err := fs.Stat(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			provenance, ok := info.Sys().(*Provenance)
+			if !ok || !reflect.DeepEqual(provenance.Layers, layers) {
+				t.Errorf("Sys() = %#v", info.Sys())
+			}
+		})
+	}
+
+	if _, err := NewFS(root).Resolve("case/missing"); err == nil {
+		t.Error("Resolve() of a missing file succeeded")
+	}
+}
+
+func TestReadDirLazy(t *testing.T) {
+	root := &countFS{
+		FS: fstest.MapFS{
+			"evidence.zip": &fstest.MapFile{Data: testZip(t)},
+			"plain.txt":    &fstest.MapFile{Data: []byte("plain")},
+		},
+		count: map[string]int{},
+	}
+	fsys := NewFS(root)
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.count["evidence.zip"] != 0 {
+		t.Errorf("ReadDir() opened evidence.zip %d times", root.count["evidence.zip"])
+	}
+
+	want := map[string]bool{"evidence.zip": true, "plain.txt": false}
+	for _, entry := range entries {
+		if entry.IsDir() != want[entry.Name()] || entry.IsDir() != entry.Type().IsDir() {
+			t.Errorf("%s IsDir() = %v", entry.Name(), entry.IsDir())
+		}
+	}
+	if root.count["evidence.zip"] != 1 {
+		t.Errorf("evidence.zip opened %d times", root.count["evidence.zip"])
+	}
+
+	// the detection result is cached
+	if _, err := fs.ReadDir(fsys, "evidence.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if root.count["evidence.zip"] != 3 {
+		t.Errorf("evidence.zip opened %d times", root.count["evidence.zip"])
+	}
+}
+
+// BenchmarkReadDir lists a directory on disk with archives of many members,
+// which are expensive to parse. Listing must not parse them, so its cost does
+// not grow with the number of members.
+func BenchmarkReadDir(b *testing.B) {
+	for _, members := range []int{100, 2000} {
+		b.Run(fmt.Sprintf("members=%d", members), func(b *testing.B) {
+			root := os.DirFS(testArchiveDir(b, members))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fsys := NewFS(root)
+				if _, err := fs.ReadDir(fsys, "."); err != nil {
+					b.Fatal(err)
+				}
+				_ = fsys.Close()
+			}
+		})
+	}
+}
+
+// testArchiveDir writes 10 zip and 10 tar files with the given number of
+// members to a temporary directory.
+func testArchiveDir(b *testing.B, members int) string {
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte("recursivefs "), 100)
+	for i := 0; i < 10; i++ {
+		zipBuf, tarBuf := &bytes.Buffer{}, &bytes.Buffer{}
+		zw, tw := zip.NewWriter(zipBuf), tar.NewWriter(tarBuf)
+		for j := 0; j < members; j++ {
+			name := fmt.Sprintf("%d.txt", j)
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				b.Fatal(err)
+			}
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			b.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.zip", i)), zipBuf.Bytes(), 0644); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.tar", i)), tarBuf.Bytes(), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFS_Interfaces(t *testing.T) {
+	zipFile := testZip(t)
+	root := fstest.MapFS{
+		"case/disk.dd":      &fstest.MapFile{Data: testDisk(t)},
+		"case/evidence.zip": &fstest.MapFile{Data: zipFile},
+		"case/plain.txt":    &fstest.MapFile{Data: []byte("plain")},
+	}
+	fsys := NewFS(root)
+	var _ interface {
+		fs.StatFS
+		fs.ReadDirFS
+		fs.ReadFileFS
+		fs.GlobFS
+		fs.SubFS
+	} = fsys
+
+	info, err := fsys.Stat("case/disk.dd/p0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || !info.(*Info).IsContainer() {
+		t.Errorf("Stat() = %v", info.Mode())
+	}
+
+	entries, err := fsys.ReadDir("case/evidence.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "dir" || entries[1].Name() != "doc.txt" {
+		t.Errorf("ReadDir() = %v", entries)
+	}
+
+	for name, want := range map[string][]byte{"case/evidence.zip/dir/doc.txt": []byte("content"), "case/evidence.zip": zipFile} {
+		b, err := fsys.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("ReadFile(%s) = %q", name, b)
+		}
+	}
+
+	globs := map[string][]string{
+		"case/*.zip/*.txt":      {"case/evidence.zip/doc.txt"},
+		"case/*/p?/*/doc.txt":   {"case/disk.dd/p0/dir/doc.txt"},
+		"case/plain.txt":        {"case/plain.txt"},
+		"case/missing.txt":      nil,
+		"case/plain.txt/*":      nil,
+		"case/[a-d]*.dd/p0/dir": {"case/disk.dd/p0/dir"},
+	}
+	for pattern, want := range globs {
+		matches, err := fsys.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(matches, want) {
+			t.Errorf("Glob(%s) = %v, want %v", pattern, matches, want)
+		}
+	}
+	if _, err := fsys.Glob("["); err == nil {
+		t.Error("Glob() with a bad pattern succeeded")
+	}
+
+	sub, err := fs.Sub(fsys, "case/disk.dd/p0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(sub, "dir/doc.txt"); err != nil || string(b) != "content" {
+		t.Errorf("ReadFile() = %q, %v", b, err)
+	}
+	layers, err := sub.(*FS).Resolve("dir/doc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 3 || layers[0].Path != "case/disk.dd" {
+		t.Errorf("Resolve() = %v", layers)
+	}
+	if _, err := fs.Sub(fsys, "case/plain.txt"); err == nil {
+		t.Error("Sub() of a file succeeded")
+	}
+}
+
+func TestItem_ReaderAt(t *testing.T) {
+	fsys := NewFS(fstest.MapFS{"archive.tar": &fstest.MapFile{Data: testTar(t)}})
+
+	f, err := fsys.Open("archive.tar/nested.zip/doc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := iotest.TestReader(f.(*Item), []byte("content")); err != nil {
+		t.Error(err)
+	}
+
+	raw, err := fsys.OpenRaw("archive.tar/nested.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	info, err := raw.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r interface {
+		io.ReaderAt
+		io.Seeker
+	} = raw.(*Item)
+	if _, err := r.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(r, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.File) != 2 {
+		t.Errorf("zip.NewReader() = %v", archive.File)
+	}
+}
+
+func TestFS_Spool(t *testing.T) {
+	root := fstest.MapFS{"archive.tar": &fstest.MapFile{Data: testTar(t)}}
+
+	// tar members are stream-only, the nested zip is spilled to disk
+	dir := t.TempDir()
+	fsys := NewFS(root, WithMemoryLimit(0), WithTempDir(dir))
+	data, err := fs.ReadFile(fsys, "archive.tar/nested.zip/dir/doc.txt")
+	if err != nil || string(data) != "content" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+	if fsys.spool.Used() == 0 {
+		t.Error("nested zip was not spilled")
+	}
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 || fsys.spool.Used() != 0 {
+		t.Errorf("temp files = %d, used = %d after Close", len(entries), fsys.spool.Used())
+	}
+
+	fsys = NewFS(root, WithMemoryLimit(0), WithTempDir(t.TempDir()), WithTempQuota(16))
+	defer fsys.Close()
+	if _, err := fs.ReadFile(fsys, "archive.tar/nested.zip/dir/doc.txt"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("ReadFile() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+}
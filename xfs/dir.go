@@ -0,0 +1,170 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package xfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	dirBlockMagicV4 = "XD2B"
+	dirBlockMagicV5 = "XDB3"
+	dirDataMagicV4  = "XD2D"
+	dirDataMagicV5  = "XDD3"
+	dirHeaderV4     = 16
+	dirHeaderV5     = 64
+	dirFreeTag      = 0xffff
+)
+
+// readDir returns the entries of a directory without "." and "..".
+func (fsys *FS) readDir(in *inode) ([]*DirEntry, error) {
+	if in.format == formatLocal {
+		return fsys.shortformDir(in.fork)
+	}
+
+	extents, err := fsys.extents(in)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{fsys: fsys, extents: extents, size: dirLeafOffset}
+	dirBlockSize := fsys.sb.blockSize << fsys.sb.dirBlockLog
+	leafBlock := uint64(dirLeafOffset >> fsys.sb.blockLog)
+
+	var entries []*DirEntry
+	b := make([]byte, dirBlockSize)
+	for _, e := range extents {
+		end := e.offset + e.count
+		if end > leafBlock {
+			end = leafBlock
+		}
+		for off := int64(e.offset) * fsys.sb.blockSize; off < int64(end)*fsys.sb.blockSize; off += dirBlockSize {
+			if _, err := r.ReadAt(b, off); err != nil && err != io.EOF {
+				return nil, err
+			}
+			blockEntries, err := fsys.dirBlock(b)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, blockEntries...)
+		}
+	}
+	return entries, nil
+}
+
+func (fsys *FS) shortformDir(b []byte) ([]*DirEntry, error) {
+	if len(b) < 2 {
+		return nil, errors.New("xfs: invalid short form directory")
+	}
+	count, inoSize := int(b[0]), 4
+	if b[1] != 0 {
+		count, inoSize = int(b[1]), 8
+	}
+
+	var entries []*DirEntry
+	p := 2 + inoSize
+	for i := 0; i < count; i++ {
+		if p >= len(b) {
+			return nil, errors.New("xfs: invalid short form directory")
+		}
+		nameLen := int(b[p])
+		entrySize := 3 + nameLen + inoSize
+		if fsys.sb.ftype {
+			entrySize++
+		}
+		if p+entrySize > len(b) {
+			return nil, errors.New("xfs: invalid short form directory")
+		}
+		entry := &DirEntry{fsys: fsys, name: string(b[p+3 : p+3+nameLen])}
+		ino := b[p+entrySize-inoSize:]
+		if inoSize == 8 {
+			entry.ino = be64(ino)
+		} else {
+			entry.ino = uint64(be32(ino))
+		}
+		if fsys.sb.ftype {
+			entry.ftype = b[p+3+nameLen]
+		}
+		entries = append(entries, entry)
+		p += entrySize
+	}
+	return entries, nil
+}
+
+// dirBlock parses the entries of a directory block or data block.
+func (fsys *FS) dirBlock(b []byte) ([]*DirEntry, error) {
+	header, end := 0, len(b)
+	switch string(b[:4]) {
+	case dirBlockMagicV4, dirBlockMagicV5:
+		// the block tail and the leaf entries are at the end of the block
+		leafCount := int(be32(b[len(b)-8:]))
+		end = len(b) - 8 - leafCount*8
+		header = dirHeaderV4
+		if string(b[:4]) == dirBlockMagicV5 {
+			header = dirHeaderV5
+		}
+	case dirDataMagicV4:
+		header = dirHeaderV4
+	case dirDataMagicV5:
+		header = dirHeaderV5
+	default:
+		return nil, fmt.Errorf("xfs: invalid directory block %q", b[:4])
+	}
+	if end < header {
+		return nil, errors.New("xfs: invalid directory block")
+	}
+
+	var entries []*DirEntry
+	for p := header; p+8 < end; {
+		if be16(b[p:]) == dirFreeTag {
+			length := int(be16(b[p+2:]))
+			if length == 0 {
+				return nil, errors.New("xfs: invalid unused directory entry")
+			}
+			p += length
+			continue
+		}
+
+		nameLen := int(b[p+8])
+		size := 8 + 1 + nameLen + 2
+		if fsys.sb.ftype {
+			size++
+		}
+		size = (size + 7) &^ 7
+		if p+size > end {
+			return nil, errors.New("xfs: invalid directory entry")
+		}
+		name := string(b[p+9 : p+9+nameLen])
+		if name != "." && name != ".." {
+			entry := &DirEntry{fsys: fsys, name: name, ino: be64(b[p:])}
+			if fsys.sb.ftype {
+				entry.ftype = b[p+9+nameLen]
+			}
+			entries = append(entries, entry)
+		}
+		p += size
+	}
+	return entries, nil
+}
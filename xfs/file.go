@@ -0,0 +1,304 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package xfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/forensicanalysis/recursivefs/internal/direntries"
+)
+
+// file types stored in directory entries
+const (
+	ftypeRegular = 1
+	ftypeDir     = 2
+	ftypeSymlink = 7
+)
+
+// File is a file or directory of the file system.
+type File struct {
+	fsys      *FS
+	inode     *inode
+	name      string
+	data      io.ReaderAt
+	offset    int64
+	dirOffset int
+}
+
+func (f *File) reader() (io.ReaderAt, error) {
+	if f.data != nil {
+		return f.data, nil
+	}
+	if f.inode.format == formatLocal {
+		size := f.inode.size
+		if size > int64(len(f.inode.fork)) {
+			return nil, errors.New("xfs: invalid inline data")
+		}
+		f.data = &inlineReader{f.inode.fork[:size]}
+		return f.data, nil
+	}
+	extents, err := f.fsys.extents(f.inode)
+	if err != nil {
+		return nil, err
+	}
+	f.data = &reader{fsys: f.fsys, extents: extents, size: f.inode.size}
+	return f.data, nil
+}
+
+// Read reads bytes into the passed buffer.
+func (f *File) Read(p []byte) (n int, err error) {
+	if f.inode.isDir() {
+		return 0, syscall.EISDIR
+	}
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads bytes starting at off into the passed buffer.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.inode.isDir() {
+		return 0, syscall.EISDIR
+	}
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.ReadAt(p, off)
+}
+
+// Seek moves the current offset to the given position.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.inode.size
+	default:
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir returns up to n child items of a directory.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.inode.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	dirEntries, err := f.fsys.readDir(f.inode)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(dirEntries, func(i, j int) bool { return dirEntries[i].name < dirEntries[j].name })
+	entries := make([]fs.DirEntry, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		entries = append(entries, entry)
+	}
+
+	return direntries.Read(n, entries, &f.dirOffset)
+}
+
+// Stat returns the fs.FileInfo of the file.
+func (f *File) Stat() (fs.FileInfo, error) {
+	return &FileInfo{name: f.name, inode: f.inode}, nil
+}
+
+// Close does not do anything for XFS files.
+func (f *File) Close() error { return nil }
+
+// Stat contains XFS specific attributes of a file.
+type Stat struct {
+	Inode        uint64
+	UID, GID     uint32
+	Nlink        uint32
+	AccessTime   time.Time
+	ChangeTime   time.Time
+	CreationTime time.Time
+}
+
+// FileInfo describes a file or directory.
+type FileInfo struct {
+	name  string
+	inode *inode
+}
+
+func (fi *FileInfo) Name() string { return fi.name }
+
+func (fi *FileInfo) Size() int64 { return fi.inode.size }
+
+func (fi *FileInfo) Mode() fs.FileMode { return fi.inode.fileMode() }
+
+func (fi *FileInfo) ModTime() time.Time { return fi.inode.mtime }
+
+func (fi *FileInfo) IsDir() bool { return fi.inode.isDir() }
+
+// Sys returns the *Stat of the file.
+func (fi *FileInfo) Sys() interface{} {
+	return &Stat{
+		Inode:        fi.inode.ino,
+		UID:          fi.inode.uid,
+		GID:          fi.inode.gid,
+		Nlink:        fi.inode.nlink,
+		AccessTime:   fi.inode.atime,
+		ChangeTime:   fi.inode.ctime,
+		CreationTime: fi.inode.crtime,
+	}
+}
+
+// DirEntry is an entry of a directory.
+type DirEntry struct {
+	fsys  *FS
+	name  string
+	ino   uint64
+	ftype uint8
+}
+
+func (e *DirEntry) Name() string { return e.name }
+
+func (e *DirEntry) IsDir() bool { return e.Type().IsDir() }
+
+func (e *DirEntry) Type() fs.FileMode {
+	switch e.ftype {
+	case ftypeRegular:
+		return 0
+	case ftypeDir:
+		return fs.ModeDir
+	case ftypeSymlink:
+		return fs.ModeSymlink
+	}
+	info, err := e.Info()
+	if err != nil {
+		return fs.ModeIrregular
+	}
+	return info.Mode().Type()
+}
+
+func (e *DirEntry) Info() (fs.FileInfo, error) {
+	in, err := e.fsys.inode(e.ino)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{name: e.name, inode: in}, nil
+}
+
+// Open opens the file of the entry by its inode, so names that are not
+// unique or contain a slash can be opened.
+func (e *DirEntry) Open() (fs.File, error) {
+	in, err := e.fsys.inode(e.ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: e.name, Err: err}
+	}
+	return &File{fsys: e.fsys, inode: in, name: e.name}, nil
+}
+
+type inlineReader struct {
+	data []byte
+}
+
+func (r *inlineReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// reader reads the data of a file through its extents, holes and unwritten
+// extents are read as zeros.
+type reader struct {
+	fsys    *FS
+	extents []extent
+	size    int64
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	bs := r.fsys.sb.blockSize
+	for n < len(p) {
+		pos := off + int64(n)
+		chunk := p[n:]
+		e := r.extent(uint64(pos / bs))
+		if e == nil || int64(e.offset)*bs > pos {
+			// hole
+			if e != nil && int64(e.offset)*bs-pos < int64(len(chunk)) {
+				chunk = chunk[:int64(e.offset)*bs-pos]
+			}
+			n += zero(chunk)
+			continue
+		}
+
+		within := pos - int64(e.offset)*bs
+		if available := int64(e.count)*bs - within; int64(len(chunk)) > available {
+			chunk = chunk[:available]
+		}
+		if e.unwritten {
+			n += zero(chunk)
+			continue
+		}
+		m, rerr := r.fsys.r.ReadAt(chunk, r.fsys.fsbOffset(e.block)+within)
+		n += m
+		if rerr != nil && !(rerr == io.EOF && m == len(chunk)) {
+			return n, rerr
+		}
+	}
+	return n, err
+}
+
+// extent returns the extent that contains the block or the next extent.
+func (r *reader) extent(block uint64) *extent {
+	i := sort.Search(len(r.extents), func(i int) bool {
+		return r.extents[i].offset+r.extents[i].count > block
+	})
+	if i == len(r.extents) {
+		return nil
+	}
+	return &r.extents[i]
+}
+
+func zero(b []byte) int {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b)
+}
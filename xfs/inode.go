@@ -0,0 +1,240 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package xfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+const (
+	inodeMagic  = "IN"
+	inodeCoreV2 = 100
+	inodeCoreV3 = 176
+
+	formatDev     = 0
+	formatLocal   = 1
+	formatExtents = 2
+	formatBtree   = 3
+
+	modeTypeMask = 0170000
+	modeDir      = 0040000
+	modeRegular  = 0100000
+	modeSymlink  = 0120000
+
+	bmbtHeaderV4  = 24
+	bmbtHeaderV5  = 72
+	maxBtreeLevel = 16
+)
+
+type inode struct {
+	ino      uint64
+	mode     uint16
+	format   uint8
+	uid, gid uint32
+	nlink    uint32
+	size     int64
+	atime    time.Time
+	mtime    time.Time
+	ctime    time.Time
+	crtime   time.Time
+	nextents uint32
+	fork     []byte // data fork literal area
+}
+
+func (in *inode) isDir() bool { return in.mode&modeTypeMask == modeDir }
+
+func (in *inode) fileMode() fs.FileMode {
+	m := fs.FileMode(in.mode & 0777)
+	switch in.mode & modeTypeMask {
+	case modeDir:
+		m |= fs.ModeDir
+	case modeSymlink:
+		m |= fs.ModeSymlink
+	case modeRegular:
+	default:
+		m |= fs.ModeIrregular
+	}
+	return m
+}
+
+func timestamp(b []byte) time.Time {
+	return time.Unix(int64(int32(be32(b))), int64(be32(b[4:]))).UTC()
+}
+
+func (fsys *FS) inode(ino uint64) (*inode, error) {
+	sb := &fsys.sb
+	agino := ino & (1<<(sb.agBlockLog+sb.inopbLog) - 1)
+	agno := ino >> (sb.agBlockLog + sb.inopbLog)
+	agbno := agino >> sb.inopbLog
+	offset := int64(agino&(1<<sb.inopbLog-1)) * sb.inodeSize
+	if uint32(agno) >= sb.agCount {
+		return nil, fmt.Errorf("xfs: invalid inode number %d", ino)
+	}
+
+	b := make([]byte, sb.inodeSize)
+	pos := (int64(agno)*sb.agBlocks+int64(agbno))*sb.blockSize + offset
+	if _, err := fsys.r.ReadAt(b, pos); err != nil {
+		return nil, err
+	}
+	if string(b[:2]) != inodeMagic {
+		return nil, fmt.Errorf("xfs: invalid inode %d", ino)
+	}
+
+	in := &inode{
+		ino:      ino,
+		mode:     be16(b[2:]),
+		format:   b[5],
+		uid:      be32(b[8:]),
+		gid:      be32(b[12:]),
+		nlink:    be32(b[16:]),
+		atime:    timestamp(b[32:]),
+		mtime:    timestamp(b[40:]),
+		ctime:    timestamp(b[48:]),
+		size:     int64(be64(b[56:])),
+		nextents: be32(b[76:]),
+	}
+
+	core := int64(inodeCoreV2)
+	if b[4] == 3 {
+		core = inodeCoreV3
+		in.crtime = timestamp(b[144:])
+	}
+	end := sb.inodeSize
+	if forkoff := int64(b[82]); forkoff != 0 {
+		end = core + forkoff*8
+	}
+	if end > sb.inodeSize || end < core {
+		return nil, fmt.Errorf("xfs: invalid fork offset in inode %d", ino)
+	}
+	in.fork = b[core:end]
+	return in, nil
+}
+
+type extent struct {
+	offset    uint64 // in file system blocks
+	block     uint64
+	count     uint64
+	unwritten bool
+}
+
+func parseExtent(b []byte) extent {
+	hi, lo := be64(b), be64(b[8:])
+	return extent{
+		unwritten: hi>>63 != 0,
+		offset:    (hi >> 9) & (1<<54 - 1),
+		block:     (hi&(1<<9-1))<<43 | lo>>21,
+		count:     lo & (1<<21 - 1),
+	}
+}
+
+// extents returns the sorted extent list of the data fork.
+func (fsys *FS) extents(in *inode) (extents []extent, err error) {
+	switch in.format {
+	case formatExtents:
+		if int(in.nextents)*16 > len(in.fork) {
+			return nil, fmt.Errorf("xfs: invalid extent count in inode %d", in.ino)
+		}
+		for i := 0; i < int(in.nextents); i++ {
+			extents = append(extents, parseExtent(in.fork[i*16:]))
+		}
+	case formatBtree:
+		extents, err = fsys.btreeRoot(in.fork)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("xfs: inode %d has no extents", in.ino)
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+	return extents, nil
+}
+
+// btreeRoot walks an extent B+tree starting at the root in the inode.
+func (fsys *FS) btreeRoot(fork []byte) ([]extent, error) {
+	if len(fork) < 4 {
+		return nil, errors.New("xfs: invalid btree root")
+	}
+	level, numrecs := int(be16(fork)), int(be16(fork[2:]))
+	maxrecs := (len(fork) - 4) / 16
+	if level == 0 || numrecs > maxrecs {
+		return nil, errors.New("xfs: invalid btree root")
+	}
+
+	var extents []extent
+	ptrs := fork[4+maxrecs*8:]
+	for i := 0; i < numrecs; i++ {
+		child, err := fsys.btreeBlock(be64(ptrs[i*8:]), level-1)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, child...)
+	}
+	return extents, nil
+}
+
+func (fsys *FS) btreeBlock(fsb uint64, level int) ([]extent, error) {
+	if level >= maxBtreeLevel {
+		return nil, errors.New("xfs: btree too deep")
+	}
+	b, err := fsys.readBlock(fsb)
+	if err != nil {
+		return nil, err
+	}
+	header := bmbtHeaderV4
+	if fsys.sb.v5 {
+		header = bmbtHeaderV5
+	}
+	if int(be16(b[4:])) != level {
+		return nil, fmt.Errorf("xfs: invalid btree block %d", fsb)
+	}
+	numrecs := int(be16(b[6:]))
+
+	var extents []extent
+	if level == 0 {
+		if header+numrecs*16 > len(b) {
+			return nil, fmt.Errorf("xfs: invalid btree block %d", fsb)
+		}
+		for i := 0; i < numrecs; i++ {
+			extents = append(extents, parseExtent(b[header+i*16:]))
+		}
+		return extents, nil
+	}
+
+	maxrecs := (len(b) - header) / 16
+	if numrecs > maxrecs {
+		return nil, fmt.Errorf("xfs: invalid btree block %d", fsb)
+	}
+	ptrs := b[header+maxrecs*8:]
+	for i := 0; i < numrecs; i++ {
+		child, err := fsys.btreeBlock(be64(ptrs[i*8:]), level-1)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, child...)
+	}
+	return extents, nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+// Package xfs provides a read-only io/fs implementation of the XFS file
+// system.
+//
+// Version 4 and 5 file systems are supported. Files are read through their
+// extent lists or extent B+trees, directories can be stored in short form,
+// block, leaf, node or B+tree format. Real-time devices and external logs are
+// not supported.
+package xfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+const (
+	superblockMagic = "XFSB"
+	superblockSize  = 512
+
+	versionMask = 0x000f
+	version5    = 5
+
+	version2FType = 0x00000200
+	incompatFType = 0x00000001
+	dirLeafOffset = 1 << 35
+)
+
+// Match checks if the buffer starts with a XFS superblock.
+func Match(buf []byte) bool {
+	return len(buf) >= 4 && string(buf[:4]) == superblockMagic
+}
+
+func be16(b []byte) uint16 { return binary.BigEndian.Uint16(b) }
+func be32(b []byte) uint32 { return binary.BigEndian.Uint32(b) }
+func be64(b []byte) uint64 { return binary.BigEndian.Uint64(b) }
+
+type superblock struct {
+	blockSize   int64
+	rootIno     uint64
+	agBlocks    int64
+	agCount     uint32
+	inodeSize   int64
+	blockLog    uint8
+	inopbLog    uint8
+	agBlockLog  uint8
+	dirBlockLog uint8
+	v5          bool
+	ftype       bool
+}
+
+// FS implements a read-only file system for XFS.
+type FS struct {
+	r  io.ReaderAt
+	sb superblock
+}
+
+// New creates a new xfs FS.
+func New(r io.ReaderAt) (*FS, error) {
+	b := make([]byte, superblockSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	if !Match(b) {
+		return nil, errors.New("xfs: invalid superblock")
+	}
+
+	sb := superblock{
+		blockSize:   int64(be32(b[4:])),
+		rootIno:     be64(b[56:]),
+		agBlocks:    int64(be32(b[84:])),
+		agCount:     be32(b[88:]),
+		inodeSize:   int64(be16(b[104:])),
+		blockLog:    b[120],
+		inopbLog:    b[123],
+		agBlockLog:  b[124],
+		dirBlockLog: b[192],
+	}
+	version := be16(b[100:]) & versionMask
+	switch {
+	case version == version5:
+		sb.v5 = true
+		sb.ftype = be32(b[216:])&incompatFType != 0
+	case version == 4:
+		sb.ftype = be32(b[200:])&version2FType != 0
+	default:
+		return nil, fmt.Errorf("xfs: unsupported version %d", version)
+	}
+	if sb.blockSize == 0 || sb.blockSize != 1<<sb.blockLog || sb.inodeSize < 256 || sb.agBlocks == 0 {
+		return nil, errors.New("xfs: invalid superblock geometry")
+	}
+
+	return &FS{r: r, sb: sb}, nil
+}
+
+// Open opens a file or directory for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	in, err := fsys.inode(fsys.sb.rootIno)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	base := "."
+	if name != "." {
+		for _, part := range strings.Split(name, "/") {
+			if !in.isDir() {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			entries, err := fsys.readDir(in)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			var found *DirEntry
+			for _, entry := range entries {
+				if entry.name == part {
+					found = entry
+					break
+				}
+			}
+			if found == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			if in, err = fsys.inode(found.ino); err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+		base = name[strings.LastIndex(name, "/")+1:]
+	}
+	return &File{fsys: fsys, inode: in, name: base}, nil
+}
+
+// fsbOffset returns the byte offset of a file system block number.
+func (fsys *FS) fsbOffset(fsb uint64) int64 {
+	agno := fsb >> fsys.sb.agBlockLog
+	agbno := fsb & (1<<fsys.sb.agBlockLog - 1)
+	return (int64(agno)*fsys.sb.agBlocks + int64(agbno)) * fsys.sb.blockSize
+}
+
+func (fsys *FS) readBlock(fsb uint64) ([]byte, error) {
+	b := make([]byte, fsys.sb.blockSize)
+	_, err := fsys.r.ReadAt(b, fsys.fsbOffset(fsb))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
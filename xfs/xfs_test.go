@@ -0,0 +1,278 @@
+// Copyright (c) 2019-2020 Siemens AG
+// Copyright (c) 2019-2021 Jonas Plum
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// Author(s): Jonas Plum
+
+package xfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+const (
+	testBlockSize = 4096
+	testInodeSize = 512
+	testAGBlocks  = 64
+)
+
+type testImage struct {
+	b  []byte
+	v5 bool
+}
+
+func fsb(agno, agbno uint64) uint64 { return agno<<6 | agbno }
+
+// ftype returns the file type of the test inodes, "link" has no file type in
+// the directory entry.
+func ftype(ino uint64) byte {
+	switch ino {
+	case 64, 66, 69:
+		return ftypeDir
+	case 68:
+		return 0
+	default:
+		return ftypeRegular
+	}
+}
+
+func (img *testImage) block(fsb uint64) []byte {
+	off := (int64(fsb>>6)*testAGBlocks + int64(fsb&63)) * testBlockSize
+	return img.b[off : off+testBlockSize]
+}
+
+func extentBytes(offset, block, count uint64, unwritten bool) []byte {
+	b := make([]byte, 16)
+	hi := offset<<9 | block>>43
+	if unwritten {
+		hi |= 1 << 63
+	}
+	binary.BigEndian.PutUint64(b, hi)
+	binary.BigEndian.PutUint64(b[8:], block<<21|count)
+	return b
+}
+
+func (img *testImage) inode(ino uint64, mode uint16, format uint8, size int64, nextents int, fork []byte) {
+	agino := ino & (1<<9 - 1)
+	b := img.block(fsb(ino>>9, agino>>3))[(agino&7)*testInodeSize:]
+	copy(b, inodeMagic)
+	binary.BigEndian.PutUint16(b[2:], mode)
+	b[4] = 2
+	core := inodeCoreV2
+	if img.v5 {
+		b[4] = 3
+		core = inodeCoreV3
+	}
+	b[5] = format
+	binary.BigEndian.PutUint32(b[16:], 1)
+	binary.BigEndian.PutUint32(b[40:], 1600000000)
+	binary.BigEndian.PutUint64(b[56:], uint64(size))
+	binary.BigEndian.PutUint32(b[76:], uint32(nextents))
+	copy(b[core:testInodeSize], fork)
+}
+
+func (img *testImage) dirBlock(b []byte, block bool, entries map[string]uint64, names ...string) {
+	magic, header := dirDataMagicV4, dirHeaderV4
+	if block {
+		magic = dirBlockMagicV4
+	}
+	if img.v5 {
+		magic, header = dirDataMagicV5, dirHeaderV5
+		if block {
+			magic = dirBlockMagicV5
+		}
+	}
+	copy(b, magic)
+
+	p := header
+	if !block {
+		// unused space at the start of the data block
+		binary.BigEndian.PutUint16(b[p:], dirFreeTag)
+		binary.BigEndian.PutUint16(b[p+2:], 16)
+		p += 16
+	}
+	for _, name := range names {
+		binary.BigEndian.PutUint64(b[p:], entries[name])
+		b[p+8] = byte(len(name))
+		copy(b[p+9:], name)
+		b[p+9+len(name)] = ftype(entries[name])
+		p += (8 + 1 + len(name) + 1 + 2 + 7) &^ 7
+	}
+	binary.BigEndian.PutUint16(b[p:], dirFreeTag)
+	binary.BigEndian.PutUint16(b[p+2:], uint16(testBlockSize-p))
+	if block {
+		binary.BigEndian.PutUint16(b[p+2:], uint16(testBlockSize-p-8-len(names)*8))
+		binary.BigEndian.PutUint32(b[testBlockSize-8:], uint32(len(names)))
+	}
+}
+
+func newTestImage(v5 bool) *testImage {
+	img := &testImage{b: make([]byte, 2*testAGBlocks*testBlockSize), v5: v5}
+
+	sb := img.b
+	copy(sb, superblockMagic)
+	binary.BigEndian.PutUint32(sb[4:], testBlockSize)
+	binary.BigEndian.PutUint64(sb[8:], 2*testAGBlocks)
+	binary.BigEndian.PutUint64(sb[56:], 64)
+	binary.BigEndian.PutUint32(sb[84:], testAGBlocks)
+	binary.BigEndian.PutUint32(sb[88:], 2)
+	binary.BigEndian.PutUint16(sb[104:], testInodeSize)
+	binary.BigEndian.PutUint16(sb[106:], testBlockSize/testInodeSize)
+	sb[120], sb[122], sb[123], sb[124] = 12, 9, 3, 6
+	if v5 {
+		binary.BigEndian.PutUint16(sb[100:], 0xb4a5)
+		binary.BigEndian.PutUint32(sb[216:], incompatFType)
+	} else {
+		binary.BigEndian.PutUint16(sb[100:], 0xb4a4)
+		binary.BigEndian.PutUint32(sb[200:], version2FType)
+	}
+
+	// root directory in short form
+	root := []byte{6, 0, 0, 0, 0, 64}
+	for _, e := range []struct {
+		name string
+		ino  uint32
+	}{{"hello.txt", 65}, {"sub", 66}, {"btree.bin", 67}, {"link", 68}, {"big", 69}, {"far.txt", 544}} {
+		root = append(root, byte(len(e.name)), 0, 0)
+		root = append(root, e.name...)
+		root = append(root, ftype(uint64(e.ino)), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(root[len(root)-4:], e.ino)
+	}
+	img.inode(64, modeDir|0755, formatLocal, int64(len(root)), 0, root)
+
+	img.inode(65, modeRegular|0644, formatExtents, 11, 1, extentBytes(0, fsb(0, 20), 1, false))
+	copy(img.block(fsb(0, 20)), "hello world")
+
+	// block directory with a sparse file
+	img.inode(66, modeDir|0755, formatExtents, testBlockSize, 1, extentBytes(0, fsb(0, 21), 1, false))
+	img.dirBlock(img.block(fsb(0, 21)), true, map[string]uint64{".": 66, "..": 64, "nested.txt": 70}, ".", "..", "nested.txt")
+	img.inode(70, modeRegular|0644, formatExtents, 2*testBlockSize, 1, extentBytes(1, fsb(0, 22), 1, false))
+	copy(img.block(fsb(0, 22)), bytes.Repeat([]byte("n"), testBlockSize))
+
+	// file with an extent btree and an unwritten extent
+	maxrecs := (testInodeSize - inodeCoreV2 - 4) / 16
+	if v5 {
+		maxrecs = (testInodeSize - inodeCoreV3 - 4) / 16
+	}
+	btreeRoot := make([]byte, 4+maxrecs*16)
+	binary.BigEndian.PutUint16(btreeRoot, 1)
+	binary.BigEndian.PutUint16(btreeRoot[2:], 1)
+	binary.BigEndian.PutUint64(btreeRoot[4+maxrecs*8:], fsb(0, 30))
+	img.inode(67, modeRegular|0644, formatBtree, 3*testBlockSize, 3, btreeRoot)
+	leaf := img.block(fsb(0, 30))
+	header := bmbtHeaderV4
+	copy(leaf, "BMAP")
+	if v5 {
+		header = bmbtHeaderV5
+		copy(leaf, "BMA3")
+	}
+	binary.BigEndian.PutUint16(leaf[6:], 3)
+	copy(leaf[header:], extentBytes(0, fsb(0, 31), 1, false))
+	copy(leaf[header+16:], extentBytes(1, fsb(0, 32), 1, true))
+	copy(leaf[header+32:], extentBytes(2, fsb(0, 33), 1, false))
+	copy(img.block(fsb(0, 31)), bytes.Repeat([]byte("1"), testBlockSize))
+	copy(img.block(fsb(0, 32)), bytes.Repeat([]byte("2"), testBlockSize))
+	copy(img.block(fsb(0, 33)), bytes.Repeat([]byte("3"), testBlockSize))
+
+	img.inode(68, modeSymlink|0777, formatLocal, 9, 0, []byte("hello.txt"))
+
+	// leaf directory with two data blocks and a leaf block
+	fork := append(extentBytes(0, fsb(0, 40), 2, false), extentBytes(dirLeafOffset/testBlockSize, fsb(0, 42), 1, false)...)
+	img.inode(69, modeDir|0755, formatExtents, 3*testBlockSize, 2, fork)
+	entries := map[string]uint64{".": 69, "..": 64, "a": 65, "b": 66}
+	img.dirBlock(img.block(fsb(0, 40)), false, entries, ".", "..", "a")
+	img.dirBlock(img.block(fsb(0, 41)), false, entries, "b")
+	copy(img.block(fsb(0, 42)), "garbage")
+
+	img.inode(544, modeRegular|0600, formatExtents, 8, 1, extentBytes(0, fsb(1, 10), 1, false))
+	copy(img.block(fsb(1, 10)), "far away")
+	return img
+}
+
+func TestFS(t *testing.T) {
+	for _, v5 := range []bool{false, true} {
+		img := newTestImage(v5)
+		fsys, err := New(bytes.NewReader(img.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fstest.TestFS(fsys, "hello.txt", "sub/nested.txt", "btree.bin", "link", "big/a", "big/b", "far.txt"); err != nil {
+			t.Errorf("v5 %v: %v", v5, err)
+		}
+
+		want := map[string][]byte{
+			"hello.txt":      []byte("hello world"),
+			"link":           []byte("hello.txt"),
+			"far.txt":        []byte("far away"),
+			"sub/nested.txt": append(make([]byte, testBlockSize), bytes.Repeat([]byte("n"), testBlockSize)...),
+			"btree.bin": bytes.Join([][]byte{
+				bytes.Repeat([]byte("1"), testBlockSize),
+				make([]byte, testBlockSize),
+				bytes.Repeat([]byte("3"), testBlockSize),
+			}, nil),
+		}
+		for name, data := range want {
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("v5 %v: ReadFile(%s) = %q, want %q", v5, name, got[:16], data[:16])
+			}
+		}
+
+		info, err := fs.Stat(fsys, "link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			t.Errorf("v5 %v: link mode = %s", v5, info.Mode())
+		}
+		if _, err := fsys.Open("hello.txt/x"); err == nil {
+			t.Errorf("v5 %v: Open() of a path below a file succeeded", v5)
+		}
+
+		entries, err := fs.ReadDir(fsys, "sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			f, err := entry.(*DirEntry).Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(f)
+			if err != nil || !bytes.Equal(got, want["sub/"+entry.Name()]) {
+				t.Errorf("v5 %v: Open() of entry %s = %d bytes, %v", v5, entry.Name(), len(got), err)
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(bytes.NewReader(make([]byte, 1024))); err == nil {
+		t.Error("New() error = nil for empty image")
+	}
+}